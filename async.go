@@ -0,0 +1,153 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	pathpkg "path"
+
+	"kylelemons.net/go/esource"
+)
+
+// JobsPath is the name of the synthetic node under the root which holds the
+// status of asynchronous writes.
+const JobsPath = "_jobs"
+
+// maxJobs is the number of jobs whose status is retained.
+const maxJobs = 100
+
+// Job statuses
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// A Job is the status of an asynchronous write.
+type Job struct {
+	ID     string
+	Method string
+	Path   string
+	Status string
+	Code   int    // the status code of the write, once it completes
+	Result string // the body or error message of the write, once it completes
+}
+
+// wantsAsync returns true if the client has asked for r to be processed
+// asynchronously and obj allows it.
+func (obj *Object) wantsAsync(r *http.Request) bool {
+	if !obj.top().AllowAsync {
+		return false
+	}
+	switch r.Method {
+	case "POST", "PUT", "DELETE", "PATCH":
+	default:
+		return false
+	}
+	return prefers(r, "respond-async")
+}
+
+// serveAsync responds to r with 202 Accepted and the path of a job which
+// performs the write in the background, as handle would.  The conditional
+// headers of r are checked before the write is accepted, as well as when it
+// is performed.
+func (obj *Object) serveAsync(w http.ResponseWriter, r *http.Request) {
+	unlock := obj.lockRead()
+	code, err := obj.checkPreconditions(r)
+	unlock()
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	body, err := obj.readBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err, http.StatusBadRequest))
+		return
+	}
+	req := new(http.Request)
+	*req = *r
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	top := obj.top()
+	top.jobs.Lock()
+	top.jobs.next++
+	job := &Job{
+		ID:     strconv.Itoa(top.jobs.next),
+		Method: r.Method,
+		Path:   obj.path,
+		Status: JobRunning,
+	}
+	if top.jobs.byID == nil {
+		top.jobs.byID = map[string]*Job{}
+	}
+	top.jobs.byID[job.ID] = job
+	top.jobs.order = append(top.jobs.order, job.ID)
+	for len(top.jobs.order) > maxJobs {
+		delete(top.jobs.byID, top.jobs.order[0])
+		top.jobs.order = top.jobs.order[1:]
+	}
+	top.jobs.Unlock()
+
+	status := "/" + pathpkg.Join(JobsPath, job.ID)
+	obj.emit(esource.Event{
+		Type: "job",
+		Data: status,
+	})
+
+	go func() {
+		code, buf, err := obj.handle(http.Header{}, req)
+
+		top.jobs.Lock()
+		job.Code, job.Status = code, JobDone
+		if buf != nil {
+			job.Result = buf.String()
+		}
+		if err != nil {
+			job.Status, job.Result = JobFailed, err.Error()
+		}
+		top.jobs.Unlock()
+
+		obj.emit(esource.Event{
+			Type: "job",
+			Data: status,
+		})
+	}()
+
+	w.Header().Set("Content-Type", PlainText)
+	w.Header().Set("Location", status)
+	w.Header().Set("Content-Length", strconv.Itoa(len(status)+1))
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, status)
+}
+
+// findJob returns a synthetic, read-only object holding a snapshot of the
+// status of the job with the given ID.
+func (obj *Object) findJob(id string) (*Object, bool) {
+	obj.jobs.Lock()
+	defer obj.jobs.Unlock()
+	job, ok := obj.jobs.byID[id]
+	if !ok {
+		return nil, false
+	}
+	path := []string{"", JobsPath, id}
+	return newObject(path, reflect.ValueOf(*job), nil, obj.ESource, tagOptions{}), true
+}
@@ -0,0 +1,47 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"errors"
+	"net/http"
+)
+
+// An Authorizer decides whether the request r may perform method on the
+// object at path.  It returns nil to allow the request.  Returning
+// ErrUnauthorized rejects the request with 401 Unauthorized; any other error
+// rejects it with 403 Forbidden.
+type Authorizer func(r *http.Request, path, method string) error
+
+// ErrUnauthorized can be returned by an Authorizer to indicate that the
+// client has not authenticated, rather than that it is not allowed.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// authorize returns the status code with which to reject r, which targets
+// path, or 0 if the tree containing obj allows it.
+func (obj *Object) authorize(r *http.Request, path string) (int, error) {
+	auth := obj.top().Authorizer
+	if auth == nil {
+		return 0, nil
+	}
+	switch err := auth(r, path, r.Method); err {
+	case nil:
+		return 0, nil
+	case ErrUnauthorized:
+		return http.StatusUnauthorized, err
+	default:
+		return http.StatusForbidden, err
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxSafeInteger is the largest integer which JavaScript can represent
+// exactly, and the default threshold for the bignum option.
+const maxSafeInteger = 1<<53 - 1
+
+// isNumberType returns true if typ (or the type it points to) is numeric.
+func isNumberType(typ reflect.Type) bool {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// bigNumString returns the JSON encoding of the number v as a string if its
+// magnitude is larger than limit.
+func bigNumString(v reflect.Value, limit float64) (string, bool) {
+	var f float64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = v.Float()
+	default:
+		return "", false
+	}
+	if math.Abs(f) <= limit {
+		return "", false
+	}
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// unquoteBigNums returns data, which holds a JSON value of type typ with the
+// given options, with the strings holding bignum leaves replaced by the
+// numbers they contain.  This allows them to be written in either form.
+func unquoteBigNums(data []byte, typ reflect.Type, opts tagOptions) []byte {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if opts.bigNum > 0 {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return data
+		}
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return data
+		}
+		return []byte(s)
+	}
+
+	if typ.Kind() != reflect.Struct {
+		return data
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	changed := false
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+		fopts, _ := parseTag(field.Tag.Get("rest"))
+		for key, raw := range fields {
+			// encoding/json matches keys to fields without regard to case
+			if !strings.EqualFold(key, name) {
+				continue
+			}
+			if fixed := unquoteBigNums(raw, field.Type, fopts); !bytes.Equal(fixed, raw) {
+				fields[key] = fixed
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return data
+	}
+	fixed, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return fixed
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	pathpkg "path"
+)
+
+// A Bulk is the response to GET /path?paths=a,b,c, which fetches the
+// values at several paths below an object at once.
+type Bulk struct {
+	// Values holds the value at each path which could be read, by its
+	// full path.
+	Values map[string]interface{} `json:"values"`
+
+	// Errors holds the reason each other path could not be read.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// getPaths writes the values at the comma-separated paths in list, which are
+// relative to obj.  Each path must be readable by the client (see
+// Authorizer).  The caller must hold obj.rw, which covers the paths.
+func (obj *Object) getPaths(w io.Writer, headers http.Header, r *http.Request, list string) (int, error) {
+	bulk := Bulk{Values: map[string]interface{}{}}
+	fail := func(path string, err error) {
+		if bulk.Errors == nil {
+			bulk.Errors = map[string]string{}
+		}
+		bulk.Errors[path] = err.Error()
+	}
+	for _, rel := range strings.Split(list, ",") {
+		path := pathpkg.Join(obj.path, rel)
+		if _, err := obj.authorize(r, path); err != nil {
+			fail(path, err)
+			continue
+		}
+		target, missing := obj.find(strings.Split(rel, "/"))
+		if len(missing) > 0 {
+			fail(path, fmt.Errorf("%s not found", path))
+			continue
+		}
+		if _, err := target.checkReadable(nil, "GET"); err != nil {
+			fail(path, err)
+			continue
+		}
+		bulk.Values[path] = target.viewData()
+	}
+	return encodeAccepted(w, headers, r, reflect.ValueOf(bulk))
+}
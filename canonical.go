@@ -0,0 +1,139 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// writeCanonical writes v to w as canonical JSON followed by a newline.  In
+// canonical JSON, the keys of every object (including those from structs)
+// are sorted, there is no insignificant whitespace, and numbers are written
+// in a single form: integers without a fraction or exponent, and other
+// numbers in the shortest form that round-trips, using an exponent only
+// for very large or very small magnitudes.
+func writeCanonical(w io.Writer, v interface{}, escapeHTML bool) error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(escapeHTML)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(buf)
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return err
+	}
+
+	out := new(bytes.Buffer)
+	if err := canonicalize(out, generic, escapeHTML); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(w)
+	return err
+}
+
+func canonicalize(buf *bytes.Buffer, v interface{}, escapeHTML bool) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		num, err := canonicalNumber(v)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(num)
+	case string:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(escapeHTML)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		buf.Truncate(buf.Len() - 1) // remove the newline added by Encode
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := canonicalize(buf, elem, escapeHTML); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := canonicalize(buf, key, escapeHTML); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := canonicalize(buf, v[key], escapeHTML); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("cannot canonicalize %T", v)
+	}
+	return nil
+}
+
+// canonicalNumber returns the canonical form of the JSON number n.
+func canonicalNumber(n json.Number) (string, error) {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		// Integers are kept exactly, since they may not fit in a float64.
+		if s == "-0" {
+			return "0", nil
+		}
+		return s, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", err
+	}
+	if f == 0 {
+		return "0", nil
+	}
+	if abs := math.Abs(f); abs < 1e-6 || abs >= 1e21 {
+		// Use an exponent without leading zeros, e.g. 1e-7 instead of 1e-07.
+		s = strconv.FormatFloat(f, 'e', -1, 64)
+		e := strings.Index(s, "e") + 2 // after the sign of the exponent
+		return s[:e] + strings.TrimLeft(s[e:], "0"), nil
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// A Client makes requests to an Object served over HTTP, encoding and
+// decoding values in the same way as the server.
+type Client struct {
+	// BaseURL is the URL at which the root object is served, such as
+	// "http://localhost:8080/api".
+	BaseURL string
+
+	// HTTPClient is used to make requests.  If it is nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client for the object served at baseURL.
+func NewClient(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// A ClientError is returned by a Client when the server responds with an
+// unexpected status.
+type ClientError struct {
+	Method  string
+	Path    string
+	Code    int    // the HTTP status code
+	Message string // the body of the response
+}
+
+func (e *ClientError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.Path, e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// Get decodes the value at path into out.
+func (c *Client) Get(path string, out interface{}) error {
+	body, err := c.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("GET %s: decoding response: %s", path, err)
+	}
+	return nil
+}
+
+// Post replaces the value at path (or creates it, if it is a new map key)
+// with in.
+func (c *Client) Post(path string, in interface{}) error {
+	_, err := c.send("POST", path, in)
+	return err
+}
+
+// Put appends in to the slice at path, or sets the map entry at path to in.
+// It returns the path of the new element or entry.
+func (c *Client) Put(path string, in interface{}) (newPath string, err error) {
+	body, err := c.send("PUT", path, in)
+	if err != nil {
+		return "", err
+	}
+	if newPath = strings.TrimSpace(string(body)); newPath == "" {
+		// Replacing an existing map entry does not return a path
+		newPath = path
+	}
+	return newPath, nil
+}
+
+// Delete removes the value at path.
+func (c *Client) Delete(path string) error {
+	_, err := c.do("DELETE", path, nil)
+	return err
+}
+
+// send makes a request with in encoded as JSON as the body.
+func (c *Client) send(method, path string, in interface{}) ([]byte, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: encoding request: %s", method, path, err)
+	}
+	return c.do(method, path, bytes.NewReader(data))
+}
+
+// do makes a request and returns the body of a successful response.
+func (c *Client) do(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", ApplicationJSON)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: reading response: %s", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &ClientError{
+			Method:  method,
+			Path:    path,
+			Code:    resp.StatusCode,
+			Message: strings.TrimSpace(string(data)),
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An Encoder writes values in a particular format.
+type Encoder interface {
+	Encode(w io.Writer, v interface{}) error
+	ContentType() string // the value of the Content-Type header for the output
+}
+
+// A Decoder reads values in a particular format.
+type Decoder interface {
+	Decode(r io.Reader, v interface{}) error
+}
+
+// jsonCodec is the built-in encoder and decoder for JSON.  Values encoded
+// with it honor the options described in encodeJSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error { return json.NewEncoder(w).Encode(v) }
+func (jsonCodec) Decode(r io.Reader, v interface{}) error { return json.NewDecoder(r).Decode(v) }
+func (jsonCodec) ContentType() string                     { return ApplicationJSON }
+
+var codecs = struct {
+	sync.RWMutex
+	enc map[string]Encoder
+	dec map[string]Decoder
+}{
+	enc: map[string]Encoder{"application/json": jsonCodec{}},
+	dec: map[string]Decoder{"application/json": jsonCodec{}},
+}
+
+// RegisterEncoder causes GET requests which accept the given MIME type (such
+// as "application/xml") to be answered using enc.  Requests which accept no
+// registered type are answered with JSON.  Package yamlcodec registers an
+// encoder (and decoder) for YAML.
+func RegisterEncoder(mimeType string, enc Encoder) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.enc[strings.ToLower(mimeType)] = enc
+}
+
+// RegisterDecoder causes the bodies of POST, PUT, and PATCH requests with
+// the given MIME type as their Content-Type to be decoded using dec.  Bodies
+// with no Content-Type or an unregistered one are decoded as JSON.
+func RegisterDecoder(mimeType string, dec Decoder) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.dec[strings.ToLower(mimeType)] = dec
+}
+
+// An accepted is a media range from an Accept header.
+type accepted struct {
+	mimeType string
+	q        float64
+}
+
+// acceptedTypes returns the media ranges accepted by r, most preferred
+// first.  Ranges with a quality of zero are omitted.
+func acceptedTypes(r *http.Request) []accepted {
+	var types []accepted
+	for _, header := range r.Header["Accept"] {
+		for _, part := range strings.Split(header, ",") {
+			mt, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if s, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(s, 64); err != nil {
+					continue
+				}
+			}
+			if q > 0 {
+				types = append(types, accepted{mt, q})
+			}
+		}
+	}
+	sort.SliceStable(types, func(i, j int) bool { return types[i].q > types[j].q })
+	return types
+}
+
+// encoderFor returns the registered encoder for the most preferred type
+// accepted by r, or the JSON encoder if there is none.
+func encoderFor(r *http.Request) Encoder {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	for _, a := range acceptedTypes(r) {
+		if a.mimeType == "*/*" {
+			break
+		}
+		if enc, ok := codecs.enc[a.mimeType]; ok {
+			return enc
+		}
+		if prefix := strings.TrimSuffix(a.mimeType, "*"); prefix != a.mimeType {
+			if strings.HasPrefix("application/json", prefix) {
+				break
+			}
+			var names []string
+			for name := range codecs.enc {
+				if strings.HasPrefix(name, prefix) {
+					names = append(names, name)
+				}
+			}
+			if len(names) > 0 {
+				sort.Strings(names)
+				return codecs.enc[names[0]]
+			}
+		}
+	}
+	return codecs.enc["application/json"]
+}
+
+// prefersPlainText returns true if r accepts plain text at least as much as
+// any type with a registered encoder.  Requests with no Accept header, or
+// which accept anything, prefer plain text.
+func prefersPlainText(r *http.Request) bool {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	for _, a := range acceptedTypes(r) {
+		switch a.mimeType {
+		case "text/plain", "text/*", "*/*":
+			return true
+		}
+		if _, ok := codecs.enc[a.mimeType]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeAccepted writes v to w using the encoder for the Accept header of r.
+// JSON is written with encodeJSON.
+func encodeAccepted(w io.Writer, headers http.Header, r *http.Request, v reflect.Value) (int, error) {
+	enc := encoderFor(r)
+	headers.Add("Vary", "Accept")
+	if _, ok := enc.(jsonCodec); ok {
+		return encodeJSON(w, headers, r, v)
+	}
+	headers.Set("Content-Type", enc.ContentType())
+	if err := enc.Encode(w, v.Interface()); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("encode %s: %s", v.Type(), err)
+	}
+	return http.StatusOK, nil
+}
+
+// decoderFor returns the registered decoder for the Content-Type of r, or
+// nil if the body should be decoded as JSON.
+func decoderFor(r *http.Request) Decoder {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	dec := codecs.dec[mt]
+	if _, ok := dec.(jsonCodec); ok {
+		return nil
+	}
+	return dec
+}
+
+// decodeBody decodes a value of the given type from data, the body of r,
+// using the decoder for its Content-Type.  Without one, it is the same as
+// decodeValue, except that JSON is decoded strictly if strict is set (see
+// decodeJSON).
+func decodeBody(r *http.Request, data []byte, typ reflect.Type, stringer, strict bool) (reflect.Value, error) {
+	dec := decoderFor(r)
+	if dec == nil && strict && !stringer {
+		return decodeJSON(bytes.NewReader(data), typ, true)
+	}
+	if dec == nil {
+		return decodeValue(bytes.NewReader(data), typ, stringer)
+	}
+	ptr := reflect.New(typ)
+	if err := dec.Decode(bytes.NewReader(data), ptr.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("failed to decode body as %s: %s", r.Header.Get("Content-Type"), err)
+	}
+	return ptr.Elem(), nil
+}
@@ -0,0 +1,346 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// elements returns the elements of the slice or array held by obj.
+func (obj *Object) elements() ([]reflect.Value, error) {
+	v := indirect(obj.root)
+	if k := v.Kind(); k != reflect.Slice && k != reflect.Array {
+		return nil, fmt.Errorf("%s is not a slice", obj.path)
+	}
+	elems := make([]reflect.Value, v.Len())
+	for i := range elems {
+		elems[i] = v.Index(i)
+	}
+	return elems, nil
+}
+
+// itemCount returns the number of elements in the slice, array, or map held
+// by obj.  The second return value is false if obj does not hold one.
+func (obj *Object) itemCount() (int, bool) {
+	if isNil(obj.root) {
+		return 0, false
+	}
+	switch v := indirect(obj.root); v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len(), true
+	}
+	return 0, false
+}
+
+// structField returns the value of the named field of the struct held by v.
+// The name is the JSON name of the field (see findField).  The second return
+// value is false if v is nil, or the field is promoted through a nil embedded
+// pointer.  Fields tagged `rest:"wo"` cannot be read, just as with a GET.
+func structField(v reflect.Value, name string) (reflect.Value, bool, error) {
+	if isNil(v) {
+		return reflect.Value{}, false, nil
+	}
+	v = indirect(v)
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false, fmt.Errorf("%s is not a struct", v.Type())
+	}
+	field, ok := findField(v.Type(), name)
+	if !ok {
+		return reflect.Value{}, false, fmt.Errorf("%s has no field %q", v.Type(), name)
+	}
+	if opts, _ := parseTag(field.Tag.Get("rest")); opts.writeOnly {
+		return reflect.Value{}, false, &statusError{http.StatusMethodNotAllowed, fmt.Sprintf("field %q is write-only", name)}
+	}
+	fv, ok := fieldByIndex(v, field.Index)
+	return fv, ok, nil
+}
+
+// findField returns the field of the struct type typ which is encoded with
+// the given JSON name, which may be promoted from an embedded struct (see
+// visibleFields).  As when encoding/json decodes an object, a field whose
+// name matches exactly is preferred, but otherwise the case of the name is
+// ignored.  Fields which aren't encoded, such as those tagged `json:"-"`, are
+// never found.
+func findField(typ reflect.Type, name string) (visibleField, bool) {
+	var fold *visibleField
+	fields := visibleFields(typ)
+	for i := range fields {
+		switch field := &fields[i]; {
+		case field.name == name:
+			return *field, true
+		case fold == nil && strings.EqualFold(field.name, name):
+			fold = field
+		}
+	}
+	if fold != nil {
+		return *fold, true
+	}
+	return visibleField{}, false
+}
+
+// less reports whether a sorts before b.  The second return value is false
+// if the values cannot be ordered.
+func less(a, b reflect.Value) (bool, bool) {
+	a, b = indirect(a), indirect(b)
+	if !a.IsValid() || !b.IsValid() || a.Kind() != b.Kind() {
+		return false, false
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint(), true
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float(), true
+	case reflect.String:
+		return a.String() < b.String(), true
+	case reflect.Bool:
+		return !a.Bool() && b.Bool(), true
+	}
+	return false, false
+}
+
+// getDistinct writes the distinct values of the named field across the
+// elements of the slice of structs held by obj.  Values which can be ordered
+// are sorted; others are listed in the order in which they first appear.
+func (obj *Object) getDistinct(w io.Writer, headers http.Header, r *http.Request, field string) (int, error) {
+	elems, err := obj.elements()
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	seen := map[string]bool{}
+	var values []reflect.Value
+	for _, elem := range elems {
+		v, ok, err := structField(elem, field)
+		if err != nil {
+			return errorCode(err, http.StatusBadRequest), err
+		}
+		if !ok {
+			continue
+		}
+		key, err := json.Marshal(visibleValue(v))
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		values = append(values, v)
+	}
+
+	sortable := true
+	for i := 1; i < len(values) && sortable; i++ {
+		_, sortable = less(values[0], values[i])
+	}
+	if sortable {
+		sort.SliceStable(values, func(i, j int) bool {
+			lt, _ := less(values[i], values[j])
+			return lt
+		})
+	}
+
+	list := make([]interface{}, len(values))
+	for i, v := range values {
+		list[i] = visibleValue(v)
+	}
+	return encodeJSON(w, headers, r, reflect.ValueOf(list))
+}
+
+// getSorted writes the elements of the slice of structs held by obj ordered
+// by the named field, or in descending order if the name starts with "-".
+// Elements which are nil sort last.  The stored slice is not changed.
+func (obj *Object) getSorted(w io.Writer, headers http.Header, r *http.Request, field string) (int, error) {
+	desc := strings.HasPrefix(field, "-")
+	field = strings.TrimPrefix(field, "-")
+
+	elems, err := obj.elements()
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	keys := make([]reflect.Value, len(elems))
+	var first reflect.Value
+	for i, elem := range elems {
+		v, ok, err := structField(elem, field)
+		if err != nil {
+			return errorCode(err, http.StatusBadRequest), err
+		}
+		if !ok {
+			continue
+		}
+		keys[i] = v
+		if !first.IsValid() {
+			first = v
+		}
+		if _, ok := less(first, v); !ok {
+			return http.StatusBadRequest, fmt.Errorf("cannot sort by field %q of type %s", field, v.Type())
+		}
+	}
+
+	order := make([]int, len(elems))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := keys[order[i]], keys[order[j]]
+		if !a.IsValid() || !b.IsValid() {
+			return a.IsValid()
+		}
+		if desc {
+			a, b = b, a
+		}
+		lt, _ := less(a, b)
+		return lt
+	})
+
+	list := make([]interface{}, len(elems))
+	for i, idx := range order {
+		if child, ok := obj.child[strconv.Itoa(idx)]; ok {
+			list[i] = child.viewData()
+		} else {
+			list[i] = visibleValue(elems[idx])
+		}
+	}
+	return encodeJSON(w, headers, r, reflect.ValueOf(list))
+}
+
+// getEntries writes the map held by obj as a JSON array of
+// {"key": ..., "value": ...} objects ordered by key, which is the form
+// accepted by postEntries.  Keys are written as strings (in the form used in
+// paths) unless they are numbers.
+func (obj *Object) getEntries(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	m := obj.deref()
+	if m.kind != reflect.Map {
+		return http.StatusBadRequest, fmt.Errorf("%s is not a map", obj.path)
+	}
+
+	keys := m.root.MapKeys()
+	sort.SliceStable(keys, func(i, j int) bool {
+		if lt, ok := less(keys[i], keys[j]); ok {
+			return lt
+		}
+		return keyString(keys[i]) < keyString(keys[j])
+	})
+
+	list := make([]jsonObject, len(keys))
+	for i, k := range keys {
+		var key interface{} = keyString(k)
+		if isNumberType(k.Type()) {
+			key = k.Interface()
+		}
+		var val interface{}
+		if child, ok := m.child[keyString(k)]; ok {
+			val = child.viewData()
+		} else {
+			val = visibleValue(m.root.MapIndex(k))
+		}
+		list[i] = jsonObject{{"key", key}, {"value", val}}
+	}
+	return encodeJSON(w, headers, r, reflect.ValueOf(list))
+}
+
+// An entry is a key and value in a bulk map update.
+type entry struct {
+	Key   json.RawMessage
+	Value json.RawMessage
+}
+
+// postEntries sets each of the keys in data, which is a JSON array of
+// {"key": ..., "value": ...} objects, in the map held by obj.  All values are
+// decoded and checked before any are set, so that either every entry is set
+// or none are, and an event is fired for each key.  If strict is set, the
+// values are decoded strictly (see decodeJSON).
+func (obj *Object) postEntries(data []byte, strict bool) (int, error) {
+	var entries []entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("failed to decode body as JSON entries: %s", err)
+	}
+
+	m := obj.deref()
+	targets := make([]*Object, len(entries))
+	values := make([]reflect.Value, len(entries))
+	seen := map[string]bool{}
+	for i, e := range entries {
+		var key string
+		if err := json.Unmarshal(e.Key, &key); err != nil {
+			// Allow non-string keys (such as numbers) to be given directly
+			key = string(bytes.TrimSpace(e.Key))
+		}
+		if key == "" {
+			return http.StatusBadRequest, fmt.Errorf("entry %d has no key", i)
+		}
+		target, ok := m.child[key]
+		if !ok {
+			if target = m.newChild(key); target == nil {
+				return http.StatusBadRequest, fmt.Errorf("cannot add keys to %s", m.path)
+			}
+		}
+		var v reflect.Value
+		var err error
+		if strict && !target.isStringer() {
+			v, err = decodeJSON(bytes.NewReader(e.Value), target.typ, true)
+		} else {
+			v, err = decodeValue(bytes.NewReader(e.Value), target.typ, target.isStringer())
+		}
+		if err == nil {
+			err = target.restrictFields(e.Value, v)
+		}
+		if err == nil {
+			err = target.checkSet(v)
+		}
+		if err == nil && seen[key] && m.opts.createOnly {
+			err = &statusError{http.StatusConflict, fmt.Sprintf("key %q already exists", key)}
+		}
+		if err != nil {
+			return errorCode(err, http.StatusBadRequest), fmt.Errorf("entry %q: %s", key, err)
+		}
+		seen[key] = true
+		targets[i], values[i] = target, v
+	}
+
+	for i, target := range targets {
+		if _, err := target.apply("post", values[i], true); err != nil {
+			return errorCode(err, http.StatusBadRequest), fmt.Errorf("entry %q: %s", target.name, err)
+		}
+	}
+	return http.StatusNoContent, nil
+}
+
+// A countingWriter counts the bytes written to it and discards them.
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// getSize writes the number of bytes in the body of a GET of obj (with the
+// same encoding options as r).
+func (obj *Object) getSize(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	var n countingWriter
+	if code, err := encodeJSON(&n, http.Header{}, r, obj.view()); err != nil {
+		return code, err
+	}
+	return encodeJSON(w, headers, r, reflect.ValueOf(int64(n)))
+}
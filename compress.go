@@ -0,0 +1,121 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressMinSize is the size of the smallest response body which is
+// compressed unless CompressMinSize is set.  Smaller bodies are not worth
+// the CPU time.
+const DefaultCompressMinSize = 1024
+
+// acceptsGzip returns true if r has an Accept-Encoding header which allows
+// gzip.  An explicit gzip coding takes precedence over a "*".
+func acceptsGzip(r *http.Request) bool {
+	explicit, star := -1.0, -1.0
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(header, ",") {
+			params := strings.Split(coding, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					var err error
+					if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+						q = 0
+					}
+				}
+			}
+			if name == "gzip" {
+				explicit = q
+			} else {
+				star = q
+			}
+		}
+	}
+	if explicit >= 0 {
+		return explicit > 0
+	}
+	return star > 0
+}
+
+// compress returns the gzip compression of body if the tree containing obj
+// is configured to compress bodies of its size and compression makes it
+// smaller.  The second return value is false if body should be sent as-is.
+func (obj *Object) compress(body []byte) ([]byte, bool) {
+	top := obj.top()
+	min := top.CompressMinSize
+	if min == 0 {
+		min = DefaultCompressMinSize
+	}
+	if min < 0 || len(body) < min {
+		return nil, false
+	}
+	level := top.CompressLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	buf := new(bytes.Buffer)
+	gz, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := gz.Write(body); err != nil {
+		return nil, false
+	}
+	if err := gz.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(body) {
+		// Not worth making the client decompress it
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// writeBody writes the response with the given code and body to w,
+// compressing the body if the client accepts it.  The response to a HEAD
+// request has only the Content-Length of the body, which is left out if the
+// body is empty (see Head).
+func (obj *Object) writeBody(w http.ResponseWriter, r *http.Request, code int, body *bytes.Buffer) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		if gz, ok := obj.compress(body.Bytes()); ok {
+			w.Header().Set("Content-Encoding", "gzip")
+			body = bytes.NewBuffer(gz)
+		}
+	}
+	if r.Method == "HEAD" {
+		if body.Len() > 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		}
+		w.WriteHeader(code)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(code)
+	body.WriteTo(w)
+}
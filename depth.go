@@ -0,0 +1,102 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// getDepth writes the value of obj with everything more than depth levels
+// below its children replaced by a {"$ref": path} link.  At depth 0, each
+// child of obj is a link.  Only the nodes which are written are visited.
+func (obj *Object) getDepth(w io.Writer, headers http.Header, r *http.Request, depth string) (int, error) {
+	n, err := strconv.Atoi(depth)
+	if err != nil || n < 0 {
+		return http.StatusBadRequest, fmt.Errorf("invalid depth %q", depth)
+	}
+	val := obj.truncate(n)
+	return encodeJSON(w, headers, r, reflect.ValueOf(&val).Elem())
+}
+
+// truncate returns the view of obj with its children truncated at depth.
+func (obj *Object) truncate(depth int) interface{} {
+	if obj.isLeaf() || obj.opaque() {
+		return obj.viewData()
+	}
+	child := func(c *Object) interface{} {
+		if depth == 0 {
+			return jsonObject{{"$ref", c.path}}
+		}
+		return c.truncate(depth - 1)
+	}
+
+	o := obj.deref()
+	switch v := indirect(o.root); v.Kind() {
+	case reflect.Struct:
+		omitEmpty := obj.top().OmitEmpty
+		var fields jsonObject
+		for _, field := range visibleFields(v.Type()) {
+			if ropts, _ := parseTag(field.Tag.Get("rest")); ropts.writeOnly {
+				continue
+			}
+			fv, ok := fieldByIndex(v, field.Index)
+			if !ok {
+				continue
+			}
+			if (omitEmpty || strings.Contains(field.opts, ",omitempty")) && isEmptyValue(fv) {
+				continue
+			}
+			if c, ok := o.child[field.name]; ok {
+				fields = append(fields, jsonField{field.name, child(c)})
+			} else {
+				fields = append(fields, jsonField{field.name, visibleValue(fv)})
+			}
+		}
+		return fields
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		keys := make([]string, 0, len(o.child))
+		for key := range o.child {
+			keys = append(keys, key)
+		}
+		o.sortKeys(keys)
+		fields := make(jsonObject, len(keys))
+		for i, key := range keys {
+			fields[i] = jsonField{key, child(o.child[key])}
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			if c, ok := o.child[strconv.Itoa(i)]; ok {
+				list[i] = child(c)
+			} else {
+				list[i] = visibleValue(v.Index(i))
+			}
+		}
+		return list
+	}
+	return obj.viewData()
+}
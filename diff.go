@@ -0,0 +1,124 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	pathpkg "path"
+)
+
+// A Change is a single difference between two values.  Changes are also the
+// data of the events for writes when ValueEvents is set.
+type Change struct {
+	Op   string      // "add", "remove", or "replace"
+	Path string      // the path of the changed value
+	Old  interface{} `json:",omitempty"` // the old value (for remove and replace)
+	New  interface{} `json:",omitempty"` // the new value (for add and replace)
+}
+
+// writeDiff writes the changes that would be made by replacing the value of
+// obj with v as a JSON array, without changing obj.  This is used for writes
+// with a "Prefer: diff" header.
+func (obj *Object) writeDiff(w io.Writer, headers http.Header, r *http.Request, v reflect.Value) (int, error) {
+	old, err := generic(obj.view())
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	proposed := newObject(strings.Split(obj.path, "/"), v, nil, obj.ESource, obj.opts)
+	new, err := generic(proposed.view())
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	changes := diffValues(obj.path, old, new, []Change{})
+	return encodeJSON(w, headers, r, reflect.ValueOf(changes))
+}
+
+// generic returns the value which results from encoding v as JSON and
+// decoding it into an interface{}.
+func generic(v reflect.Value) (interface{}, error) {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	var g interface{}
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// diffValues appends the changes between the generic JSON values old and new
+// (which are at path) to changes.
+func diffValues(path string, old, new interface{}, changes []Change) []Change {
+	switch o := old.(type) {
+	case map[string]interface{}:
+		n, ok := new.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(o)+len(n))
+		for key := range o {
+			keys = append(keys, key)
+		}
+		for key := range n {
+			if _, ok := o[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sub := pathpkg.Join(path, key)
+			ov, inOld := o[key]
+			nv, inNew := n[key]
+			switch {
+			case !inOld:
+				changes = append(changes, Change{Op: "add", Path: sub, New: nv})
+			case !inNew:
+				changes = append(changes, Change{Op: "remove", Path: sub, Old: ov})
+			default:
+				changes = diffValues(sub, ov, nv, changes)
+			}
+		}
+		return changes
+	case []interface{}:
+		n, ok := new.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(o) || i < len(n); i++ {
+			sub := pathpkg.Join(path, strconv.Itoa(i))
+			switch {
+			case i >= len(o):
+				changes = append(changes, Change{Op: "add", Path: sub, New: n[i]})
+			case i >= len(n):
+				changes = append(changes, Change{Op: "remove", Path: sub, Old: o[i]})
+			default:
+				changes = diffValues(sub, o[i], n[i], changes)
+			}
+		}
+		return changes
+	}
+	if !reflect.DeepEqual(old, new) {
+		changes = append(changes, Change{Op: "replace", Path: path, Old: old, New: new})
+	}
+	return changes
+}
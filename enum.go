@@ -0,0 +1,148 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// enum returns the values allowed for obj.  These come from the tag of obj
+// itself or, for the elements of a collection, from the tag of the
+// collection.
+func (obj *Object) enum() []string {
+	if obj.opts.enum != nil {
+		return obj.opts.enum
+	}
+	if p := obj.parent; p != nil && p.elem != obj {
+		switch indirect(p.root).Kind() {
+		case reflect.Map, reflect.Slice, reflect.Array:
+			return p.opts.enum
+		}
+	}
+	return nil
+}
+
+// enumString returns the string which is compared against the values of an
+// enum tag for v: the string itself for strings, and the JSON encoding for
+// other values.
+func enumString(v reflect.Value) string {
+	if isStringerType(v.Type()) {
+		if s, ok := stringify(v).(string); ok {
+			return s
+		}
+	}
+	if v.Kind() == reflect.String {
+		return v.String()
+	}
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprint(v.Interface())
+	}
+	return string(b)
+}
+
+// checkEnums returns an error if v is not one of the values in enum or if
+// any value within v does not match the enum tag which applies to it.  If v
+// is a collection, enum applies to its elements.
+func checkEnums(v reflect.Value, enum []string) error {
+	if isNil(v) {
+		return nil
+	}
+	v = indirect(v)
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := checkEnums(v.Index(i), enum); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			if err := checkEnums(v.MapIndex(key), enum); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if enum != nil {
+		s := enumString(v)
+		for _, allowed := range enum {
+			if s == allowed {
+				return nil
+			}
+		}
+		return &statusError{
+			code: http.StatusUnprocessableEntity,
+			msg:  fmt.Sprintf("%q is not one of %s", s, strings.Join(enum, ", ")),
+		}
+	}
+
+	if v.Kind() == reflect.Struct {
+		typ := v.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			if typ.Field(i).PkgPath != "" {
+				continue // skip unexported fields
+			}
+			opts, _ := parseTag(typ.Field(i).Tag.Get("rest"))
+			if err := checkEnums(v.Field(i), opts.enum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enumSchema adds the values in enum to the schema for values of type t.
+// If t is a collection, the values are added to the schema of its elements.
+func enumSchema(schema map[string]interface{}, t reflect.Type, enum []string) {
+	if enum == nil {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			enumSchema(items, t.Elem(), enum)
+		}
+		return
+	case reflect.Map:
+		if elem, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+			enumSchema(elem, t.Elem(), enum)
+		}
+		return
+	}
+
+	values := make([]interface{}, len(enum))
+	for i, s := range enum {
+		values[i] = s
+		if t.Kind() == reflect.String || isStringerType(t) {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err == nil {
+			values[i] = v
+		}
+	}
+	schema["enum"] = values
+}
@@ -0,0 +1,118 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// etag returns the entity tag of the response to r, a GET of obj, which is
+// the ETag header set by Get.  It depends on the encoding of the response
+// (such as its format and ?pretty), as well as on the value of obj.
+func (obj *Object) etag(r *http.Request) (string, error) {
+	buf := new(bytes.Buffer)
+	if _, err := obj.get(buf, http.Header{}, r); err != nil {
+		return "", err
+	}
+	return bodyETag(buf.Bytes()), nil
+}
+
+// getRequest returns a GET request with the headers of r and the given
+// query parameters, for finding the entity tags of the response to a GET.
+func getRequest(r *http.Request, query string) *http.Request {
+	req := r.Clone(r.Context())
+	req.Method = "GET"
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req.URL.RawQuery = query
+	return req
+}
+
+// bodyETag returns the entity tag for a response body.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagMatches returns true if the value of an If-None-Match or If-Match
+// header matches the entity tag.  If strong is set, as it is for If-Match,
+// weak tags never match (RFC 9110, section 13.1.1); otherwise they are
+// compared as if they were strong.
+func etagMatches(header, tag string, strong bool) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if strings.HasPrefix(t, "W/") {
+			if strong {
+				continue
+			}
+			t = t[len("W/"):]
+		}
+		if t == "*" || (t != "" && t == tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch returns 412 Precondition Failed unless the value of the
+// If-Match header of r matches the current entity tag of obj, which is the
+// ETag of a GET of obj with the same Accept header and query parameters as
+// r.  "*" matches any value which exists.  Write-only values have no entity
+// tag, so only "*" matches them.
+func (obj *Object) checkIfMatch(r *http.Request) (int, error) {
+	header := r.Header.Get("If-Match")
+	if !obj.exists() {
+		return http.StatusPreconditionFailed, fmt.Errorf("%s does not exist", obj.path)
+	}
+	var tag string
+	if !obj.writeOnly() {
+		var err error
+		if tag, err = obj.etag(getRequest(r, r.URL.RawQuery)); err != nil {
+			return errorCode(err, http.StatusInternalServerError), err
+		}
+	}
+	if !etagMatches(header, tag, true) {
+		return http.StatusPreconditionFailed, fmt.Errorf("%s has changed", obj.path)
+	}
+	return 0, nil
+}
+
+// getETags writes a JSON object mapping the key of each element of the
+// slice or map held by obj to the element's entity tag.  Clients can use this
+// to find which elements of a collection have changed.
+func (obj *Object) getETags(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	switch indirect(obj.root).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+	default:
+		return http.StatusBadRequest, fmt.Errorf("%s is not a slice or map", obj.path)
+	}
+
+	tags := make(map[string]string, len(obj.child))
+	for key, child := range obj.child {
+		tag, err := child.etag(getRequest(r, ""))
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		tags[key] = tag
+	}
+	return encodeJSON(w, headers, r, reflect.ValueOf(tags))
+}
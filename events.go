@@ -0,0 +1,312 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"kylelemons.net/go/esource"
+)
+
+// The types of the events sent for writes when GranularEvents is set.
+const (
+	EventCreate  = "create"  // a new map entry or slice element was added
+	EventUpdate  = "update"  // the value of an existing leaf was changed
+	EventReplace = "replace" // an existing map, slice, or struct was replaced
+	EventRemove  = "remove"  // the value was removed from its parent
+)
+
+// eventType returns the type of the event for performing op on obj.  It
+// must be called before the tree is changed.
+func (obj *Object) eventType(op string) string {
+	if !obj.top().GranularEvents {
+		return op
+	}
+	switch op {
+	case "put":
+		return EventCreate
+	case "delete":
+		return EventRemove
+	}
+	if !obj.exists() {
+		return EventCreate
+	}
+	switch obj.deref().kind {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return EventReplace
+	}
+	return EventUpdate
+}
+
+// startChange returns the Change for performing op on obj, with the old
+// value filled in, or nil if ValueEvents is not set.  It must be called
+// before the tree is changed.
+func (obj *Object) startChange(op string, created bool) *Change {
+	if !obj.top().ValueEvents {
+		return nil
+	}
+	c := &Change{Op: "replace"}
+	switch {
+	case created:
+		c.Op = "add"
+	case op == "delete":
+		c.Op = "remove"
+	}
+	if !created && obj.exists() && !obj.writeOnly() {
+		c.Old = obj.viewData()
+	}
+	return c
+}
+
+// eventData returns the data for the event for a write to path.  This is
+// the path unless there is a Change, in which case it is the Change (with
+// path and the new value v, if it is valid, filled in) encoded as JSON.
+func eventData(path string, c *Change, v reflect.Value, stringer bool) string {
+	if c == nil {
+		return path
+	}
+	c.Path = path
+	if c.Op != "remove" && v.IsValid() {
+		c.New = visibleValue(v)
+		if stringer {
+			c.New = stringify(v)
+		}
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return path
+	}
+	return string(data)
+}
+
+// emit sends ev to the event source for obj.  The event is recorded as the
+// last event for both the path of obj and the path in the event.
+func (obj *Object) emit(ev esource.Event) {
+	obj.emitFor(ev.Data, ev)
+}
+
+// emitFor is like emit, but the event is recorded for path instead of the
+// path in the event.  It is used for events whose data is not a path.
+func (obj *Object) emitFor(path string, ev esource.Event) {
+	if top := obj.top(); top.KeepLastEvent {
+		top.last.Lock()
+		if top.last.event == nil {
+			top.last.event = map[string]esource.Event{}
+		}
+		top.last.event[obj.path] = ev
+		top.last.event[path] = ev
+		top.last.Unlock()
+	}
+	obj.send(ev)
+}
+
+// DefaultMaxQueuedEvents is the default limit on the number of events
+// waiting to be sent (see MaxQueuedEvents).
+const DefaultMaxQueuedEvents = 1024
+
+// send sends ev to the event source without blocking, since writers call it
+// with locks held and a slow consumer of events must not stall them.  Events
+// which can't be sent right away are queued and sent in order by drain, or
+// dropped if the queue is full.
+func (obj *Object) send(ev esource.Event) {
+	top := obj.top()
+	top.outbox.Lock()
+	defer top.outbox.Unlock()
+	if len(top.outbox.queue) == 0 {
+		select {
+		case obj.ESource.Events <- ev:
+			top.outbox.full = false
+			return
+		default:
+		}
+	}
+	limit := top.MaxQueuedEvents
+	if limit == 0 {
+		limit = DefaultMaxQueuedEvents
+	}
+	if limit > 0 && len(top.outbox.queue) >= limit {
+		if !top.outbox.full {
+			log.Printf("rest: event queue is full (%d events), dropping events until it drains", len(top.outbox.queue))
+		}
+		top.outbox.full = true
+		top.outbox.dropped++
+		return
+	}
+	top.outbox.full = false
+	top.outbox.queue = append(top.outbox.queue, ev)
+	if !top.outbox.draining {
+		top.outbox.draining = true
+		go top.drain(obj.ESource)
+	}
+}
+
+// drain sends the queued events of the tree rooted at obj to es until there
+// are none left.  Each event stays in the queue until it has been sent, so
+// that later events are queued behind it.
+func (obj *Object) drain(es *esource.EventSource) {
+	for {
+		obj.outbox.Lock()
+		if len(obj.outbox.queue) == 0 {
+			obj.outbox.draining = false
+			obj.outbox.Unlock()
+			return
+		}
+		ev := obj.outbox.queue[0]
+		obj.outbox.Unlock()
+
+		es.Events <- ev
+
+		obj.outbox.Lock()
+		obj.outbox.queue = obj.outbox.queue[1:]
+		obj.outbox.Unlock()
+	}
+}
+
+// DroppedEvents returns the number of events for the tree containing obj
+// which were dropped because too many were waiting to be sent (see
+// MaxQueuedEvents).
+func (obj *Object) DroppedEvents() uint64 {
+	top := obj.top()
+	top.outbox.Lock()
+	defer top.outbox.Unlock()
+	return top.outbox.dropped
+}
+
+func (obj *Object) getLastEvent(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	top := obj.top()
+	if !top.KeepLastEvent {
+		return http.StatusBadRequest, fmt.Errorf("last events are not retained")
+	}
+	top.last.Lock()
+	ev, ok := top.last.event[obj.path]
+	top.last.Unlock()
+	if !ok {
+		return http.StatusNoContent, nil
+	}
+	return encodeJSON(w, headers, r, reflect.ValueOf(ev))
+}
+
+// isEventsPath returns true if pieces is the path of the EventsPath of obj,
+// which must be the root.
+func (obj *Object) isEventsPath(pieces []string) bool {
+	name := obj.top().EventsPath
+	return name != "" && obj.parent == nil && len(pieces) == 1 && pieces[0] == name
+}
+
+// serveEventsPath serves the ESource of obj to r, which was made for its
+// EventsPath.  The ESource flushes each event as it is sent and stops when
+// the client goes away.
+func (obj *Object) serveEventsPath(w http.ResponseWriter, r *http.Request, entry *LogEntry) {
+	path := "/" + obj.top().EventsPath
+	entry.Path, entry.Found = path, true
+	if code, err := obj.authorize(r, path); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	entry.Dispatched = r.Method
+	obj.ESource.ServeHTTP(w, r)
+}
+
+// serveEvents serves the event stream of the tree to r, as the ESource does,
+// but with only the events for obj and its descendants.
+func (obj *Object) serveEvents(w http.ResponseWriter, r *http.Request) {
+	ef := &eventFilter{ResponseWriter: w, prefix: obj.path}
+	obj.ESource.ServeHTTP(ef, r)
+	ef.flushPartial()
+}
+
+// eventPath returns the path of the object an event is about, given its
+// data.  This is the data itself unless it is a Change (see ValueEvents).
+func eventPath(data string) string {
+	if !strings.HasPrefix(data, "{") {
+		return data
+	}
+	var c Change
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		return data
+	}
+	return c.Path
+}
+
+// underPath returns true if path is prefix or one of its descendants.
+func underPath(path, prefix string) bool {
+	return prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// An eventFilter is an http.ResponseWriter for a text/event-stream which
+// drops the events that aren't under prefix.  Everything else, such as
+// comments and retry fields, is written unchanged.
+type eventFilter struct {
+	http.ResponseWriter
+	prefix string
+	buf    []byte // the start of an event which hasn't been fully written
+}
+
+func (ef *eventFilter) Write(p []byte) (int, error) {
+	ef.buf = append(ef.buf, p...)
+	for {
+		end := bytes.Index(ef.buf, []byte("\n\n"))
+		if end < 0 {
+			return len(p), nil
+		}
+		frame := ef.buf[:end+2]
+		if ef.keep(frame) {
+			if _, err := ef.ResponseWriter.Write(frame); err != nil {
+				return 0, err
+			}
+		}
+		ef.buf = ef.buf[end+2:]
+	}
+}
+
+// keep returns true if frame has no data or its data is under the prefix.
+func (ef *eventFilter) keep(frame []byte) bool {
+	var data []string
+	for _, line := range strings.Split(string(frame), "\n") {
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if data == nil {
+		return true
+	}
+	return underPath(eventPath(strings.Join(data, "\n")), ef.prefix)
+}
+
+func (ef *eventFilter) Flush() {
+	if f, ok := ef.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flushPartial writes anything left over which isn't a complete event.
+func (ef *eventFilter) flushPartial() {
+	if len(ef.buf) > 0 && ef.keep(ef.buf) {
+		ef.ResponseWriter.Write(ef.buf)
+	}
+	ef.buf = nil
+}
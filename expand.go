@@ -0,0 +1,108 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// getExpanded writes the struct held by obj, or each of the structs in the
+// slice held by obj, with the named reference field (one tagged `rest:"ref"`)
+// replaced by the value of the object it refers to.  References which do not
+// resolve are replaced by null.  Only the named field is expanded, so cycles
+// of references cannot lead to unbounded output.
+func (obj *Object) getExpanded(w io.Writer, headers http.Header, r *http.Request, field string) (int, error) {
+	o := obj.deref()
+	switch indirect(o.root).Kind() {
+	case reflect.Struct:
+		val, err := o.expand(field)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		return encodeJSON(w, headers, r, reflect.ValueOf(&val).Elem())
+	case reflect.Slice, reflect.Array:
+	default:
+		return http.StatusBadRequest, fmt.Errorf("%s is not a struct or slice", obj.path)
+	}
+
+	list := make([]interface{}, indirect(o.root).Len())
+	for i := range list {
+		child, ok := o.child[strconv.Itoa(i)]
+		if !ok {
+			return http.StatusInternalServerError, fmt.Errorf("%s has no element %d", obj.path, i)
+		}
+		val, err := child.deref().expand(field)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		list[i] = val
+	}
+	return encodeJSON(w, headers, r, reflect.ValueOf(list))
+}
+
+// expand returns the view of the struct held by obj with the named reference
+// field replaced by the view of the object it refers to.
+func (obj *Object) expand(name string) (interface{}, error) {
+	if isNil(obj.root) {
+		return nil, nil
+	}
+	v := indirect(obj.root)
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not a struct", obj.path)
+	}
+	field, ok := findField(v.Type(), name)
+	if !ok {
+		return nil, fmt.Errorf("%s has no field %q", v.Type(), name)
+	}
+	if opts, _ := parseTag(field.Tag.Get("rest")); !opts.ref {
+		return nil, fmt.Errorf("field %q is not a reference", name)
+	}
+
+	var ref interface{}
+	fv, _ := fieldByIndex(v, field.Index)
+	var path string
+	if fv.IsValid() {
+		path = fv.String()
+	}
+	if target, missing := obj.top().find(strings.Split(path, "/")); path != "" && len(missing) == 0 {
+		switch {
+		case target.contains(obj):
+			// The target would include obj, and can't be locked for reading
+			// while obj is held without risking a deadlock with a writer
+			// below it, so it is treated as if it didn't resolve.
+		case obj.contains(target):
+			// The caller's lock on obj covers the target.
+			ref = target.viewData()
+		default:
+			// The Locker of the tree is already held with obj.
+			unlock := target.lockTree(shared)
+			ref = target.viewData()
+			unlock()
+		}
+	}
+
+	fields := obj.viewStruct(v)
+	for i := range fields {
+		if fields[i].Name == field.name {
+			fields[i].Value = ref
+		}
+	}
+	return fields, nil
+}
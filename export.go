@@ -0,0 +1,174 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// exportVersion is the version of the format written by Export.
+const exportVersion = 1
+
+// An export is the document written by Export.
+type export struct {
+	Version int
+	Values  []exportValue
+}
+
+// An exportValue is the value at a path in an export, along with the name
+// of its Go type as a hint for readers.
+type exportValue struct {
+	Path  string
+	Type  string
+	Value json.RawMessage
+}
+
+// An ImportError lists the values in an export which could not be applied
+// by Import, along with the reason for each.
+type ImportError struct {
+	Skipped []string
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("import: skipped %d values: %s", len(e.Skipped), strings.Join(e.Skipped, "; "))
+}
+
+// Export writes a JSON document describing the tree below obj to w.  The
+// fields of structs and the entries of maps are listed separately, each
+// with its path and type, so that the document can be imported into a tree
+// whose types have changed since it was written (see Import).  Other values,
+// including slices, are listed whole.
+func (obj *Object) Export(w io.Writer) error {
+	doc := export{Version: exportVersion}
+	unlock := obj.lockRead()
+	err := obj.export(&doc.Values)
+	unlock()
+	if err != nil {
+		return fmt.Errorf("export: %s", err)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(doc)
+}
+
+// export appends the values at and below obj to values.  The caller must
+// hold the lock on obj for reading.
+func (obj *Object) export(values *[]exportValue) error {
+	o := obj.deref()
+	if !isNil(obj.root) && !o.isStringer() {
+		switch indirect(o.root).Kind() {
+		case reflect.Struct, reflect.Map:
+			keys := make([]string, 0, len(o.child))
+			for key := range o.child {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if err := o.child[key].export(values); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	val, err := json.Marshal(obj.viewData())
+	if err != nil {
+		return fmt.Errorf("encode %s: %s", obj.path, err)
+	}
+	*values = append(*values, exportValue{
+		Path:  obj.path,
+		Type:  obj.typ.String(),
+		Value: val,
+	})
+	return nil
+}
+
+// Import sets the values in a document written by Export in the tree below
+// obj.  Values whose paths no longer exist or whose types have changed in an
+// incompatible way are skipped, and are listed in the returned ImportError;
+// all others are applied (and logged to the MutationLog) as if they were
+// posted individually.
+func (obj *Object) Import(r io.Reader) error {
+	var doc export
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return fmt.Errorf("import: %s", err)
+	}
+	if doc.Version != exportVersion {
+		return fmt.Errorf("import: unsupported version %d", doc.Version)
+	}
+
+	var skipped []string
+	for _, ev := range doc.Values {
+		if err := obj.importValue(ev); err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s: %s", ev.Path, err))
+		}
+	}
+	if len(skipped) > 0 {
+		return &ImportError{skipped}
+	}
+	return nil
+}
+
+func (obj *Object) importValue(ev exportValue) error {
+	pieces := strings.Split(ev.Path, "/")[1:]
+	target, missing := obj.find(pieces)
+
+	// Map entries holding structs are exported field by field, so create
+	// the entries themselves as needed.
+	for len(missing) > 1 {
+		entry := target.newChild(missing[0])
+		if entry == nil {
+			return fmt.Errorf("path not found")
+		}
+		v := reflect.Zero(entry.typ)
+		if entry.kind == reflect.Ptr {
+			v = reflect.New(entry.typ.Elem())
+		}
+		if err := entry.setLocked(v); err != nil {
+			return err
+		}
+		target, missing = obj.find(pieces)
+	}
+	if len(missing) == 1 {
+		target = target.newChild(missing[0])
+		missing = nil
+	}
+	if len(missing) > 0 || target == nil {
+		return fmt.Errorf("path not found")
+	}
+
+	data := unquoteBigNums(ev.Value, target.typ, target.opts)
+	v, err := decodeValue(bytes.NewReader(data), target.typ, target.isStringer())
+	if err != nil {
+		return fmt.Errorf("cannot decode %s as %s: %s", ev.Type, target.typ, err)
+	}
+	return target.setLocked(v)
+}
+
+// setLocked sets the value of obj to v, taking the locks which the write
+// requires.
+func (obj *Object) setLocked(v reflect.Value) error {
+	defer obj.lockWrite(false)()
+
+	_, err := obj.apply("post", v, true)
+	return err
+}
@@ -0,0 +1,119 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+
+	pathpkg "path"
+)
+
+// A MethodHandler handles one method on an object, like Get or Post.  It
+// writes the body of the response to w, sets any response headers in
+// headers, and returns the status code.
+type MethodHandler func(w io.Writer, headers http.Header, r *http.Request) (int, error)
+
+// HandleFunc overrides the handling of method requests for the object at
+// relativePath below obj.  The override takes the place of the method
+// (such as Get or Post) which would otherwise be called, and is called in
+// the same way (see MethodHandler).  Methods which are not otherwise
+// supported, such as OPTIONS or custom methods, can be handled too.
+//
+// The override is called while the tree is locked as it would be for the
+// method it replaces (custom methods are locked as writes), so it must not
+// make requests on the tree itself.  It applies to whichever object is at
+// the path when a request is made, so it remains in effect when the value is
+// replaced or the path is removed and added again.
+func (obj *Object) HandleFunc(relativePath, method string, fn func(io.Writer, http.Header, *http.Request) (int, error)) {
+	path := pathpkg.Join(obj.path, relativePath)
+	top := obj.top()
+	top.handlers.Lock()
+	defer top.handlers.Unlock()
+	if top.handlers.byPath == nil {
+		top.handlers.byPath = make(map[string]map[string]MethodHandler)
+	}
+	if top.handlers.byPath[path] == nil {
+		top.handlers.byPath[path] = make(map[string]MethodHandler)
+	}
+	top.handlers.byPath[path][method] = fn
+}
+
+// handlerFor returns the override registered with HandleFunc for method on
+// obj, or nil if there is none.
+func (obj *Object) handlerFor(method string) MethodHandler {
+	top := obj.top()
+	top.handlers.Lock()
+	defer top.handlers.Unlock()
+	return top.handlers.byPath[obj.path][method]
+}
+
+// overriddenMethods returns the methods with overrides registered for obj,
+// in sorted order.
+func (obj *Object) overriddenMethods() []string {
+	top := obj.top()
+	top.handlers.Lock()
+	defer top.handlers.Unlock()
+	var methods []string
+	for method := range top.handlers.byPath[obj.path] {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Use adds mw to the middleware of the tree containing obj.  Each request
+// which is dispatched to a method (such as Get, Post, or an override
+// registered with HandleFunc) calls the method wrapped by the middleware, with
+// the middleware added first outermost.  Middleware can find the path of the
+// object the request resolved to with ResolvedPath, and the method in r.
+//
+// Middleware is called while the tree is locked for the request, so it must
+// not make requests on the tree itself.  (Streamed NDJSON responses are the
+// exception: the tree is locked while each element is encoded instead.)
+func (obj *Object) Use(mw func(next MethodHandler) MethodHandler) {
+	top := obj.top()
+	top.middleware.Lock()
+	defer top.middleware.Unlock()
+	top.middleware.chain = append(top.middleware.chain, mw)
+}
+
+// wrap returns h wrapped by the middleware of the tree containing obj.
+func (obj *Object) wrap(h MethodHandler) MethodHandler {
+	top := obj.top()
+	top.middleware.Lock()
+	defer top.middleware.Unlock()
+	for i := len(top.middleware.chain) - 1; i >= 0; i-- {
+		h = top.middleware.chain[i](h)
+	}
+	return h
+}
+
+type resolvedPathKey struct{}
+
+// withResolvedPath returns r with the path of obj in its context.
+func (obj *Object) withResolvedPath(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), resolvedPathKey{}, obj.path))
+}
+
+// ResolvedPath returns the path of the object to which r was dispatched, or
+// "" if r was not dispatched by an Object.  It can be used by middleware and
+// by handlers registered with HandleFunc.
+func ResolvedPath(r *http.Request) string {
+	path, _ := r.Context().Value(resolvedPathKey{}).(string)
+	return path
+}
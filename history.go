@@ -0,0 +1,133 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// A HistoryEntry is a value which was set on a leaf, as returned by
+// GET /path?history.
+type HistoryEntry struct {
+	Time  time.Time
+	Value json.RawMessage
+}
+
+// A ring holds the most recent entries for a leaf.
+type ring struct {
+	entries []HistoryEntry
+	next    int // the index at which the next entry is stored
+}
+
+func (r *ring) add(e HistoryEntry, size int) {
+	if len(r.entries) < size {
+		r.entries = append(r.entries, e)
+		r.next = len(r.entries) % size
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// newest returns the most recent entry.  There must be at least one.
+func (r *ring) newest() HistoryEntry {
+	n := len(r.entries)
+	return r.entries[(r.next-1+n)%n]
+}
+
+// latest returns the entries from newest to oldest.
+func (r *ring) latest() []HistoryEntry {
+	n := len(r.entries)
+	list := make([]HistoryEntry, n)
+	for i := range list {
+		list[i] = r.entries[(r.next-1-i+2*n)%n]
+	}
+	return list
+}
+
+// recordHistory adds the values of the leaves below obj, which has just been
+// set, to their histories.  If elem is set, obj holds a slice and only the
+// leaves below the named element are recorded.  Leaves whose value has not
+// changed since it was last recorded are skipped.  The caller must hold
+// obj.rw.
+func (obj *Object) recordHistory(name string, elem bool) {
+	top := obj.top()
+	if top.HistorySize <= 0 || obj.parent == nil {
+		return
+	}
+	updated, ok := obj.parent.child[obj.name]
+	if !ok {
+		return
+	}
+	if elem {
+		if updated, ok = updated.deref().child[name]; !ok {
+			return
+		}
+	}
+
+	now := time.Now()
+	top.history.Lock()
+	defer top.history.Unlock()
+	if top.history.leaf == nil {
+		top.history.leaf = map[string]*ring{}
+	}
+	updated.walkLeaves(func(leaf *Object) {
+		val, err := json.Marshal(leaf.viewData())
+		if err != nil {
+			return
+		}
+		r, ok := top.history.leaf[leaf.path]
+		if !ok {
+			r = new(ring)
+			top.history.leaf[leaf.path] = r
+		}
+		if len(r.entries) > 0 && bytes.Equal(r.newest().Value, val) {
+			return
+		}
+		r.add(HistoryEntry{now, val}, top.HistorySize)
+	})
+}
+
+// walkLeaves calls f for each leaf at or below obj.
+func (obj *Object) walkLeaves(f func(*Object)) {
+	if obj.isLeaf() {
+		f(obj)
+		return
+	}
+	for _, child := range obj.deref().child {
+		child.walkLeaves(f)
+	}
+}
+
+// getHistory writes the recent values of the leaf held by obj, newest first.
+func (obj *Object) getHistory(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	top := obj.top()
+	if top.HistorySize <= 0 {
+		return http.StatusBadRequest, fmt.Errorf("history is not retained")
+	}
+	top.history.Lock()
+	list := []HistoryEntry{}
+	if r, ok := top.history.leaf[obj.path]; ok {
+		list = r.latest()
+	}
+	top.history.Unlock()
+	return encodeJSON(w, headers, r, reflect.ValueOf(list))
+}
@@ -0,0 +1,54 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// jsonpName matches the callback names which are allowed for JSONP: a
+// JavaScript identifier, or several separated by dots.
+var jsonpName = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// jsonpCallback returns the JSONP callback requested by r, or "" if there is
+// none or JSONP is not enabled (see EnableJSONP).
+func (obj *Object) jsonpCallback(r *http.Request) (string, error) {
+	callback := r.URL.Query().Get("callback")
+	if callback == "" || r.Method != "GET" || !obj.top().EnableJSONP {
+		return "", nil
+	}
+	if !jsonpName.MatchString(callback) {
+		return "", fmt.Errorf("invalid callback %q", callback)
+	}
+	return callback, nil
+}
+
+// wrapJSONP returns the JSON body wrapped in a call to callback.  Bodies
+// which are not JSON are returned unchanged.
+func wrapJSONP(headers http.Header, callback string, body *bytes.Buffer) *bytes.Buffer {
+	if !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
+		return body
+	}
+	headers.Set("Content-Type", ApplicationJavaScript)
+	// Clients which don't expect a script mustn't sniff one either.
+	headers.Set("X-Content-Type-Options", "nosniff")
+	out := new(bytes.Buffer)
+	fmt.Fprintf(out, "/**/%s(%s);\n", callback, bytes.TrimSpace(body.Bytes()))
+	return out
+}
@@ -0,0 +1,260 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	pathpkg "path"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000 // the data holds the HTTP status code
+)
+
+type rpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcParams struct {
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// JSONRPC returns a handler which serves the tree below obj using JSON-RPC
+// 2.0 over HTTP POST.  Each method takes named parameters, including the
+// path of the object it applies to:
+//
+//	get    {path}        - returns the value at path
+//	set    {path, value} - replaces the value at path (like POST)
+//	delete {path}        - removes the value at path (like DELETE)
+//	list   {path}        - returns the paths of the children of path
+//
+// Batches of requests are processed in order.
+func (obj *Object) JSONRPC() http.Handler {
+	return http.HandlerFunc(obj.serveRPC)
+}
+
+func (obj *Object) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := obj.readBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err, http.StatusBadRequest))
+		return
+	}
+
+	var out interface{}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			out = rpcFailure(nil, rpcParseError, err.Error(), nil)
+		} else if len(batch) == 0 {
+			out = rpcFailure(nil, rpcInvalidRequest, "empty batch", nil)
+		} else {
+			var resps []*rpcResponse
+			for _, req := range batch {
+				if resp := obj.callRPC(r, req); resp != nil {
+					resps = append(resps, resp)
+				}
+			}
+			if len(resps) > 0 {
+				out = resps
+			}
+		}
+	} else if resp := obj.callRPC(r, data); resp != nil {
+		out = resp
+	}
+
+	if out == nil {
+		// Only notifications were sent, so there is nothing to say.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(out)
+}
+
+func rpcFailure(id json.RawMessage, code int, msg string, data interface{}) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{
+		Version: "2.0",
+		Error:   &rpcError{code, msg, data},
+		ID:      id,
+	}
+}
+
+// callRPC performs a single request, sent in the body of r, and returns the
+// response, which is nil for notifications.
+func (obj *Object) callRPC(r *http.Request, data []byte) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return rpcFailure(nil, rpcParseError, err.Error(), nil)
+	}
+	if req.Version != "2.0" || req.Method == "" {
+		return rpcFailure(req.ID, rpcInvalidRequest, "not a JSON-RPC 2.0 request", nil)
+	}
+
+	var params rpcParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return rpcFailure(req.ID, rpcInvalidParams, err.Error(), nil)
+		}
+	}
+
+	var result interface{}
+	var err error
+	switch req.Method {
+	case "get":
+		result, err = obj.rpcGet(r, params.Path)
+	case "set":
+		err = obj.rpcSet(r, params.Path, params.Value)
+	case "delete":
+		err = obj.rpcDelete(r, params.Path)
+	case "list":
+		result, err = obj.rpcList(r, params.Path)
+	default:
+		return rpcFailure(req.ID, rpcMethodNotFound, fmt.Sprintf("unknown method %q", req.Method), nil)
+	}
+
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		code := errorCode(err, http.StatusBadRequest)
+		return rpcFailure(req.ID, rpcServerError, err.Error(), map[string]int{"status": code})
+	}
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	return &rpcResponse{Version: "2.0", Result: result, ID: req.ID}
+}
+
+// resolve returns the object at path, which the Authorizer must allow r to
+// use with the HTTP method equivalent to the call.  If create is set, the
+// path can name a new key in an existing map.
+func (obj *Object) resolve(r *http.Request, method, path string, create bool) (*Object, error) {
+	target, missing := obj.lookup(strings.Split(path, "/"))
+	if len(missing) == 1 && create {
+		if child := target.newChild(missing[0]); child != nil {
+			target, missing = child, nil
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &statusError{http.StatusNotFound, fmt.Sprintf("%s not found", pathpkg.Clean("/"+path))}
+	}
+	req := r.Clone(r.Context())
+	req.Method = method
+	if code, err := obj.authorize(req, target.path); err != nil {
+		return nil, &statusError{code, err.Error()}
+	}
+	return target, nil
+}
+
+func (obj *Object) rpcGet(r *http.Request, path string) (interface{}, error) {
+	target, err := obj.resolve(r, "GET", path, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := target.checkReadable(nil, "GET"); err != nil {
+		return nil, err
+	}
+	defer target.lockRead()()
+	return target.viewData(), nil
+}
+
+func (obj *Object) rpcSet(r *http.Request, path string, value json.RawMessage) error {
+	target, err := obj.resolve(r, "POST", path, true)
+	if err != nil {
+		return err
+	}
+	if len(value) == 0 {
+		return fmt.Errorf("missing value")
+	}
+	if _, err := target.checkWritable(nil, "POST"); err != nil {
+		return err
+	}
+	data := unquoteBigNums(value, target.typ, target.opts)
+	v, err := decodeValue(bytes.NewReader(data), target.typ, target.isStringer())
+	if err != nil {
+		return err
+	}
+	if err := target.restrictFields(data, v); err != nil {
+		return err
+	}
+	return target.setLocked(v)
+}
+
+func (obj *Object) rpcDelete(r *http.Request, path string) error {
+	target, err := obj.resolve(r, "DELETE", path, false)
+	if err != nil {
+		return err
+	}
+	if _, err := target.checkWritable(nil, "DELETE"); err != nil {
+		return err
+	}
+	defer target.lockWrite(true)()
+	_, err = target.apply("delete", reflect.Value{}, true)
+	return err
+}
+
+func (obj *Object) rpcList(r *http.Request, path string) (interface{}, error) {
+	target, err := obj.resolve(r, "GET", path, false)
+	if err != nil {
+		return nil, err
+	}
+	target = target.deref()
+	defer target.lockRead()()
+	paths := make([]string, 0, len(target.child))
+	for _, child := range target.child {
+		if !child.writeOnly() {
+			paths = append(paths, child.path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"reflect"
+	"sync"
+)
+
+// The modes in which a treeLock can be held.
+const (
+	intentShared    = iota // something below the object is being read
+	intentExclusive        // something below the object is being written
+	shared                 // the object and everything below it are being read
+	exclusive              // the object and everything below it are being written
+)
+
+// conflicts[m] lists the modes which must not be held for m to be acquired.
+var conflicts = [...][]int{
+	intentShared:    {exclusive},
+	intentExclusive: {shared, exclusive},
+	shared:          {intentExclusive, exclusive},
+	exclusive:       {intentShared, intentExclusive, shared, exclusive},
+}
+
+// A treeLock guards an object and the tree below it.  A request locks the
+// object it uses for reading or writing, and each of the ancestors of the
+// object (from the root down) with the matching intention.  Requests on
+// disjoint subtrees therefore don't block each other, while a request on an
+// object excludes conflicting requests on its ancestors, which would see the
+// same values.
+type treeLock struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	held [4]int // the number of holders in each mode
+}
+
+// lock blocks until the lock can be held in the given mode.
+func (l *treeLock) lock(mode int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+	for {
+		ok := true
+		for _, m := range conflicts[mode] {
+			ok = ok && l.held[m] == 0
+		}
+		if ok {
+			break
+		}
+		l.cond.Wait()
+	}
+	l.held[mode]++
+}
+
+// unlock releases one hold of the lock in the given mode.
+func (l *treeLock) unlock(mode int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[mode]--; l.held[mode] < 0 {
+		panic("unlock of unlocked treeLock")
+	}
+	if l.cond != nil {
+		l.cond.Broadcast()
+	}
+}
+
+// lockTree locks obj in the given mode and its ancestors with the matching
+// intention, and returns the function which unlocks them all.
+func (obj *Object) lockTree(mode int) (unlock func()) {
+	intent := intentShared
+	if mode == exclusive {
+		intent = intentExclusive
+	}
+	var path []*Object
+	for p := obj.parent; p != nil; p = p.parent {
+		path = append(path, p)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		path[i].rw.lock(intent)
+	}
+	obj.rw.lock(mode)
+	return func() {
+		obj.rw.unlock(mode)
+		for _, p := range path {
+			p.rw.unlock(intent)
+		}
+	}
+}
+
+// contains returns true if other is obj or is in the tree below it.
+func (obj *Object) contains(other *Object) bool {
+	for p := other; p != nil; p = p.parent {
+		if p == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// A readLocker is a Locker (such as a *sync.RWMutex) which can be locked
+// for reading.
+type readLocker interface {
+	RLock()
+	RUnlock()
+}
+
+// lockApp takes the Locker of the tree containing obj, if there is one, and
+// returns the function which releases it.  If write is not set, the Locker
+// is locked for reading if it can be.
+func (obj *Object) lockApp(write bool) (unlock func()) {
+	l := obj.top().Locker
+	if l == nil {
+		return func() {}
+	}
+	if rl, ok := l.(readLocker); ok && !write {
+		rl.RLock()
+		return rl.RUnlock
+	}
+	l.Lock()
+	return l.Unlock
+}
+
+// lockRead locks obj for reading and returns the function which unlocks it.
+// The Locker of the tree (if any) is held too.
+func (obj *Object) lockRead() (unlock func()) {
+	unlockApp := obj.lockApp(false)
+	unlockTree := obj.lockTree(shared)
+	return func() {
+		unlockTree()
+		unlockApp()
+	}
+}
+
+// lockWrite locks the tree for a write to obj and returns the function which
+// unlocks it.  If del is set, the write removes obj from its parent.  The
+// Locker of the tree (if any) is held too.
+//
+// The object which is locked is usually obj itself, since values are
+// replaced in place and their objects are rebuilt in place.  The parent is
+// locked instead when the write changes which children it has: deleting
+// obj, or adding it as a new map key.  A write which stores a value in a map
+// changes the map itself, so the object holding the map is locked too.
+func (obj *Object) lockWrite(del bool) (unlock func()) {
+	scope := obj
+	if (del || obj.detached) && scope.parent != nil {
+		scope = scope.parent
+	}
+	if p := scope.parent; p != nil && p.kind == reflect.Map {
+		scope = p
+	}
+	unlockApp := obj.lockApp(true)
+	unlockTree := scope.lockTree(exclusive)
+	return func() {
+		unlockTree()
+		unlockApp()
+	}
+}
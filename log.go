@@ -0,0 +1,96 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"time"
+)
+
+// A LogEntry describes a request served by an Object, for its Logger.
+type LogEntry struct {
+	Method    string // the method of the request
+	RequestID string // the ID of the request (see RequestID)
+	Path      string // the path of the object the request resolved to
+
+	// Found is set if the path of the request was found.  Otherwise Path
+	// is the path of the request, cleaned.
+	Found bool
+
+	// Dispatched is the method which handled the request (such as "GET"),
+	// or "" if the request was answered before it was dispatched, such as
+	// when it was not found or not authorized.
+	Dispatched string
+
+	Code     int           // the status code of the response
+	Bytes    int64         // the number of bytes of body written
+	Duration time.Duration // the time taken to serve the request
+}
+
+// A Logger is called with a LogEntry after each request is served.
+type Logger func(LogEntry)
+
+// A logWriter records the status and size of a response for a Logger or
+// Metrics.
+type logWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (lw *logWriter) WriteHeader(code int) {
+	if lw.code == 0 {
+		lw.code = code
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	if lw.code == 0 {
+		lw.code = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(p)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter, if it can be flushed, so that
+// streamed responses are still streamed when they are logged.
+func (lw *logWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveLogged serves r with obj and reports the resulting entry to logger
+// and metrics, either of which may be nil.
+func (obj *Object) serveLogged(w http.ResponseWriter, r *http.Request, logger Logger, metrics Metrics) {
+	start := time.Now()
+	lw := &logWriter{ResponseWriter: w}
+	entry := LogEntry{Method: r.Method, RequestID: RequestID(r), Path: r.URL.Path}
+	obj.serve(lw, r, &entry)
+	if lw.code == 0 {
+		lw.code = http.StatusOK
+	}
+	entry.Code, entry.Bytes, entry.Duration = lw.code, lw.bytes, time.Since(start)
+	if logger != nil {
+		logger(entry)
+	}
+	if tm, ok := metrics.(TracedMetrics); ok {
+		tm.ObserveTracedRequest(entry.RequestID, entry.Method, obj.metricPath(entry.Path), entry.Code, entry.Duration)
+	} else if metrics != nil {
+		metrics.ObserveRequest(entry.Method, obj.metricPath(entry.Path), entry.Code, entry.Duration)
+	}
+}
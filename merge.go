@@ -0,0 +1,131 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	pathpkg "path"
+)
+
+// NewMerged returns an object which presents a merged view of the given
+// layers, such as a base configuration followed by overrides.  A GET
+// returns the value at the path in each layer merged together: the keys of
+// JSON objects are combined and, for any other value, the last layer which
+// has a value wins.  Values which are null do not override earlier layers,
+// so override layers should use pointers, maps, or omitempty fields for
+// values they leave unset.
+//
+// Each layer's Authorizer must allow a GET.  All other methods are served by
+// the last layer.  The layers themselves are not changed by the merge and
+// can still be served separately.
+func NewMerged(layers ...*Object) *Object {
+	if len(layers) == 0 {
+		panic("NewMerged: no layers")
+	}
+	top := layers[len(layers)-1]
+	return &Object{
+		path:    "/",
+		child:   map[string]*Object{},
+		layers:  layers,
+		ESource: top.ESource,
+	}
+}
+
+func (obj *Object) serveMerged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		obj.layers[len(obj.layers)-1].ServeHTTP(w, r)
+		return
+	}
+
+	pieces := strings.Split(r.URL.Path, "/")[1:]
+	var merged interface{}
+	var found bool
+	var listing []string
+	for _, layer := range obj.layers {
+		actual, missing := layer.lookup(pieces)
+		target := pathpkg.Join(append([]string{actual.path}, missing...)...)
+		if code, err := layer.authorize(r, target); err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if len(missing) > 0 {
+			actual.rw.lock(intentShared)
+			for key := range actual.deref().child {
+				listing = append(listing, pathpkg.Join(actual.path, key))
+			}
+			actual.rw.unlock(intentShared)
+			continue
+		}
+		if code, err := actual.checkReadable(w.Header(), r.Method); err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		unlock := actual.lockRead()
+		v, err := generic(actual.view())
+		unlock()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("encode %s: %s", actual.path, err), http.StatusInternalServerError)
+			return
+		}
+		merged, found = mergeValues(merged, v), true
+	}
+
+	if !found {
+		w.Header().Set("Content-Type", PlainText)
+		w.WriteHeader(http.StatusNotFound)
+		sort.Strings(listing)
+		for i, path := range listing {
+			if i > 0 && path == listing[i-1] {
+				continue
+			}
+			fmt.Fprintln(w, path)
+		}
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	code, err := encodeJSON(buf, w.Header(), r, reflect.ValueOf(&merged).Elem())
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	obj.writeBody(w, r, code, buf)
+}
+
+// mergeValues returns the generic JSON value over merged on top of base.
+func mergeValues(base, over interface{}) interface{} {
+	if over == nil {
+		return base
+	}
+	b, ok := base.(map[string]interface{})
+	o, ok2 := over.(map[string]interface{})
+	if !ok || !ok2 {
+		return over
+	}
+	merged := make(map[string]interface{}, len(b)+len(o))
+	for key, val := range b {
+		merged[key] = val
+	}
+	for key, val := range o {
+		merged[key] = mergeValues(b[key], val)
+	}
+	return merged
+}
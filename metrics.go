@@ -0,0 +1,59 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"strings"
+	"time"
+)
+
+// Metrics receives an observation of each request served by an Object, for
+// example to export request counts and latencies to Prometheus.
+type Metrics interface {
+	// ObserveRequest is called after each request with its method, the
+	// top-level path it targeted (such as "/users" for a request for
+	// "/users/42/name", "/" for the root, or UnknownPath), the status code
+	// of the response, and the time taken to serve it.
+	ObserveRequest(method, path string, code int, dur time.Duration)
+}
+
+// UnknownPath is the path observed by Metrics for requests whose top-level
+// path doesn't exist, so that clients can't create any number of distinct
+// paths by requesting them.
+const UnknownPath = "<unknown>"
+
+// metricPath returns the top-level path of path to be observed by Metrics:
+// the first segment of path, if it names a child of the root (or the
+// synthetic jobs or events nodes), and UnknownPath otherwise.
+func (obj *Object) metricPath(path string) string {
+	name := strings.TrimPrefix(path, "/")
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" {
+		return "/"
+	}
+	top := obj.top()
+	if name == JobsPath || name == top.EventsPath {
+		return "/" + name
+	}
+	top.rw.lock(intentShared)
+	_, ok := top.deref().child[name]
+	top.rw.unlock(intentShared)
+	if !ok {
+		return UnknownPath
+	}
+	return "/" + name
+}
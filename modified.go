@@ -0,0 +1,138 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A modNode holds the modification times of a path in the tree, and the
+// nodes for the paths below it which have changed since it was replaced.
+// The nodes are keyed by the elements of the paths, so that a change only
+// visits the nodes for the changed path and its ancestors.
+type modNode struct {
+	at       time.Time // the time of the latest change at or below the path
+	replaced time.Time // the time the path was replaced, if it was
+	child    map[string]*modNode
+}
+
+// pathElems returns the elements of path, which is nil for the root.
+func pathElems(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" || path == "." {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// find returns the node below n for the path with the given elements,
+// creating it if necessary, after setting the time of the latest change of
+// each of its ancestors to now.
+func (n *modNode) find(elems []string, now time.Time) *modNode {
+	for _, name := range elems {
+		n.at = now
+		next, ok := n.child[name]
+		if !ok {
+			if n.child == nil {
+				n.child = map[string]*modNode{}
+			}
+			next = &modNode{}
+			n.child[name] = next
+		}
+		n = next
+	}
+	return n
+}
+
+// markModified records that the value at path was replaced now, which also
+// modifies each of its ancestors.  The times for the paths below it are
+// forgotten, since they inherit the new time.
+func (obj *Object) markModified(path string) {
+	top := obj.top()
+	now := time.Now()
+	top.modified.Lock()
+	defer top.modified.Unlock()
+
+	if top.modified.root == nil {
+		top.modified.root = &modNode{}
+	}
+	n := top.modified.root.find(pathElems(path), now)
+	n.at, n.replaced, n.child = now, now, nil
+}
+
+// markRemoved records that the value at path was removed now, which
+// modifies each of its ancestors.  The times for the path and those below it
+// are forgotten.
+func (obj *Object) markRemoved(path string) {
+	elems := pathElems(path)
+	if len(elems) == 0 {
+		obj.markModified(path)
+		return
+	}
+	top := obj.top()
+	now := time.Now()
+	top.modified.Lock()
+	defer top.modified.Unlock()
+
+	if top.modified.root == nil {
+		top.modified.root = &modNode{}
+	}
+	parent := top.modified.root.find(elems[:len(elems)-1], now)
+	parent.at = now
+	delete(parent.child, elems[len(elems)-1])
+}
+
+// lastModified returns the time at which the value of obj last changed,
+// which is the time of the latest change to it or anything below it.  Values
+// which have not changed themselves get the time at which their closest
+// ancestor was replaced, or the time at which the tree was created.
+func (obj *Object) lastModified() time.Time {
+	top := obj.top()
+	top.modified.Lock()
+	defer top.modified.Unlock()
+
+	t, n := top.modified.start, top.modified.root
+	if n == nil {
+		return t
+	}
+	for _, name := range pathElems(obj.path) {
+		if !n.replaced.IsZero() {
+			t = n.replaced
+		}
+		next, ok := n.child[name]
+		if !ok {
+			return t
+		}
+		n = next
+	}
+	return n.at
+}
+
+// notModifiedSince returns true if r has an If-Modified-Since header and no
+// If-None-Match header (which takes precedence), and modified is no later
+// than the time in the header.
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	if modified.IsZero() || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// HTTP dates only have a resolution of one second
+	return !modified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,120 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+
+	pathpkg "path"
+)
+
+// A Navigation describes the position of an object in its tree.  It is
+// returned by GET /path?nav.  Parent is nil for the root.
+type Navigation struct {
+	Parent   *string  `json:"parent"`
+	Children []string `json:"children"`
+	Siblings []string `json:"siblings"`
+}
+
+// childPaths returns the paths of the children of obj, other than the one
+// named skip, in the order of their keys (see sortKeys).  The caller must
+// hold obj.rw.
+func (obj *Object) childPaths(skip *Object) []string {
+	keys := make([]string, 0, len(obj.child))
+	for key, child := range obj.child {
+		if child != skip {
+			keys = append(keys, key)
+		}
+	}
+	obj.sortKeys(keys)
+	paths := make([]string, len(keys))
+	for i, key := range keys {
+		paths[i] = obj.child[key].path
+	}
+	return paths
+}
+
+// getNav writes the Navigation for obj.  The caller must hold obj.rw.
+func (obj *Object) getNav(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	// Values held by pointers and interfaces are at the same position as
+	// the pointer or interface itself.
+	node := obj
+	for node.parent != nil && node.parent.elem == node {
+		node = node.parent
+	}
+
+	nav := Navigation{
+		Children: obj.deref().childPaths(nil),
+		Siblings: []string{},
+	}
+	// The caller's lock on obj includes an intention to read below the
+	// parent, which keeps its children from changing.
+	if parent := node.parent; parent != nil {
+		nav.Parent = &parent.path
+		nav.Siblings = parent.childPaths(node)
+	}
+	return encodeJSON(w, headers, r, reflect.ValueOf(nav))
+}
+
+// A NotFound is the body of a 404 Not Found response for clients which
+// prefer JSON (or another registered type) to plain text.  It describes the
+// closest existing object to the path which was not found.
+type NotFound struct {
+	Path     string   `json:"path"`     // the path of the closest object
+	Children []string `json:"children"` // the names of its children
+}
+
+// serveNotFound answers a request for a missing path below obj with a
+// listing of the children of obj: their paths, one per line, for clients
+// which accept plain text, or a NotFound for those which prefer another
+// type.  Paths are JSON Pointers if pointers is set.
+func (obj *Object) serveNotFound(w http.ResponseWriter, r *http.Request, pointers bool) {
+	nf := NotFound{Path: obj.path, Children: []string{}}
+	if pointers {
+		nf.Path = obj.pointer()
+	}
+	obj.rw.lock(intentShared)
+	for key, child := range obj.child {
+		if child.writeOnly() {
+			continue
+		}
+		if pointers {
+			key = escapePointer(key)
+		}
+		nf.Children = append(nf.Children, key)
+	}
+	obj.rw.unlock(intentShared)
+	obj.sortKeys(nf.Children)
+
+	if prefersPlainText(r) {
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("Content-Type", PlainText)
+		w.WriteHeader(http.StatusNotFound)
+		for _, child := range nf.Children {
+			fmt.Fprintln(w, pathpkg.Join(nf.Path, child))
+		}
+		return
+	}
+	buf := new(bytes.Buffer)
+	if code, err := encodeAccepted(buf, w.Header(), r, reflect.ValueOf(nf)); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	obj.writeBody(w, r, http.StatusNotFound, buf)
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// ApplicationNDJSON is the Content-Type of newline-delimited JSON, in which
+// each line is a JSON value.
+const ApplicationNDJSON = "application/x-ndjson"
+
+// ndjsonFlushSize is the number of bytes of NDJSON which are buffered before
+// they are flushed to the client.
+const ndjsonFlushSize = 32 << 10
+
+// wantsNDJSON returns true if r is a GET of obj which should be streamed as
+// NDJSON: obj is a slice or array, NDJSON is the most preferred type accepted
+// by r, and there are no query options or overrides which would change the
+// response.
+func (obj *Object) wantsNDJSON(r *http.Request) bool {
+	if r.Method != "GET" || r.URL.RawQuery != "" || obj.handlerFor("GET") != nil {
+		return false
+	}
+	types := acceptedTypes(r)
+	if len(types) == 0 || types[0].mimeType != ApplicationNDJSON {
+		return false
+	}
+	defer obj.lockRead()()
+	switch indirect(obj.deref().root).Kind() {
+	case reflect.Slice, reflect.Array:
+		return true
+	}
+	return false
+}
+
+// serveNDJSON writes the elements of obj to w, one per line, as they are
+// encoded.  Unlike other responses, the body is not buffered, so that the
+// memory used doesn't grow with the size of obj; the output is flushed every
+// ndjsonFlushSize bytes instead.  The tree is locked for reading while each
+// element is encoded, rather than for the whole response, so a slow client
+// doesn't hold up writers; elements added or removed while the response is
+// being written may or may not be included.
+//
+// The response is written by a MethodHandler wrapped by the middleware, like
+// any other, but the status is sent before the first element, so headers
+// set by middleware after it calls the handler are not sent.
+func (obj *Object) serveNDJSON(w http.ResponseWriter, r *http.Request) {
+	started := false
+	stream := func(body io.Writer, headers http.Header, r *http.Request) (int, error) {
+		headers.Add("Vary", "Accept")
+		headers.Set("Content-Type", ApplicationNDJSON)
+		w.WriteHeader(http.StatusOK)
+		started = true
+
+		flusher, _ := body.(http.Flusher)
+		out := bufio.NewWriterSize(body, ndjsonFlushSize)
+		flush := func() {
+			out.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		defer flush()
+
+		var line bytes.Buffer
+		for i := 0; r.Context().Err() == nil; i++ {
+			line.Reset()
+			// The status has already been sent, so if an element can't be
+			// encoded, the best that can be done is to end the response
+			// early.
+			if ok, err := obj.encodeElement(&line, i); !ok || err != nil {
+				break
+			}
+			if out.Available() < line.Len() {
+				flush()
+			}
+			if _, err := line.WriteTo(out); err != nil {
+				break
+			}
+		}
+		return http.StatusOK, nil
+	}
+
+	code, err := obj.wrap(stream)(w, w.Header(), obj.withResolvedPath(r))
+	switch {
+	case started:
+	case err != nil:
+		if code == 0 || code == http.StatusOK {
+			code = http.StatusInternalServerError
+		}
+		http.Error(w, err.Error(), code)
+	default:
+		// The middleware answered the request itself.
+		w.WriteHeader(code)
+	}
+}
+
+// encodeElement writes the JSON encoding of element i of the slice or array
+// obj, followed by a newline, to buf.  It returns false if there is no
+// element i.
+func (obj *Object) encodeElement(buf *bytes.Buffer, i int) (ok bool, err error) {
+	defer obj.lockRead()()
+	o := obj.deref()
+	v := indirect(o.root)
+	if k := v.Kind(); k != reflect.Slice && k != reflect.Array || i >= v.Len() {
+		return false, nil
+	}
+	var data interface{}
+	if child, ok := o.child[strconv.Itoa(i)]; ok {
+		data = child.viewData()
+	} else {
+		data = visibleValue(v.Index(i))
+	}
+	return true, json.NewEncoder(buf).Encode(data)
+}
@@ -0,0 +1,250 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	pathpkg "path"
+)
+
+// OpenAPI returns an OpenAPI 3.0 document describing the paths below obj,
+// the methods they support, and the schemas of their values.  The document
+// is also served in JSON form by GET /?openapi.json.
+//
+// The elements of maps and slices are described by a single templated path
+// (such as /Items/{index}) based on their first element.
+func (obj *Object) OpenAPI() map[string]interface{} {
+	g := &openAPI{
+		paths:   map[string]interface{}{},
+		schemas: map[string]interface{}{},
+	}
+	g.walk(obj, obj.path, nil)
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "rest",
+			"version": "1",
+		},
+		"paths": g.paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+		},
+	}
+}
+
+type openAPI struct {
+	paths   map[string]interface{}
+	schemas map[string]interface{}
+}
+
+// walk adds the path for obj (which is at the given, possibly templated,
+// path) and its children.  The params are the names of the path template
+// parameters used so far.
+func (g *openAPI) walk(obj *Object, path string, params []string) {
+	schema := g.schema(obj.typ)
+	enumSchema(schema, obj.typ, obj.enum())
+	ops := map[string]interface{}{}
+	for _, method := range obj.allowedMethods() {
+		op := map[string]interface{}{}
+		switch method {
+		case "GET":
+			op["responses"] = map[string]interface{}{
+				"200": response("The value at this path", ApplicationJSON, schema),
+			}
+		case "POST":
+			op["requestBody"] = body(ApplicationJSON, schema)
+			op["responses"] = map[string]interface{}{
+				"204": response("The value was replaced", "", nil),
+				"400": response("The value could not be decoded or set", "", nil),
+			}
+			if indirect(obj.root).Kind() == reflect.Slice {
+				op["parameters"] = []interface{}{map[string]interface{}{
+					"name":        "append",
+					"in":          "query",
+					"description": "Append a single element (as with PUT) instead of replacing the slice",
+					"schema":      map[string]interface{}{"type": "boolean"},
+				}}
+				op["responses"].(map[string]interface{})["201"] = response("The path of the appended value", PlainText, map[string]interface{}{"type": "string"})
+			}
+		case "PUT":
+			if obj.putsEntry() {
+				op["requestBody"] = body(ApplicationJSON, schema)
+				op["responses"] = map[string]interface{}{
+					"201": response("The path of the created entry", PlainText, map[string]interface{}{"type": "string"}),
+					"204": response("The entry was replaced", "", nil),
+					"400": response("The value could not be decoded or set", "", nil),
+				}
+				break
+			}
+			elem := g.schema(indirect(obj.root).Type().Elem())
+			enumSchema(elem, indirect(obj.root).Type().Elem(), obj.opts.enum)
+			op["requestBody"] = body(ApplicationJSON, elem)
+			op["responses"] = map[string]interface{}{
+				"201": response("The path of the appended value", PlainText, map[string]interface{}{"type": "string"}),
+				"400": response("The value could not be decoded or appended", "", nil),
+			}
+		default:
+			continue
+		}
+		ops[strings.ToLower(method)] = op
+	}
+	if len(params) > 0 {
+		var list []interface{}
+		for _, param := range params {
+			list = append(list, map[string]interface{}{
+				"name":     param,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		ops["parameters"] = list
+	}
+	g.paths[path] = ops
+
+	keys := make([]string, 0, len(obj.child))
+	for key := range obj.child {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	switch indirect(obj.root).Kind() {
+	case reflect.Struct:
+		for _, key := range keys {
+			g.walk(obj.child[key], pathpkg.Join(path, key), params)
+		}
+	case reflect.Map, reflect.Slice, reflect.Array:
+		if len(keys) == 0 {
+			return
+		}
+		name := "key"
+		if indirect(obj.root).Kind() != reflect.Map {
+			name = "index"
+		}
+		if n := countPrefix(params, name); n > 0 {
+			name += strconv.Itoa(n + 1)
+		}
+		sub := append(params[:len(params):len(params)], name)
+		g.walk(obj.child[keys[0]], pathpkg.Join(path, "{"+name+"}"), sub)
+	}
+}
+
+func countPrefix(list []string, prefix string) (n int) {
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func response(desc, ctype string, schema interface{}) map[string]interface{} {
+	resp := map[string]interface{}{
+		"description": desc,
+	}
+	if ctype != "" {
+		resp["content"] = map[string]interface{}{
+			ctype: map[string]interface{}{"schema": schema},
+		}
+	}
+	return resp
+}
+
+func body(ctype string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"required": true,
+		"content": map[string]interface{}{
+			ctype: map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+// schema returns the JSON schema for values of type t.  Named struct types
+// are added to the component schemas and referenced.
+func (g *openAPI) schema(t reflect.Type) map[string]interface{} {
+	if stringerParser(t) != nil {
+		return map[string]interface{}{"type": "string"}
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		return map[string]interface{}{}
+	}
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = nil // placeholder for recursive types
+			g.schemas[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (g *openAPI) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	for _, field := range visibleFields(t) {
+		name := field.name
+		opts, _ := parseTag(field.Tag.Get("rest"))
+		if opts.stringer {
+			props[name] = map[string]interface{}{"type": "string"}
+			continue
+		}
+		schema := g.schema(field.Type)
+		enumSchema(schema, field.Type, opts.enum)
+		props[name] = schema
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// schemaName returns a component name for the named type t.
+func schemaName(t reflect.Type) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, t.String())
+}
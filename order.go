@@ -0,0 +1,54 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// NumericKeyOrder is a KeyOrder which sorts keys which are integers
+// numerically (so that "9" comes before "10") and before any other keys,
+// which are sorted as strings.
+func NumericKeyOrder(a, b string) bool {
+	ai, aerr := strconv.ParseInt(a, 10, 64)
+	bi, berr := strconv.ParseInt(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil:
+		return ai < bi
+	case aerr == nil:
+		return true
+	case berr == nil:
+		return false
+	}
+	return a < b
+}
+
+// sortKeys sorts the keys of the children of obj.  The indices of a slice
+// or array are sorted numerically, and map keys with the KeyOrder of the
+// tree, or as strings if it has none.
+func (obj *Object) sortKeys(keys []string) {
+	order := obj.top().KeyOrder
+	switch indirect(obj.deref().root).Kind() {
+	case reflect.Slice, reflect.Array:
+		order = NumericKeyOrder
+	}
+	if order == nil {
+		sort.Strings(keys)
+		return
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return order(keys[i], keys[j]) })
+}
@@ -0,0 +1,252 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	pathpkg "path"
+)
+
+// DefaultPageSize is the number of elements on each synthetic page of a
+// slice or array unless the field holding it specifies `rest:"pagesize=N"`.
+const DefaultPageSize = 50
+
+// pageInfo describes a synthetic page of a collection.
+type pageInfo struct {
+	base   string // the path of the collection
+	number int    // the page number, starting at 1
+	size   int    // the number of elements per page
+	total  int    // the number of elements in the collection
+}
+
+func (p *pageInfo) count() int {
+	return (p.total + p.size - 1) / p.size
+}
+
+func (p *pageInfo) setHeaders(headers http.Header) {
+	headers.Set("X-Total-Count", strconv.Itoa(p.total))
+	headers.Set("X-Page-Count", strconv.Itoa(p.count()))
+
+	link := func(n int, rel string) string {
+		return fmt.Sprintf("<%s>; rel=%q", pathpkg.Join(p.base, "page", strconv.Itoa(n)), rel)
+	}
+	var links []string
+	if n := p.number - 1; n >= 1 && n <= p.count() {
+		links = append(links, link(n, "prev"))
+	}
+	if n := p.number + 1; n <= p.count() {
+		links = append(links, link(n, "next"))
+	}
+	if len(links) > 0 {
+		headers.Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// findPage returns a synthetic, read-only object holding a copy of the
+// elements on the given page of a slice or array.  Pages past the end of the
+// collection are empty.  The caller must hold obj.rw in shared mode.
+func (obj *Object) findPage(num string) (*Object, bool) {
+	v := indirect(obj.root)
+	if k := v.Kind(); k != reflect.Slice && k != reflect.Array {
+		return nil, false
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 1 {
+		return nil, false
+	}
+
+	info := &pageInfo{
+		base:   obj.path,
+		number: n,
+		size:   obj.opts.pageSize,
+		total:  v.Len(),
+	}
+	if info.size == 0 {
+		info.size = DefaultPageSize
+	}
+
+	lo, hi := (n-1)*info.size, n*info.size
+	if lo > info.total {
+		lo = info.total
+	}
+	if hi > info.total {
+		hi = info.total
+	}
+	page := reflect.MakeSlice(reflect.SliceOf(v.Type().Elem()), hi-lo, hi-lo)
+	for i := lo; i < hi; i++ {
+		page.Index(i - lo).Set(v.Index(i))
+	}
+
+	ret := obj.snapshot(pathpkg.Join("page", num), page)
+	ret.page = info
+	return ret, true
+}
+
+// snapshot returns a synthetic object at the given path below obj holding
+// val, which is a copy of some of the elements of obj.  It is built like any
+// other object, so fields tagged `rest:"wo"` are left out when it is read,
+// and it has the options of obj, including those inherited from ancestors.
+func (obj *Object) snapshot(name string, val reflect.Value) *Object {
+	opts := obj.opts
+	opts.readOnly, opts.writeOnly = obj.readOnly(), obj.writeOnly()
+	path := strings.Split(pathpkg.Join(obj.path, name), "/")
+	return newObject(path, val, nil, obj.ESource, opts)
+}
+
+// getWindow writes the elements of the slice, array, or map held by obj from
+// the "offset" query parameter (default 0) up to the "limit" parameter
+// (default the page size), along with the total number of elements and the
+// offset of the next window (or null if this is the last).  Map entries are
+// windowed in key order, so that successive windows are consistent.
+func (obj *Object) getWindow(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	query := r.URL.Query()
+	offset, limit := 0, obj.opts.pageSize
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	for name, dst := range map[string]*int{"offset": &offset, "limit": &limit} {
+		val, ok := query[name]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(val[0])
+		if err != nil || n < 0 {
+			return http.StatusBadRequest, fmt.Errorf("invalid %s %q", name, val[0])
+		}
+		*dst = n
+	}
+
+	o := obj.deref()
+	v := indirect(o.root)
+	total := 0
+	if !isNil(o.root) {
+		total = v.Len()
+	}
+	lo, hi := offset, offset+limit
+	if lo > total {
+		lo = total
+	}
+	if hi > total {
+		hi = total
+	}
+
+	var items interface{}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, 0, hi-lo)
+		for i := lo; i < hi; i++ {
+			if child, ok := o.child[strconv.Itoa(i)]; ok {
+				list = append(list, child.viewData())
+				continue
+			}
+			list = append(list, visibleValue(v.Index(i)))
+		}
+		items = list
+	case reflect.Map:
+		keys := v.MapKeys()
+		order := obj.top().KeyOrder
+		sort.SliceStable(keys, func(i, j int) bool {
+			if order != nil {
+				return order(keyString(keys[i]), keyString(keys[j]))
+			}
+			if lt, ok := less(keys[i], keys[j]); ok {
+				return lt
+			}
+			return keyString(keys[i]) < keyString(keys[j])
+		})
+		fields := make(jsonObject, 0, hi-lo)
+		for _, k := range keys[lo:hi] {
+			field := jsonField{Name: keyString(k)}
+			if child, ok := o.child[keyString(k)]; ok {
+				field.Value = child.viewData()
+			} else {
+				field.Value = visibleValue(v.MapIndex(k))
+			}
+			fields = append(fields, field)
+		}
+		items = fields
+	default:
+		return http.StatusBadRequest, fmt.Errorf("%s is not a slice or map", obj.path)
+	}
+
+	var next interface{}
+	if hi < total {
+		next = hi
+	}
+	window := jsonObject{{"items", items}, {"total", total}, {"next", next}}
+	return encodeJSON(w, headers, r, reflect.ValueOf(window))
+}
+
+// findIndex resolves a path element naming elements of the slice or array
+// held by obj other than by their index: a negative index counts back from
+// the end, so -1 is the last element, and a range "lo:hi" is a synthetic
+// view of the elements from lo up to (but not including) hi.  Either end of
+// a range may be omitted or negative.  It returns false if name is not of
+// one of these forms, or is out of range.  The caller must hold obj.rw in
+// shared mode.
+func (obj *Object) findIndex(name string) (*Object, bool) {
+	v := indirect(obj.root)
+	if k := v.Kind(); k != reflect.Slice && k != reflect.Array {
+		return nil, false
+	}
+	n := v.Len()
+	index := func(s string, def int) (int, bool) {
+		if s == "" {
+			return def, true
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, false
+		}
+		if i < 0 {
+			i += n
+		}
+		return i, i >= 0 && i <= n
+	}
+
+	colon := strings.Index(name, ":")
+	if colon < 0 {
+		if !strings.HasPrefix(name, "-") {
+			return nil, false // non-negative indices are children
+		}
+		i, ok := index(name, 0)
+		if !ok || i == n {
+			return nil, false
+		}
+		child, ok := obj.child[strconv.Itoa(i)]
+		return child, ok
+	}
+
+	lo, ok := index(name[:colon], 0)
+	if !ok {
+		return nil, false
+	}
+	hi, ok := index(name[colon+1:], n)
+	if !ok || hi < lo {
+		return nil, false
+	}
+	view := reflect.MakeSlice(reflect.SliceOf(v.Type().Elem()), hi-lo, hi-lo)
+	for i := lo; i < hi; i++ {
+		view.Index(i - lo).Set(v.Index(i))
+	}
+	return obj.snapshot(name, view), true
+}
@@ -0,0 +1,188 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+// Patch applies the JSON merge patch (RFC 7386) in the body of r to the
+// struct or map held by obj.  Only the fields or keys named in the patch are
+// changed; nested objects are merged recursively, and a null removes a map
+// key or sets a field to its zero value.  The patch may be in any format with
+// a registered Decoder, as long as it decodes to a map[string]interface{}.
+// A root which holds a pointer or map is patched in place.
+func (obj *Object) Patch(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	data, err := obj.readBody(r)
+	if err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	var patch map[string]interface{}
+	if dec := decoderFor(r); dec != nil {
+		err = dec.Decode(bytes.NewReader(data), &patch)
+	} else {
+		// Numbers are kept as they were written, so that they can be
+		// decoded exactly into the fields they set.
+		jd := json.NewDecoder(bytes.NewReader(data))
+		jd.UseNumber()
+		err = jd.Decode(&patch)
+	}
+	if err != nil || patch == nil {
+		return http.StatusBadRequest, fmt.Errorf("PATCH body must be an object")
+	}
+
+	cur := obj.root
+	if !cur.IsValid() {
+		cur = reflect.Zero(obj.typ)
+	}
+	v, err := mergePatch(cur, patch)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := obj.restrictFields(data, v); err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	if _, err := obj.apply("patch", v, true); err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	return http.StatusNoContent, nil
+}
+
+// mergePatch returns a copy of v with the merge patch applied to it.  The
+// value held by v is not changed.
+func mergePatch(v reflect.Value, patch map[string]interface{}) (reflect.Value, error) {
+	typ := v.Type()
+	switch typ.Kind() {
+	case reflect.Ptr:
+		elem := reflect.Zero(typ.Elem())
+		if !v.IsNil() {
+			elem = v.Elem()
+		}
+		merged, err := mergePatch(elem, patch)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(typ.Elem())
+		ptr.Elem().Set(merged)
+		return ptr, nil
+	case reflect.Interface:
+		if !v.IsNil() {
+			switch elemType(v.Elem().Type()).Kind() {
+			case reflect.Struct, reflect.Map:
+				return mergePatch(v.Elem(), patch)
+			}
+		}
+		// Merge into an empty object, so that the nulls in the patch are
+		// dropped and its numbers are decoded as they would be by a POST.
+		return mergePatch(reflect.ValueOf(map[string]interface{}{}), patch)
+	case reflect.Struct:
+		out := reflect.New(typ).Elem()
+		out.Set(v)
+		for key, val := range patch {
+			field, ok := findField(typ, key)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("%s has no field %q", typ, key)
+			}
+			fv := settableField(out, field.Index)
+			merged, err := mergeValue(fv, val)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("%s: %s", key, err)
+			}
+			fv.Set(merged)
+		}
+		return out, nil
+	case reflect.Map:
+		out := reflect.MakeMap(typ)
+		if !v.IsNil() {
+			for _, k := range v.MapKeys() {
+				out.SetMapIndex(k, v.MapIndex(k))
+			}
+		}
+		for key, val := range patch {
+			k, err := convertKey(key, typ.Key())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			if val == nil {
+				out.SetMapIndex(k, reflect.Value{})
+				continue
+			}
+			cur := out.MapIndex(k)
+			if !cur.IsValid() {
+				cur = reflect.Zero(typ.Elem())
+			}
+			merged, err := mergeValue(cur, val)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("%s: %s", key, err)
+			}
+			out.SetMapIndex(k, merged)
+		}
+		return out, nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot patch %s", typ)
+}
+
+// settableField returns the field of the struct v at index, which may be
+// promoted through embedded pointers.  Each embedded struct on the way is
+// copied (or allocated, if the pointer is nil), so that setting the field
+// doesn't change a struct which v shares with another value.
+func settableField(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			ptr := reflect.New(v.Type().Elem())
+			if !v.IsNil() {
+				ptr.Elem().Set(v.Elem())
+			}
+			v.Set(ptr)
+			v = ptr.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// mergeValue returns the result of merging the generic JSON value val into
+// cur.  Objects are merged into structs and maps, null is the zero value, and
+// anything else replaces cur.
+func mergeValue(cur reflect.Value, val interface{}) (reflect.Value, error) {
+	typ := cur.Type()
+	if val == nil {
+		return reflect.Zero(typ), nil
+	}
+	if sub, ok := val.(map[string]interface{}); ok && !isStringerType(typ) {
+		switch elemType(typ).Kind() {
+		case reflect.Struct, reflect.Map, reflect.Interface:
+			return mergePatch(cur, sub)
+		}
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return decodeValue(bytes.NewReader(data), typ, isStringerType(typ))
+}
+
+// elemType returns the type to which any pointers in typ point.
+func elemType(typ reflect.Type) reflect.Type {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
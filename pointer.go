@@ -0,0 +1,77 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A request with a PathSchemeHeader of JSONPointer has its path interpreted
+// as a JSON Pointer (RFC 6901), in which "~1" stands for "/" and "~0" for "~"
+// within a key.  Paths in the response (such as the one returned by PUT and
+// the child listing) are also written as JSON Pointers.
+const (
+	PathSchemeHeader = "X-Path-Scheme"
+	JSONPointer      = "json-pointer"
+)
+
+func usesPointers(r *http.Request) bool {
+	return r.Header.Get(PathSchemeHeader) == JSONPointer
+}
+
+var (
+	pointerEscaper   = strings.NewReplacer("~", "~0", "/", "~1")
+	pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+// escapePointer returns the JSON Pointer reference token for key.
+func escapePointer(key string) string {
+	return pointerEscaper.Replace(key)
+}
+
+// unescapePointer returns the key for the JSON Pointer reference token tok.
+func unescapePointer(tok string) (string, error) {
+	for i := 0; i < len(tok); i++ {
+		if tok[i] != '~' {
+			continue
+		}
+		if i+1 == len(tok) || (tok[i+1] != '0' && tok[i+1] != '1') {
+			return "", fmt.Errorf("invalid escape in JSON Pointer token %q", tok)
+		}
+		i++
+	}
+	return pointerUnescaper.Replace(tok), nil
+}
+
+// pointer returns the JSON Pointer for obj relative to the root of its tree.
+func (obj *Object) pointer() string {
+	var toks []string
+	for o := obj; o.parent != nil; o = o.parent {
+		// Values held by pointers and interfaces share their parent's name.
+		if o.parent.elem == o {
+			continue
+		}
+		toks = append(toks, escapePointer(o.name))
+	}
+	if len(toks) == 0 {
+		return "/"
+	}
+	for i, j := 0, len(toks)-1; i < j; i, j = i+1, j-1 {
+		toks[i], toks[j] = toks[j], toks[i]
+	}
+	return "/" + strings.Join(toks, "/")
+}
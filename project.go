@@ -0,0 +1,132 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A projection is a set of selected fields, each with the projection of its
+// own fields.  A nil projection selects the whole value.
+type projection map[string]projection
+
+// parseProjection parses a comma-separated list of dotted field paths, such
+// as "Name,Address.City".  Selecting a field selects all of its fields, even
+// if some of them are also listed.
+func parseProjection(list string) projection {
+	p := projection{}
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		cur := p
+		names := strings.Split(path, ".")
+		for i, name := range names {
+			sub, ok := cur[name]
+			if ok && sub == nil {
+				break // already selected entirely
+			}
+			if i == len(names)-1 {
+				cur[name] = nil
+				break
+			}
+			if sub == nil {
+				sub = projection{}
+				cur[name] = sub
+			}
+			cur = sub
+		}
+	}
+	return p
+}
+
+// project returns the parts of v, the value held by obj, selected by p.
+// Fields of structs are selected and keyed by their JSON names (see
+// findField); the selection is applied to each element of slices and arrays.
+// Selected fields which do not exist are ignored, as are those tagged
+// `rest:"wo"`.  Selected values are encoded as they would be for a GET of
+// their object, or of v if obj is nil (as it is below the depth limit).
+func project(obj *Object, v reflect.Value, p projection) interface{} {
+	if p == nil || isNil(v) {
+		if obj != nil {
+			return obj.viewData()
+		}
+		return visibleValue(v)
+	}
+	child := func(key string) *Object {
+		if obj == nil {
+			return nil
+		}
+		c, ok := obj.deref().child[key]
+		if !ok {
+			return nil
+		}
+		return c
+	}
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Struct:
+		out := map[string]interface{}{}
+		for name, sub := range p {
+			field, ok := findField(v.Type(), name)
+			if !ok {
+				continue
+			}
+			if opts, _ := parseTag(field.Tag.Get("rest")); opts.writeOnly {
+				continue
+			}
+			fv, ok := fieldByIndex(v, field.Index)
+			if !ok {
+				continue
+			}
+			out[field.name] = project(child(field.name), fv, sub)
+		}
+		return out
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		out := map[string]interface{}{}
+		for name, sub := range p {
+			item := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+			if !item.IsValid() {
+				continue
+			}
+			out[name] = project(child(name), item, sub)
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = project(child(strconv.Itoa(i)), v.Index(i), p)
+		}
+		return list
+	}
+	if obj != nil {
+		return obj.viewData()
+	}
+	return visibleValue(v)
+}
+
+// getFields writes the fields of obj selected by the list of dotted paths
+// given as GET /path?fields=A,B.C.
+func (obj *Object) getFields(w io.Writer, headers http.Header, r *http.Request, list string) (int, error) {
+	out := project(obj, obj.root, parseProjection(list))
+	return encodeAccepted(w, headers, r, reflect.ValueOf(&out).Elem())
+}
@@ -0,0 +1,112 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	pathpkg "path"
+)
+
+// Rebuild rebuilds the tree below obj from the value it holds, so that
+// changes made to the value directly, rather than by requests, become
+// visible.  Requests are blocked while the tree is rebuilt.  No events are
+// sent for the changes, but they are reflected in Last-Modified headers.
+//
+// The value must not be changed directly while requests are being served;
+// Rebuild only makes the changes visible once they have been made.
+func (obj *Object) Rebuild() {
+	obj.RebuildPath("")
+}
+
+// RebuildPath is like Rebuild, but only rebuilds the part of the tree at
+// relativePath below obj.  The value at the path is found again from the
+// value at the root of the tree, so the path may name a value which has been
+// added or replaced since the tree was built.  If there is no longer a value
+// at the path (or there is not yet an object for it), the closest ancestor
+// which remains is rebuilt instead.
+func (obj *Object) RebuildPath(relativePath string) {
+	top := obj.top()
+	defer top.lockTree(exclusive)()
+
+	var pieces []string
+	if path := strings.Trim(pathpkg.Join(obj.path, relativePath), "/"); path != "" {
+		pieces = strings.Split(path, "/")
+	}
+	vals := []reflect.Value{top.root}
+	for _, piece := range pieces {
+		v, ok := childValue(vals[len(vals)-1], piece)
+		if !ok {
+			break
+		}
+		vals = append(vals, v)
+	}
+	// The lock on the root covers the tree, so the objects are found
+	// without taking any others (as find would).
+	target, depth := top, 0
+	for depth < len(vals)-1 {
+		child, ok := target.child[pieces[depth]]
+		if !ok {
+			break
+		}
+		target, depth = child, depth+1
+	}
+	target.rebuild(vals[depth])
+}
+
+// rebuild replaces the tree below obj with one built from v.  The caller
+// must hold the lock on the tree.
+func (obj *Object) rebuild(v reflect.Value) {
+	path := []string{""}
+	if obj.parent != nil {
+		path = strings.Split(obj.path, "/")
+	}
+	obj.adopt(newObject(path, v, obj.parent, obj.ESource, obj.opts))
+	if obj.custom {
+		obj.markAncestorsCustom()
+	}
+	obj.markModified(obj.path)
+}
+
+// childValue returns the value of the child of v named by the path element
+// name, as the tree would be built from v, or false if there is none.
+func childValue(v reflect.Value, name string) (reflect.Value, bool) {
+	if isNil(v) {
+		return reflect.Value{}, false
+	}
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, field := range visibleFields(v.Type()) {
+			if field.name == name {
+				return fieldByIndex(v, field.Index)
+			}
+		}
+	case reflect.Map:
+		key, err := convertKey(name, v.Type().Key())
+		if err != nil {
+			return reflect.Value{}, false
+		}
+		item := v.MapIndex(key)
+		return item, item.IsValid()
+	case reflect.Array, reflect.Slice:
+		if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < v.Len() {
+			return v.Index(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
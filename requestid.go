@@ -0,0 +1,66 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader is the header which carries the ID of a request.  Requests
+// without one are given one by ServeHTTP, and every response echoes the ID
+// of its request.
+const RequestIDHeader = "X-Request-ID"
+
+// A TracedMetrics is a Metrics which is also told the ID of each request
+// (see RequestID), for example to attach exemplars to its observations.
+// ObserveTracedRequest is called instead of ObserveRequest.
+type TracedMetrics interface {
+	Metrics
+	ObserveTracedRequest(id, method, path string, code int, dur time.Duration)
+}
+
+type requestIDKey struct{}
+
+// withRequestID returns r with its request ID in its context, generating
+// the ID if r has none, and sets the ID in the headers of w.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// newRequestID returns a random hex string to identify a request.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// RequestID returns the ID of r, from its X-Request-ID header or as
+// generated by ServeHTTP, or "" if r was not served by an Object.  It can be
+// used by middleware and by handlers registered with HandleFunc.
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -17,15 +17,19 @@ package rest
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"reflect"
-	"sort"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	pathpkg "path"
 
@@ -34,8 +38,9 @@ import (
 
 // Standard Content-Type values
 const (
-	ApplicationJSON = "application/json;charset=utf-8"
-	PlainText       = "text/plain;charset=utf-8"
+	ApplicationJSON       = "application/json;charset=utf-8"
+	PlainText             = "text/plain;charset=utf-8"
+	ApplicationJavaScript = "application/javascript;charset=utf-8"
 )
 
 type Object struct {
@@ -48,22 +53,474 @@ type Object struct {
 	typ  reflect.Type
 	kind reflect.Kind
 
-	rw sync.RWMutex
+	// rw guards obj and the tree below it; see lockRead and lockWrite.
+	rw treeLock
 
+	// opts holds the options from the struct tag of the field (if any)
+	// which holds this object.
+	opts tagOptions
+
+	// elem is the object for the value pointed to by a pointer or held in
+	// an interface; its children are shared with obj.
+	elem *Object
+
+	// detached is set for objects created by newChild which have not yet
+	// been added to the tree.
+	detached bool
+
+	// page is non-nil for the synthetic page views created by find.
+	page *pageInfo
+
+	// truncated is set when obj is below the depth limit of the tree (see
+	// MaxDepth), so its children were not built and it is encoded whole.
+	truncated bool
+
+	// cycle is the ancestor of obj which holds the same pointer, map, or
+	// slice, if there is one.  Such an obj has no children and is encoded
+	// as a reference to the path of its ancestor.
+	cycle *Object
+
+	// last holds the most recent event for each path in the tree.  It is
+	// only used on the root object, and only if KeepLastEvent is set.
+	last struct {
+		sync.Mutex
+		event map[string]esource.Event
+	}
+
+	// changes tracks the version of the tree, which is advanced by each
+	// change, and the version at which each path was added.  It is only
+	// used on the root object.
+	changes struct {
+		sync.Mutex
+		version uint64
+		added   *addedNode
+	}
+
+	// modified holds the time at which the tree was created, and the times
+	// at which the changed paths in the tree were changed (see modNode).
+	// It is only used on the root object.
+	modified struct {
+		sync.Mutex
+		start time.Time
+		root  *modNode
+	}
+
+	// history holds the recent values of each leaf in the tree.  It is only
+	// used on the root object, and only if HistorySize is set.
+	history struct {
+		sync.Mutex
+		leaf map[string]*ring
+	}
+
+	// jobs holds the status of asynchronous writes.  It is only used on
+	// the root object.
+	jobs struct {
+		sync.Mutex
+		next  int
+		byID  map[string]*Job
+		order []string
+	}
+
+	// outbox holds the events which are waiting to be sent to the event
+	// source, in order.  It is only used on the root object.
+	outbox struct {
+		sync.Mutex
+		queue    []esource.Event
+		draining bool
+		full     bool   // whether the last event was dropped
+		dropped  uint64 // the number of events dropped
+	}
+
+	// customMu serializes the marking of ancestors as custom by writes.
+	// It is only used on the root object.
+	customMu sync.Mutex
+
+	// handlers holds the overrides registered with HandleFunc, by path and
+	// then by method.  It is only used on the root object.
+	handlers struct {
+		sync.Mutex
+		byPath map[string]map[string]MethodHandler
+	}
+
+	// middleware holds the middleware added with Use, outermost first.  It
+	// is only used on the root object.
+	middleware struct {
+		sync.Mutex
+		chain []func(MethodHandler) MethodHandler
+	}
+
+	// logMu serializes writes to the MutationLog.  It is only used on the
+	// root object.
+	logMu sync.Mutex
+
+	// layers are the objects presented by a merged object (see NewMerged).
+	layers []*Object
+
+	// custom is set when obj or one of its descendants must be encoded
+	// by walking the tree (see view) instead of by encoding root directly.
+	custom bool
+
+	// ESource receives an event for each write to the tree.  GET
+	// /path?events serves its stream with only the events for path and its
+	// descendants.
 	ESource *esource.EventSource
+
+	// KeepLastEvent causes the most recent event for each path to be
+	// retained so that it can be retrieved with GET /path?lastevent.
+	// It is only consulted on the root object.
+	KeepLastEvent bool
+
+	// MutationLog, if set, receives a line of JSON describing each mutation
+	// (see Mutation) as it is committed.  The log can be re-applied with
+	// Replay.  A mutation whose entry can't be written still succeeds, and
+	// the error is logged with the log package.
+	// It is only consulted on the root object.
+	MutationLog io.Writer
+
+	// SyncMutationLog causes the mutation log to be flushed (if it has a
+	// Flush method) and synced (if it has a Sync method) after each entry.
+	// Otherwise writes may be buffered by the writer.
+	SyncMutationLog bool
+
+	// AllowAsync causes writes with a "Prefer: respond-async" header to be
+	// performed in the background.  The client receives 202 Accepted and
+	// the path of a job (under JobsPath) which reports the outcome.
+	// It is only consulted on the root object.
+	AllowAsync bool
+
+	// EventsPath, if set, is the name of a synthetic node under the root
+	// (such as "_events") at which GET serves the ESource as a
+	// text/event-stream.  It takes the place of any value with the same
+	// name, so it should be chosen not to collide with the data.
+	// It is only consulted on the root object.
+	EventsPath string
+
+	// DropRestrictedFields causes fields which cannot be set by posting a
+	// struct (see restrictFields) to be silently ignored instead of
+	// rejected with 403 Forbidden.
+	// It is only consulted on the root object.
+	DropRestrictedFields bool
+
+	// OmitEmpty causes struct fields with empty values to be left out of
+	// responses, as if every field were tagged with omitempty.
+	// It is only consulted on the root object.
+	OmitEmpty bool
+
+	// KeyOrder, if set, reports whether the map key a comes before b.  It
+	// orders the keys of maps in responses, pages, and listings of children
+	// (such as those of 404 Not Found responses), which are otherwise sorted
+	// as strings.  The indices of slices and arrays are always listed in
+	// numeric order.
+	// It is only consulted on the root object.
+	KeyOrder func(a, b string) bool
+
+	// CompressMinSize is the size in bytes of the smallest response body
+	// which is compressed (with gzip, for clients which accept it).  If it
+	// is zero, DefaultCompressMinSize is used; if it is negative, nothing
+	// is compressed.
+	// It is only consulted on the root object.
+	CompressMinSize int
+
+	// CompressLevel is the gzip compression level (see compress/gzip).  If
+	// it is zero, gzip.DefaultCompression is used.
+	// It is only consulted on the root object.
+	CompressLevel int
+
+	// IdempotentDelete causes a DELETE of a path which does not exist to
+	// succeed with 204 No Content instead of failing with 404 Not Found,
+	// so that clients can safely retry deletes.
+	// It is only consulted on the root object.
+	IdempotentDelete bool
+
+	// StrictDecode causes JSON bodies of POST and PUT requests which have
+	// keys that don't match any field of the struct they are decoded into
+	// to be rejected with 400 Bad Request, instead of the keys being
+	// ignored.  A request can also ask for this with a "strict" query
+	// parameter.
+	// It is only consulted on the root object.
+	StrictDecode bool
+
+	// HeadComputesLength causes HEAD requests for maps, slices, and structs
+	// to encode the value as GET would, so that the response has the same
+	// Content-Length and ETag.  Otherwise those headers are left out, so
+	// that a HEAD of a large tree doesn't pay for encoding it.
+	// It is only consulted on the root object.
+	HeadComputesLength bool
+
+	// ValidateOnGet causes GET responses to include a Warning header for
+	// each Validator in the response which reports a problem.  The value
+	// is returned regardless.  Problems can also be listed with
+	// GET /path?validate.
+	// It is only consulted on the root object.
+	ValidateOnGet bool
+
+	// HistorySize is the number of recent values retained for each leaf so
+	// that they can be retrieved with GET /path?history.  No values are
+	// retained if it is zero.
+	// It is only consulted on the root object.
+	HistorySize int
+
+	// ValueEvents causes the data of the event for each write to be a
+	// Change, encoded as JSON, which holds the old and new values as well as
+	// the path.  Otherwise the data is just the path.
+	// It is only consulted on the root object.
+	ValueEvents bool
+
+	// MaxBodyBytes is the size in bytes of the largest request body which
+	// is accepted; larger bodies are rejected with 413 Request Entity Too
+	// Large.  If it is zero, DefaultMaxBodyBytes is used; if it is negative,
+	// there is no limit.
+	// It is only consulted on the root object.
+	MaxBodyBytes int64
+
+	// GranularEvents causes the events for writes to describe what
+	// happened to the changed path (see EventCreate and friends) instead
+	// of carrying the name of the operation.
+	// It is only consulted on the root object.
+	GranularEvents bool
+
+	// Authorizer, if set, is consulted before each request is dispatched
+	// with the path of the object it targets.
+	// It is only consulted on the root object.
+	Authorizer Authorizer
+
+	// Logger, if set, is called after each request is served with a
+	// description of the request and its response.
+	// It is only consulted on the root object.
+	Logger Logger
+
+	// Metrics, if set, observes the method, top-level path, status, and
+	// duration of each request, and its ID if it is a TracedMetrics.
+	// It is only consulted on the root object.
+	Metrics Metrics
+
+	// EnableJSONP causes JSON responses to GET requests with a "callback"
+	// query parameter to be wrapped in a call to the named function, for
+	// clients which load them with a <script> tag.
+	// It is only consulted on the root object.
+	EnableJSONP bool
+
+	// Locker, if set, is held while each request reads or writes the value,
+	// so that the program can coordinate its own access to the value with
+	// requests by holding the same lock.  If it also has RLock and RUnlock
+	// methods, such as a *sync.RWMutex, they are used by requests which only
+	// read.  Changes which the program makes to the value directly should be
+	// followed by a call to Rebuild, which doesn't take the Locker, so it can
+	// be called while the Locker is held.
+	// It is only consulted on the root object.
+	Locker sync.Locker
+
+	// MaxDepth is the number of levels below the root to which values are
+	// walked to build the tree.  Deeper values have no paths of their own
+	// and are encoded whole.  If it is zero, DefaultMaxDepth is used.
+	// It is only consulted on the root object.
+	MaxDepth int
+
+	// MaxQueuedEvents is the number of events which can wait to be sent to
+	// the event source while it is busy.  Events for writes made while the
+	// queue is full are dropped (see DroppedEvents).  If it is zero,
+	// DefaultMaxQueuedEvents is used; if it is negative, there is no limit.
+	// It is only consulted on the root object.
+	MaxQueuedEvents int
+}
+
+// DefaultMaxDepth is the depth to which trees are built unless MaxDepth is
+// set.
+const DefaultMaxDepth = 32
+
+// Options configure the tree created by NewObjectWithOptions.
+type Options struct {
+	// MaxDepth is the depth to which the tree is built (see Object.MaxDepth).
+	MaxDepth int
 }
 
 func NewObject(obj interface{}) *Object {
-	es := esource.New()
-	return newObject([]string{""}, reflect.ValueOf(obj), nil, es)
+	root, _ := NewObjectWithOptions(obj, Options{})
+	return root
 }
 
-func newObject(path []string, val reflect.Value, parent *Object, es *esource.EventSource) *Object {
-	typ, kind := val.Type(), val.Kind()
+// NewObjectWithOptions is like NewObject, but the tree is configured by
+// opts.  If obj is too deep to be built entirely, the tree is still returned
+// along with an error describing where it was truncated.
+func NewObjectWithOptions(obj interface{}, opts Options) (*Object, error) {
+	b := &builder{es: esource.New(), maxDepth: opts.MaxDepth, building: map[reference]*Object{}}
+	if b.maxDepth == 0 {
+		b.maxDepth = DefaultMaxDepth
+	}
+	root := b.build([]string{""}, reflect.ValueOf(obj), nil, tagOptions{})
+	root.MaxDepth = opts.MaxDepth
+	root.modified.start = time.Now()
+	if len(b.truncated) > 0 {
+		return root, fmt.Errorf("%s is more than %d levels deep", b.truncated[0], b.maxDepth)
+	}
+	return root, nil
+}
+
+// tagOptions are the options which can be specified in the `rest:"..."`
+// struct tag of a field.  Options are separated by commas and are either
+// a bare flag or a key=value pair.
+type tagOptions struct {
+	pageSize    int      // pagesize=N: the number of elements per synthetic page
+	stringer    bool     // stringer: encode the value using its String method
+	createOnly  bool     // createonly: map keys cannot be overwritten once set
+	create      bool     // create: the field can be set by posting its struct
+	template    bool     // template: a nil pointer is shown as a zero value
+	bigNum      float64  // bignum[=N]: numbers beyond ±N (default 2^53-1) are strings
+	ref         bool     // ref: the string value is the path of another object
+	contentType string   // contenttype=T: the raw value is served with Content-Type T
+	enum        []string // enum=A,B,...: the allowed values (of the elements of a collection)
+	readOnly    bool     // ro: the value (and everything below it) can't be written by clients
+	writeOnly   bool     // wo: the value (and everything below it) can't be read by clients
+}
+
+// tagFlags is the set of options which can be given without a value.  A bare
+// word in a tag which is not a known flag continues the value of the previous
+// option, which allows values that themselves contain commas.
+var tagFlags = map[string]bool{
+	"stringer":   true,
+	"createonly": true,
+	"create":     true,
+	"template":   true,
+	"bignum":     true,
+	"ref":        true,
+	"ro":         true,
+	"wo":         true,
+}
+
+func parseTag(tag string) (opts tagOptions, err error) {
+	if tag == "" {
+		return opts, nil
+	}
+
+	var keys []string
+	vals := map[string]string{}
+	for _, tok := range strings.Split(tag, ",") {
+		key, val := tok, ""
+		if eq := strings.Index(tok, "="); eq >= 0 {
+			key, val = tok[:eq], tok[eq+1:]
+		} else if !tagFlags[tok] && len(keys) > 0 {
+			last := keys[len(keys)-1]
+			vals[last] += "," + tok
+			continue
+		}
+		keys = append(keys, key)
+		vals[key] = val
+	}
+
+	for _, key := range keys {
+		val := vals[key]
+		switch key {
+		case "pagesize":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return opts, fmt.Errorf("invalid page size %q", val)
+			}
+			opts.pageSize = n
+		case "stringer":
+			opts.stringer = true
+		case "createonly":
+			opts.createOnly = true
+		case "create":
+			opts.create = true
+		case "template":
+			opts.template = true
+		case "contenttype":
+			if val == "" {
+				return opts, fmt.Errorf("missing content type")
+			}
+			opts.contentType = val
+		case "enum":
+			if val == "" {
+				return opts, fmt.Errorf("empty enum")
+			}
+			opts.enum = strings.Split(val, ",")
+		case "ref":
+			opts.ref = true
+		case "ro":
+			opts.readOnly = true
+		case "wo":
+			opts.writeOnly = true
+		case "bignum":
+			opts.bigNum = maxSafeInteger
+			if val == "" {
+				break
+			}
+			n, err := strconv.ParseFloat(val, 64)
+			if err != nil || n <= 0 {
+				return opts, fmt.Errorf("invalid bignum threshold %q", val)
+			}
+			opts.bigNum = n
+		default:
+			return opts, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return opts, nil
+}
+
+// A builder holds the state of the construction of a tree of objects.
+type builder struct {
+	es        *esource.EventSource
+	maxDepth  int      // the number of levels below the root to build
+	truncated []string // the paths at which maxDepth was reached
+
+	// building holds the objects being built for each pointer, map, and
+	// slice, so that a value which contains itself is built as a cycle
+	// instead of forever.  Values which are shared without a cycle are
+	// built in each place they appear.
+	building map[reference]*Object
+}
+
+// A reference identifies the value held by a pointer, map, or slice.
+type reference struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+// referenceTo returns the reference for v, or false if v does not hold a
+// non-nil pointer, map, or slice.
+func referenceTo(v reflect.Value) (reference, bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return reference{}, false
+		}
+		ref := reference{typ: v.Type(), ptr: v.Pointer()}
+		if v.Kind() == reflect.Slice {
+			ref.len = v.Len()
+		}
+		return ref, true
+	}
+	return reference{}, false
+}
+
+// newObject returns the object for val at path, and the tree below it.  The
+// depth limit is that of the tree containing parent, if any.
+func newObject(path []string, val reflect.Value, parent *Object, es *esource.EventSource, opts tagOptions) *Object {
+	b := &builder{es: es, maxDepth: DefaultMaxDepth, building: map[reference]*Object{}}
+	if parent != nil {
+		b.maxDepth = parent.top().maxDepth()
+	}
+	// The new object may refer back to the ancestors it is being added to.
+	for p := parent; p != nil; p = p.parent {
+		if ref, ok := referenceTo(p.root); ok {
+			b.building[ref] = p
+		}
+	}
+	return b.build(path, val, parent, opts)
+}
 
-	if len(path) > 10 {
-		panic("DEBUG: depth limit exceeded")
+// maxDepth returns the depth to which the tree containing obj is built.
+func (obj *Object) maxDepth() int {
+	if n := obj.top().MaxDepth; n != 0 {
+		return n
 	}
+	return DefaultMaxDepth
+}
+
+func (b *builder) build(path []string, val reflect.Value, parent *Object, opts tagOptions) *Object {
+	typ, kind := val.Type(), val.Kind()
+	es := b.es
 
 	sub := func(id string) []string {
 		return append(path, id)
@@ -76,6 +533,7 @@ func newObject(path []string, val reflect.Value, parent *Object, es *esource.Eve
 		root:    val,
 		typ:     typ,
 		kind:    kind,
+		opts:    opts,
 		ESource: es,
 	}
 	if len(path) > 0 {
@@ -88,46 +546,114 @@ func newObject(path []string, val reflect.Value, parent *Object, es *esource.Eve
 	if !val.CanInterface() {
 		panic(fmt.Sprintf("can't call Interface on object at %s", obj.path))
 	}
+	if opts.stringer && kind != reflect.Interface && !typ.Implements(stringerType) && !reflect.PtrTo(typ).Implements(stringerType) {
+		panic(fmt.Sprintf("stringer option on non-Stringer %s at %s", typ, obj.path))
+	}
+
+	// Stringer leaves are opaque; their structure is not exposed.
+	if obj.isStringer() {
+		obj.custom = true
+		return obj
+	}
+
+	// Write-only values must be left out when their ancestors are encoded,
+	// so those are walked instead of encoded directly.
+	if opts.bigNum > 0 || opts.writeOnly {
+		obj.custom = true
+	}
+
+	// Values which marshal themselves are opaque too, since encoding/json
+	// does not expose their structure either.  Pointers and interfaces are
+	// checked when their element is.
+	if kind != reflect.Ptr && kind != reflect.Interface && marshals(typ) {
+		return obj
+	}
+
+	if ref, ok := referenceTo(val); ok {
+		if ancestor, ok := b.building[ref]; ok {
+			obj.cycle = ancestor
+			obj.custom = true
+			return obj
+		}
+		b.building[ref] = obj
+		defer delete(b.building, ref)
+	}
+
+	// Values at the depth limit have no children, and are encoded whole.
+	// The root is at depth 0, so it is one less than the length of its path.
+	if len(path)-1 >= b.maxDepth && !isNil(val) {
+		switch kind {
+		case reflect.Ptr, reflect.Interface, reflect.Struct, reflect.Map, reflect.Array, reflect.Slice:
+			obj.truncated = true
+			b.truncated = append(b.truncated, obj.path)
+			return obj
+		}
+	}
 
 	switch kind {
 	case reflect.Ptr, reflect.Interface:
 		if val.IsNil() {
+			obj.custom = opts.template
 			break
 		}
-		sub := newObject(path, val.Elem(), obj, es)
+		sub := b.build(path, val.Elem(), obj, opts)
+		obj.elem = sub
 		obj.child = sub.child
+		obj.custom = sub.custom
 	case reflect.Struct:
-		for i := 0; i < typ.NumField(); i++ {
-			field := typ.Field(i)
-			if field.PkgPath != "" {
-				continue // skip unexported fields
+		// Fields of embedded structs are promoted to be children of obj,
+		// since encoding/json promotes them too.
+		for _, field := range visibleFields(typ) {
+			fval, ok := fieldByIndex(val, field.Index)
+			if !ok {
+				continue // promoted through a nil pointer
+			}
+			fopts, err := parseTag(field.Tag.Get("rest"))
+			if err != nil {
+				panic(fmt.Sprintf("bad rest tag on %s at %s: %s", field.Name, obj.path, err))
+			}
+			if fopts.template && field.Type.Kind() != reflect.Ptr {
+				panic(fmt.Sprintf("template option on non-pointer %s at %s", field.Name, obj.path))
+			}
+			if fopts.bigNum > 0 && !isNumberType(field.Type) {
+				panic(fmt.Sprintf("bignum option on non-numeric %s at %s", field.Name, obj.path))
+			}
+			if fopts.ref && field.Type.Kind() != reflect.String {
+				panic(fmt.Sprintf("ref option on non-string %s at %s", field.Name, obj.path))
 			}
-			obj.child[field.Name] = newObject(sub(field.Name), val.Field(i), obj, es)
+			if fopts.contentType != "" && !isRawType(field.Type) {
+				panic(fmt.Sprintf("contenttype option on %s which is not a string or []byte at %s", field.Name, obj.path))
+			}
+			// Children are named as they are in the JSON encoding, so that
+			// clients can use the keys they see as paths.
+			obj.child[field.name] = b.build(sub(field.name), fval, obj, fopts)
 		}
 	case reflect.Map:
+		// Keys which encoding/json can't handle are encoded by view using
+		// the same strings as their paths.
+		if !jsonKeyType(typ.Key()) {
+			obj.custom = true
+		}
 		for _, keyVal := range val.MapKeys() {
-			var key string
-			switch keyVal.Kind() {
-			case reflect.String:
-				key = keyVal.String()
-			default:
-				if !keyVal.CanInterface() {
-					panic(fmt.Sprintf("can't call Interface on non-string map key at %s", obj.path))
-				}
-				key = fmt.Sprintf("%v", keyVal.Interface())
+			if keyVal.Kind() != reflect.String && !keyVal.CanInterface() {
+				panic(fmt.Sprintf("can't call Interface on non-string map key at %s", obj.path))
 			}
+			key := keyString(keyVal)
 			item := val.MapIndex(keyVal)
-			obj.child[key] = newObject(sub(key), item, obj, es)
+			obj.child[key] = b.build(sub(key), item, obj, tagOptions{})
 		}
 	case reflect.Array, reflect.Slice:
 		for i := 0; i < val.Len(); i++ {
 			item := val.Index(i)
 			key := fmt.Sprintf("%d", i)
-			obj.child[key] = newObject(sub(key), item, obj, es)
+			obj.child[key] = b.build(sub(key), item, obj, tagOptions{})
 		}
 	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
 		panic(fmt.Sprintf("can't handle %s in object at %s", kind, obj.path))
 	}
+	for _, child := range obj.child {
+		obj.custom = obj.custom || child.custom
+	}
 	return obj
 }
 
@@ -135,21 +661,84 @@ var (
 	stringType = reflect.TypeOf("")
 )
 
+// A statusError is an error which should be reported with a particular
+// HTTP status code.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// errorCode returns the status code for err, or def if it does not specify
+// one.
+func errorCode(err error, def int) int {
+	if se, ok := err.(*statusError); ok {
+		return se.code
+	}
+	return def
+}
+
+// keyString returns the path element for the map key k.  Keys which
+// implement encoding.TextMarshaler use their text form, as in encoding/json.
+func keyString(k reflect.Value) string {
+	if k.Kind() == reflect.String {
+		return k.String()
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if text, err := tm.MarshalText(); err == nil {
+			return string(text)
+		}
+	}
+	return fmt.Sprintf("%v", k.Interface())
+}
+
+// jsonKeyType returns true if encoding/json can encode map keys of type t.
+func jsonKeyType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return t.Implements(textMarshalerType)
+}
+
+// checkSet returns the error with which setting obj to v would fail, if any,
+// without changing anything.
+func (obj *Object) checkSet(v reflect.Value) error {
+	if err := checkEnums(v, obj.enum()); err != nil {
+		return err
+	}
+	if err := checkValid(v); err != nil {
+		return err
+	}
+	if parent := obj.parent; parent != nil && parent.kind == reflect.Map {
+		key, err := parent.mapKey(obj.name)
+		if err != nil {
+			return err
+		}
+		if parent.opts.createOnly && parent.root.MapIndex(key).IsValid() {
+			return &statusError{http.StatusConflict, fmt.Sprintf("key %q already exists", obj.name)}
+		}
+	}
+	return nil
+}
+
 func (obj *Object) set(v reflect.Value) error {
 	parent := obj.parent
 	if parent == nil {
-		return fmt.Errorf("cannot set object with no parent")
+		return obj.setRoot(v)
 	}
 
 	switch parent.kind {
 	case reflect.Map:
-		var key reflect.Value
-		switch ktyp := parent.typ.Key(); ktyp {
-		case stringType:
-			key = reflect.ValueOf(obj.name)
-		default:
-			// TODO(kevlar): technically we can convert to any type to which string is convertable
-			return fmt.Errorf("cannot set key of non-string map type %s", parent.typ)
+		key, err := parent.mapKey(obj.name)
+		if err != nil {
+			return err
+		}
+		if parent.opts.createOnly && parent.root.MapIndex(key).IsValid() {
+			return &statusError{http.StatusConflict, fmt.Sprintf("key %q already exists", obj.name)}
 		}
 		parent.root.SetMapIndex(key, v)
 	default:
@@ -157,35 +746,241 @@ func (obj *Object) set(v reflect.Value) error {
 			return fmt.Errorf("cannot set a %s", obj.typ)
 		}
 		obj.root.Set(v)
+		// Build the new children from the stored value, so that they can be
+		// set in turn.
+		v = obj.root
 	}
 
 	path := strings.Split(obj.path, "/")
-	parent.child[obj.name] = newObject(path, v, parent, obj.ESource)
+	child := newObject(path, v, parent, obj.ESource, obj.opts)
+	if parent.child[obj.name] == obj {
+		// Rebuild obj in place, since other requests may have found it.
+		obj.adopt(child)
+	} else {
+		parent.child[obj.name] = child
+	}
+	if child.custom {
+		obj.markAncestorsCustom()
+	}
+	return nil
+}
+
+// setRoot sets the value of obj, which has no parent to hold a new value,
+// to v in place: through the pointer it holds, or by setting and removing
+// the keys of the map it holds.
+func (obj *Object) setRoot(v reflect.Value) error {
+	cur := obj.root
+	if !cur.IsValid() || !v.IsValid() || v.Type() != cur.Type() {
+		return fmt.Errorf("cannot set object with no parent")
+	}
+	switch {
+	case cur.Kind() == reflect.Ptr && !cur.IsNil() && !v.IsNil():
+		cur.Elem().Set(v.Elem())
+	case cur.Kind() == reflect.Map && !cur.IsNil():
+		for _, key := range cur.MapKeys() {
+			if !v.MapIndex(key).IsValid() {
+				cur.SetMapIndex(key, reflect.Value{})
+			}
+		}
+		for _, key := range v.MapKeys() {
+			cur.SetMapIndex(key, v.MapIndex(key))
+		}
+	default:
+		return fmt.Errorf("cannot set object with no parent")
+	}
+	obj.rebuild(cur)
 	return nil
 }
 
+// markAncestorsCustom marks the ancestors of obj as custom, since obj is.
+func (obj *Object) markAncestorsCustom() {
+	// Writes to other subtrees may be marking the same ancestors.
+	top := obj.top()
+	top.customMu.Lock()
+	defer top.customMu.Unlock()
+	for p := obj.parent; p != nil; p = p.parent {
+		p.custom = true
+	}
+}
+
+// adopt makes obj hold the value and children of next, which was built to
+// replace it.
+func (obj *Object) adopt(next *Object) {
+	obj.root, obj.typ, obj.kind, obj.opts = next.root, next.typ, next.kind, next.opts
+	obj.child, obj.elem = next.child, next.elem
+	obj.custom, obj.truncated, obj.cycle = next.custom, next.truncated, next.cycle
+	obj.detached = false
+	if obj.elem != nil {
+		obj.elem.parent = obj
+		return
+	}
+	for _, child := range obj.child {
+		child.parent = obj
+	}
+}
+
 func (obj *Object) del() error {
+	if obj.truncates() {
+		return obj.empty()
+	}
 	parent := obj.parent
 	if parent == nil {
 		return fmt.Errorf("cannot delete object with no parent")
 	}
 
 	switch parent.kind {
+	case reflect.Map:
+		key, err := parent.mapKey(obj.name)
+		if err != nil {
+			return err
+		}
+		parent.root.SetMapIndex(key, reflect.Value{})
+		delete(parent.child, obj.name)
+	case reflect.Slice:
+		i, err := strconv.Atoi(obj.name)
+		if err != nil || i < 0 || i >= parent.root.Len() {
+			return fmt.Errorf("invalid index %q", obj.name)
+		}
+		// Copy the remaining elements into a new slice, since the old one
+		// may still be referenced elsewhere.  Setting it rebuilds the
+		// children of the parent, so the later elements get their new
+		// indices.
+		old := parent.root
+		s := reflect.MakeSlice(parent.typ, 0, old.Len()-1)
+		s = reflect.AppendSlice(s, old.Slice(0, i))
+		s = reflect.AppendSlice(s, old.Slice(i+1, old.Len()))
+		return parent.set(s)
+	case reflect.Struct:
+		// Fields can't be removed, so they are reset to their zero value.
+		return obj.set(reflect.Zero(obj.typ))
 	default:
 		return fmt.Errorf("cannot delete children of a %s", parent.kind)
 	}
 	return nil
 }
 
+// truncates returns true if deleting obj empties the map or slice it holds,
+// since it can't be removed: it is the root, or a field of a struct.  Slices
+// must be settable to be emptied.
+func (obj *Object) truncates() bool {
+	if p := obj.parent; p != nil && p.kind != reflect.Struct {
+		return false
+	}
+	switch v := indirect(obj.root); v.Kind() {
+	case reflect.Map:
+		return true
+	case reflect.Slice:
+		return v.CanSet()
+	}
+	return false
+}
+
+// empty removes every entry of the map or element of the slice held by
+// obj, and rebuilds obj without children.  A map is emptied in place; a
+// slice is replaced by an empty one, since the old one may still be
+// referenced elsewhere.
+func (obj *Object) empty() error {
+	v := indirect(obj.root)
+	switch v.Kind() {
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			v.SetMapIndex(key, reflect.Value{})
+		}
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	obj.rebuild(obj.root)
+	return nil
+}
+
+// mapKey returns the key in the map held by obj for the named child.
+func (obj *Object) mapKey(name string) (reflect.Value, error) {
+	key, err := convertKey(name, obj.typ.Key())
+	if err != nil && obj.root.IsValid() && !obj.root.IsNil() {
+		// Keys which can't be parsed, such as structs, can still name the
+		// entries which are listed by a GET.
+		for _, k := range obj.root.MapKeys() {
+			if keyString(k) == name {
+				return k, nil
+			}
+		}
+	}
+	return key, err
+}
+
+// convertKey converts the path element name to a map key of type kt, which
+// is the reverse of keyString.  Keys which implement
+// encoding.TextUnmarshaler are parsed from their text form, numbers are
+// parsed in base 10, and booleans are "true" or "false"; other keys must be
+// of a type to which a string can be converted.
+func convertKey(name string, kt reflect.Type) (reflect.Value, error) {
+	if kt.Kind() != reflect.String && reflect.PtrTo(kt).Implements(textUnmarshalerType) {
+		key := reflect.New(kt)
+		if err := key.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(name)); err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid key %q for %s: %s", name, kt, err)
+		}
+		return key.Elem(), nil
+	}
+	switch kt.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(name, 10, kt.Bits())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid key %q for %s: %s", name, kt, err)
+		}
+		return reflect.ValueOf(n).Convert(kt), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(name, 10, kt.Bits())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid key %q for %s: %s", name, kt, err)
+		}
+		return reflect.ValueOf(n).Convert(kt), nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(name, kt.Bits())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid key %q for %s: %s", name, kt, err)
+		}
+		return reflect.ValueOf(f).Convert(kt), nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(name)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid key %q for %s: %s", name, kt, err)
+		}
+		return reflect.ValueOf(b).Convert(kt), nil
+	case reflect.String:
+		return reflect.ValueOf(name).Convert(kt), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot convert %q to map key type %s", name, kt)
+}
+
+// Handler returns an http.Handler which serves obj at path (such as
+// "/api"), for registering on a ServeMux as path+"/".  See Router to serve
+// several objects with one handler.
+func Handler(path string, obj *Object) http.Handler {
+	return http.StripPrefix(pathpkg.Clean(path), obj)
+}
+
+// Handle registers obj with http.DefaultServeMux to serve the paths below
+// path.  Registering Handler on a ServeMux of your own is preferred, since
+// the default ServeMux is shared by the whole program.
 func Handle(path string, obj *Object) {
 	path = pathpkg.Clean(path)
-	http.Handle(path+"/", http.StripPrefix(path, obj))
+	http.Handle(path+"/", Handler(path, obj))
+}
+
+// top returns the root of the tree containing obj.
+func (obj *Object) top() *Object {
+	for obj.parent != nil {
+		obj = obj.parent
+	}
+	return obj
 }
 
-func (obj *Object) find(pieces []string) (*Object, bool) {
+// find resolves the path pieces relative to obj.  It returns the deepest
+// object found and the pieces (if any) which could not be resolved.
+func (obj *Object) find(pieces []string) (*Object, []string) {
 	// If there are no pieces left, we're done
 	if len(pieces) == 0 {
-		return obj, true
+		return obj, nil
 	}
 
 	// If there is a // in the path or a / at the end, ignore it
@@ -194,171 +989,882 @@ func (obj *Object) find(pieces []string) (*Object, bool) {
 	}
 
 	// Find a child if we have one
-	obj.rw.RLock()
+	obj.rw.lock(intentShared)
 	ret, ok := obj.child[pieces[0]]
-	obj.rw.RUnlock()
+	obj.rw.unlock(intentShared)
+	rest := pieces[1:]
 	if !ok {
-		return obj, false
+		// Synthetic objects hold copies of the elements of obj, which must
+		// not be written while they are copied.
+		unlock := obj.lockTree(shared)
+		if pieces[0] == "page" && len(pieces) > 1 {
+			ret, ok = obj.findPage(pieces[1])
+			rest = pieces[2:]
+		}
+		if !ok {
+			ret, ok = obj.findIndex(pieces[0])
+			rest = pieces[1:]
+		}
+		unlock()
+	}
+	if !ok && pieces[0] == JobsPath && obj.parent == nil && len(pieces) > 1 {
+		ret, ok = obj.findJob(pieces[1])
+		rest = pieces[2:]
+	}
+	if !ok {
+		return obj, pieces
+	}
+
+	return ret.find(rest)
+}
+
+// lookup is like find, for callers which don't hold the Locker of the tree:
+// it is held while the path is resolved, since synthetic objects (such as
+// pages) are copied from the tree as they are found.
+func (obj *Object) lookup(pieces []string) (*Object, []string) {
+	defer obj.lockApp(false)()
+	return obj.find(pieces)
+}
+
+// deref returns the object for the value underlying any pointers or
+// interfaces held by obj.
+func (obj *Object) deref() *Object {
+	for obj.elem != nil {
+		obj = obj.elem
+	}
+	return obj
+}
+
+// isLeaf returns true if obj cannot have children: it holds a scalar, an
+// opaque value (such as a stringer), or a nil pointer or interface.
+func (obj *Object) isLeaf() bool {
+	o := obj.deref()
+	if o.isStringer() || marshals(o.typ) {
+		return true
+	}
+	switch indirect(o.root).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return false
+	}
+	return true
+}
+
+// newChild returns a detached object for the named key of the map held by
+// obj.  It is added to the tree when it is set.  If obj does not hold a map,
+// newChild returns nil.
+func (obj *Object) newChild(name string) *Object {
+	m := obj.deref()
+	if m.kind != reflect.Map || m.root.IsNil() {
+		return nil
+	}
+	typ := m.typ.Elem()
+	return &Object{
+		path:     pathpkg.Join(m.path, name),
+		name:     name,
+		parent:   m,
+		child:    map[string]*Object{},
+		root:     reflect.New(typ).Elem(),
+		typ:      typ,
+		kind:     typ.Kind(),
+		detached: true,
+		ESource:  m.ESource,
+	}
+}
+
+// exists returns true if obj is present in the tree.  Detached objects
+// from newChild exist once their key has been set in the parent map.
+func (obj *Object) exists() bool {
+	if !obj.detached {
+		return true
+	}
+	key, err := obj.parent.mapKey(obj.name)
+	if err != nil {
+		return false
+	}
+	return obj.parent.root.MapIndex(key).IsValid()
+}
+
+// MaxResponseBytesHeader is the request header with which a client can set
+// the largest response body it will accept.  It can also be given with the
+// maxbytes query parameter.  Larger responses are replaced by an error with
+// status 413.  The limit does not prevent a write from taking effect.
+const MaxResponseBytesHeader = "X-Max-Response-Bytes"
+
+// maxResponseBytes returns the largest response body which r will accept,
+// or zero if there is no limit.
+func maxResponseBytes(r *http.Request) (int, error) {
+	val := r.Header.Get(MaxResponseBytesHeader)
+	if q := r.URL.Query().Get("maxbytes"); q != "" {
+		val = q
+	}
+	if val == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid response size limit %q", val)
+	}
+	return n, nil
+}
+
+// prefers returns true if r has a Prefer header (RFC 7240) which includes
+// the given preference.
+func prefers(r *http.Request, pref string) bool {
+	for _, header := range r.Header["Prefer"] {
+		for _, p := range strings.Split(header, ",") {
+			if p = strings.TrimSpace(p); p == pref || strings.HasPrefix(p, pref+"=") || strings.HasPrefix(p, pref+";") {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	return ret.find(pieces[1:])
+// allowedMethods returns the methods which are meaningful for obj, in the
+// order in which they are listed in the Allow header.
+func (obj *Object) allowedMethods() []string {
+	var methods []string
+	if !obj.writeOnly() {
+		methods = append(methods, "GET", "HEAD")
+	}
+	p := obj.parent
+	settable := p != nil && (p.kind == reflect.Map || obj.root.CanSet())
+	readOnly := obj.readOnly()
+	// Entries can be posted to any map, even one which can't be replaced.
+	if !readOnly && (settable || obj.deref().kind == reflect.Map) {
+		methods = append(methods, "POST")
+	}
+	if !readOnly && settable {
+		switch elemType(obj.typ).Kind() {
+		case reflect.Struct, reflect.Map, reflect.Interface:
+			methods = append(methods, "PATCH")
+		}
+	}
+	if !readOnly && (obj.putsEntry() || indirect(obj.root).Kind() == reflect.Slice) {
+		methods = append(methods, "PUT")
+	}
+	if !readOnly && (p != nil && (p.kind == reflect.Map || p.kind == reflect.Slice || obj.root.CanSet()) || obj.truncates()) {
+		methods = append(methods, "DELETE")
+	}
+	methods = append(methods, "OPTIONS")
+	// Overrides can add methods which aren't otherwise supported.
+outer:
+	for _, method := range obj.overriddenMethods() {
+		for _, m := range methods {
+			if m == method {
+				continue outer
+			}
+		}
+		methods = append(methods, method)
+	}
+	return methods
 }
 
 func (obj *Object) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
+	if top := obj.top(); top.Logger != nil || top.Metrics != nil {
+		obj.serveLogged(w, r, top.Logger, top.Metrics)
+		return
+	}
+	obj.serve(w, r, new(LogEntry))
+}
+
+// serve serves r, and records how it was resolved and dispatched in entry.
+func (obj *Object) serve(w http.ResponseWriter, r *http.Request, entry *LogEntry) {
+	if obj.layers != nil {
+		obj.serveMerged(w, r)
+		return
+	}
+
 	pieces := strings.Split(r.URL.Path, "/")[1:]
-	actual, found := obj.find(pieces)
-	if !found {
-		obj.rw.RLock()
-		defer obj.rw.RUnlock()
-		w.Header().Set("Content-Type", PlainText)
-		w.WriteHeader(http.StatusNotFound)
-		keys := make([]string, 0, len(obj.child))
-		for key := range actual.child {
-			keys = append(keys, pathpkg.Join(actual.path, key))
-		}
-		sort.Strings(keys)
-		for _, key := range keys {
-			fmt.Fprintln(w, key)
+	pointers := usesPointers(r)
+	if pointers {
+		for i, piece := range pieces {
+			key, err := unescapePointer(piece)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pieces[i] = key
 		}
+	}
+	if obj.isEventsPath(pieces) {
+		obj.serveEventsPath(w, r, entry)
+		return
+	}
+	actual, missing := obj.lookup(pieces)
+	found := len(missing) == 0
+	if len(missing) == 1 && (r.Method == "POST" || r.Method == "PUT") {
+		// Writes can create new keys in maps
+		if child := actual.newChild(missing[0]); child != nil {
+			actual, found = child, true
+		}
+	}
+	target := actual.path
+	if !found {
+		target = pathpkg.Join(append([]string{target}, missing...)...)
+	}
+	entry.Path, entry.Found = target, found
+	if code, err := obj.authorize(r, target); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if !found && r.Method == "DELETE" && obj.top().IdempotentDelete {
+		// The target is already gone, which is what the client wanted.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !found && actual.isLeaf() && !isNil(actual.root) {
+		http.Error(w, actual.path+" is a scalar and has no children", http.StatusNotFound)
+		return
+	}
+	if !found {
+		actual.serveNotFound(w, r, pointers)
 		return
 	}
 	obj = actual
+	if code, err := obj.checkWritable(w.Header(), r.Method); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if code, err := obj.checkReadable(w.Header(), r.Method); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	entry.Dispatched = r.Method
+
+	if obj.wantsAsync(r) {
+		obj.serveAsync(w, r)
+		return
+	}
+	if _, ok := r.URL.Query()["events"]; ok && r.Method == "GET" {
+		obj.serveEvents(w, r)
+		return
+	}
+	if obj.wantsNDJSON(r) {
+		obj.serveNDJSON(w, r)
+		return
+	}
 
-	var f func(io.Writer, http.Header, *http.Request) (int, error)
+	limit, err := maxResponseBytes(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	callback, err := obj.jsonpCallback(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code, buf, err := obj.handle(w.Header(), r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if callback != "" {
+		buf = wrapJSONP(w.Header(), callback, buf)
+	}
+	if limit > 0 && buf.Len() > limit {
+		msg := fmt.Sprintf("response of %d bytes exceeds the limit of %d bytes", buf.Len(), limit)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	obj.writeBody(w, r, code, buf)
+}
+
+// handle performs r on obj while holding the locks it needs, and returns the
+// status and body of the response.  The response is written by ServeHTTP once
+// the locks are released, so that a slow client can't hold up other requests.
+func (obj *Object) handle(headers http.Header, r *http.Request) (int, *bytes.Buffer, error) {
+	var f MethodHandler
+	custom := obj.handlerFor(r.Method)
 	switch r.Method {
 	case "GET":
 		f = obj.Get
-		obj.rw.RLock()
-		defer obj.rw.RUnlock()
+		defer obj.lockRead()()
 	case "POST":
 		f = obj.Post
-		obj.rw.Lock()
-		defer obj.rw.Unlock()
+		defer obj.lockWrite(false)()
 	case "PUT":
+		// PUT appends to a slice, but sets a map entry or slice element.
 		f = obj.Put
-		obj.rw.Lock()
-		defer obj.rw.Unlock()
+		defer obj.lockWrite(false)()
 	case "DELETE":
 		f = obj.Delete
-		obj.rw.Lock()
-		defer obj.rw.Unlock()
+		defer obj.lockWrite(true)()
 	case "PATCH":
 		f = obj.Patch
-		obj.rw.Lock()
-		defer obj.rw.Unlock()
+		defer obj.lockWrite(false)()
 	case "HEAD":
 		f = obj.Head
-		obj.rw.RLock()
-		defer obj.rw.RUnlock()
+		defer obj.lockRead()()
+	case "OPTIONS":
+		defer obj.lockRead()()
+		if custom != nil {
+			break
+		}
+		headers.Set("Allow", strings.Join(obj.allowedMethods(), ", "))
+		// The OpenAPI document describes what each method does.
+		headers.Set("Link", fmt.Sprintf("<%s?openapi.json>; rel=%q", obj.path, "describedby"))
+		return http.StatusNoContent, new(bytes.Buffer), nil
 	default:
-		w.Header().Set("Allow", "GET, POST, PUT, DELETE, PATCH, HEAD")
-		http.Error(w, r.Method+" not allowed", http.StatusMethodNotAllowed)
-		return
+		if custom != nil {
+			defer obj.lockWrite(false)()
+			break
+		}
+		defer obj.lockRead()()
+		headers.Set("Allow", strings.Join(obj.allowedMethods(), ", "))
+		return http.StatusMethodNotAllowed, nil, fmt.Errorf("%s not allowed", r.Method)
+	}
+
+	if code, err := obj.checkPreconditions(r); err != nil {
+		return code, nil, err
+	}
+	if custom != nil {
+		f = custom
 	}
 
 	buf := new(bytes.Buffer)
-	code, err := f(buf, w.Header(), r)
+	code, err := obj.wrap(f)(buf, headers, obj.withResolvedPath(r))
 	if err != nil {
 		if code == 0 || code == http.StatusOK {
 			code = http.StatusInternalServerError
 		}
-		http.Error(w, err.Error(), code)
-		return
+		if code == http.StatusMethodNotAllowed {
+			headers.Set("Allow", strings.Join(obj.allowedMethods(), ", "))
+		}
+		return code, nil, err
 	}
+	return code, buf, nil
+}
 
-	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
-	w.WriteHeader(code)
-	buf.WriteTo(w)
+// checkPreconditions returns 412 Precondition Failed if the conditional
+// headers of r, a write, don't allow it.  The caller must hold obj.rw.
+func (obj *Object) checkPreconditions(r *http.Request) (int, error) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		return 0, nil
+	}
+	// If-None-Match: * only allows writes which create the target.
+	if r.Header.Get("If-None-Match") == "*" && obj.exists() {
+		return http.StatusPreconditionFailed, fmt.Errorf("%s already exists", obj.path)
+	}
+	// If-Match only allows writes to the value the client last saw.
+	if r.Header.Get("If-Match") != "" {
+		return obj.checkIfMatch(r)
+	}
+	return 0, nil
 }
 
-func encodeJSON(w io.Writer, headers http.Header, v reflect.Value) (code int, err error) {
+// encodeJSON writes v to w as JSON.  The query parameters of r can adjust
+// the encoding:
+//
+//	noescape  - do not escape <, >, and & for embedding in HTML
+//	canonical - write canonical JSON (see writeCanonical)
+//	pretty    - indent the output for people to read (ignored if canonical)
+//
+// Values which can't be encoded are the fault of the server, so they fail
+// with 500 Internal Server Error, unless the client went away first, in
+// which case the encoding fails with 503 Service Unavailable (as with
+// encodeTree).  A panic while encoding is logged with its stack, since it
+// usually means a MarshalJSON method is broken.
+func encodeJSON(w io.Writer, headers http.Header, r *http.Request, v reflect.Value) (code int, err error) {
 	defer func() {
-		if r := recover(); r != nil {
-			code, err = http.StatusInternalServerError, fmt.Errorf("encode %s: %v", v.Type().Name, r)
+		if p := recover(); p != nil {
+			log.Printf("rest: panic encoding %s: %v\n%s", v.Type(), p, debug.Stack())
+			code, err = http.StatusInternalServerError, fmt.Errorf("encode %s: %v", v.Type(), p)
 		}
 	}()
 	headers.Set("Content-Type", ApplicationJSON)
-	return http.StatusOK, json.NewEncoder(w).Encode(v.Interface())
+	query := r.URL.Query()
+	_, noescape := query["noescape"]
+	if _, ok := query["canonical"]; ok {
+		err = writeCanonical(w, v.Interface(), !noescape)
+	} else {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(!noescape)
+		if _, ok := query["pretty"]; ok {
+			enc.SetIndent("", "  ")
+		}
+		err = enc.Encode(v.Interface())
+	}
+	switch {
+	case err == nil:
+		return http.StatusOK, nil
+	case r.Context().Err() != nil:
+		return http.StatusServiceUnavailable, fmt.Errorf("request cancelled: %s", err)
+	}
+	return http.StatusInternalServerError, fmt.Errorf("encode %s: %s", v.Type(), err)
 }
 
-func decodeJSON(r io.Reader, typ reflect.Type) (vptr reflect.Value, err error) {
+// decodeJSON decodes a JSON value of the given type from r.  If strict is
+// set, objects may only have keys which match fields of the structs they are
+// decoded into.
+func decodeJSON(r io.Reader, typ reflect.Type, strict bool) (vptr reflect.Value, err error) {
 	zptr := reflect.New(typ)
-	if err := json.NewDecoder(r).Decode(zptr.Interface()); err != nil {
+	dec := json.NewDecoder(r)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(zptr.Interface()); err != nil {
 		return reflect.Value{}, fmt.Errorf("failed to decode body as JSON: %s", err)
 	}
 	return zptr.Elem(), nil
 }
 
+// Get writes the value of obj (or the view of it selected by the query
+// parameters of r).  Successful responses have an ETag and a Last-Modified
+// time, and are replaced by 304 Not Modified if the If-None-Match or
+// If-Modified-Since header of r shows that the client has the current value.
 func (obj *Object) Get(w io.Writer, headers http.Header, r *http.Request) (int, error) {
-	return encodeJSON(w, headers, obj.root)
+	buf := new(bytes.Buffer)
+	code, err := obj.get(buf, headers, r)
+	if err != nil || code != http.StatusOK {
+		buf.WriteTo(w)
+		return code, err
+	}
+	tag := bodyETag(buf.Bytes())
+	headers.Set("ETag", tag)
+	modified := obj.lastModified()
+	if !modified.IsZero() {
+		headers.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), tag, false) || notModifiedSince(r, modified) {
+		return http.StatusNotModified, nil
+	}
+	buf.WriteTo(w)
+	return code, nil
+}
+
+func (obj *Object) get(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	if _, ok := r.URL.Query()["lastevent"]; ok {
+		return obj.getLastEvent(w, headers, r)
+	}
+	if token, ok := r.URL.Query()["children-since"]; ok {
+		return obj.getChildrenSince(w, headers, r, token[0])
+	}
+	if _, ok := r.URL.Query()["size"]; ok {
+		return obj.getSize(w, headers, r)
+	}
+	if _, ok := r.URL.Query()["history"]; ok {
+		return obj.getHistory(w, headers, r)
+	}
+	if _, ok := r.URL.Query()["openapi.json"]; ok {
+		return encodeJSON(w, headers, r, reflect.ValueOf(obj.OpenAPI()))
+	}
+	if field := r.URL.Query().Get("distinct"); field != "" {
+		return obj.getDistinct(w, headers, r, field)
+	}
+	if field := r.URL.Query().Get("sort"); field != "" {
+		return obj.getSorted(w, headers, r, field)
+	}
+	if field := r.URL.Query().Get("expand"); field != "" {
+		return obj.getExpanded(w, headers, r, field)
+	}
+	if _, ok := r.URL.Query()["validate"]; ok {
+		return obj.getValidation(w, headers, r)
+	}
+	switch as := r.URL.Query().Get("as"); as {
+	case "":
+	case "entries":
+		return obj.getEntries(w, headers, r)
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown form %q", as)
+	}
+	if _, ok := r.URL.Query()["etags"]; ok {
+		return obj.getETags(w, headers, r)
+	}
+	if _, ok := r.URL.Query()["nav"]; ok {
+		return obj.getNav(w, headers, r)
+	}
+	if depth := r.URL.Query().Get("depth"); depth != "" {
+		return obj.getDepth(w, headers, r, depth)
+	}
+	if query := r.URL.Query(); query["offset"] != nil || query["limit"] != nil {
+		return obj.getWindow(w, headers, r)
+	}
+	if list := r.URL.Query().Get("fields"); list != "" {
+		return obj.getFields(w, headers, r, list)
+	}
+	if list := r.URL.Query().Get("paths"); list != "" {
+		return obj.getPaths(w, headers, r, list)
+	}
+	if obj.page != nil {
+		obj.page.setHeaders(headers)
+	}
+	if n, ok := obj.itemCount(); ok {
+		headers.Set("X-Item-Count", strconv.Itoa(n))
+	}
+	if obj.top().ValidateOnGet {
+		obj.setWarnings(headers)
+	}
+	if obj.opts.contentType != "" {
+		headers.Set("Content-Type", obj.opts.contentType)
+		w.Write(rawBytes(obj.root))
+		return http.StatusOK, nil
+	}
+	return obj.encodeTree(w, headers, r)
 }
 
+// Post replaces the value of obj with the body of r.  For a slice, the body
+// is the whole new slice; with an "append" query parameter, it is instead a
+// single element to append, as with Put.  For a map, the body may also be a
+// list of entries to set (see postEntries).
 func (obj *Object) Post(w io.Writer, headers http.Header, r *http.Request) (int, error) {
-	v, err := decodeJSON(r.Body, obj.typ)
+	// A touch notifies subscribers without changing anything.
+	if prefers(r, "touch") {
+		headers.Set("Preference-Applied", "touch")
+		obj.emit(esource.Event{
+			Type: "touch",
+			Data: obj.path,
+		})
+		return http.StatusNoContent, nil
+	}
+
+	if val, ok := r.URL.Query()["append"]; ok {
+		appending, err := strconv.ParseBool(val[0])
+		if val[0] == "" {
+			appending, err = true, nil
+		}
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid append %q", val[0])
+		}
+		if appending {
+			if indirect(obj.root).Kind() != reflect.Slice {
+				return http.StatusBadRequest, fmt.Errorf("cannot append to non-slice %s", obj.path)
+			}
+			return obj.Put(w, headers, r)
+		}
+	}
+
+	data, err := obj.readBody(r)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return errorCode(err, http.StatusBadRequest), err
 	}
-	if err := obj.set(v); err != nil {
-		return http.StatusBadRequest, err
+	if obj.deref().kind == reflect.Map {
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+			return obj.postEntries(data, obj.strictDecode(r))
+		}
+	}
+
+	var v reflect.Value
+	if obj.opts.contentType != "" {
+		v = reflect.ValueOf(data).Convert(obj.typ)
+	} else {
+		if decoderFor(r) == nil {
+			data = unquoteBigNums(data, obj.typ, obj.opts)
+		}
+		if v, err = decodeBody(r, data, obj.typ, obj.isStringer(), obj.strictDecode(r)); err != nil {
+			if obj.wantsArray(r, data) {
+				return http.StatusBadRequest, fmt.Errorf("POST replaces the whole of slice %s, so the body must be an array; "+
+					"use PUT or POST %s?append to append one element", obj.path, obj.path)
+			}
+			return http.StatusBadRequest, err
+		}
 	}
-	obj.ESource.Events <- esource.Event{
-		Type: "post",
-		Data: obj.path,
+	if err := obj.restrictFields(data, v); err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	// A diff would show write-only values, so it isn't offered for them.
+	if prefers(r, "diff") && !obj.writeOnly() {
+		headers.Set("Preference-Applied", "diff")
+		return obj.writeDiff(w, headers, r, v)
+	}
+	if _, err := obj.apply("post", v, true); err != nil {
+		return errorCode(err, http.StatusBadRequest), err
 	}
 	return http.StatusNoContent, nil
 }
 
-func (obj *Object) Put(w io.Writer, headers http.Header, r *http.Request) (int, error) {
-	root := obj.root
-	for {
-		k := root.Kind()
+// DefaultMaxBodyBytes is the default limit on the size of request bodies
+// (see MaxBodyBytes).
+const DefaultMaxBodyBytes = 1 << 20
+
+// readBody reads the body of r, which must be no larger than MaxBodyBytes.
+func (obj *Object) readBody(r *http.Request) ([]byte, error) {
+	limit := obj.top().MaxBodyBytes
+	if limit == 0 {
+		limit = DefaultMaxBodyBytes
+	}
+	var body io.Reader = r.Body
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %s", err)
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		msg := fmt.Sprintf("request body exceeds the limit of %d bytes", limit)
+		return nil, &statusError{http.StatusRequestEntityTooLarge, msg}
+	}
+	return data, nil
+}
+
+// strictDecode returns true if unknown fields in the JSON body of r should be
+// rejected (see StrictDecode).
+func (obj *Object) strictDecode(r *http.Request) bool {
+	_, strict := r.URL.Query()["strict"]
+	return strict || obj.top().StrictDecode
+}
+
+// decodeValue decodes a value of the given type from r, either as JSON or
+// (if stringer is set) as a string for the type's registered ParseFunc.
+func decodeValue(r io.Reader, typ reflect.Type, stringer bool) (reflect.Value, error) {
+	if stringer {
+		return decodeString(r, typ)
+	}
+	return decodeJSON(r, typ, false)
+}
+
+// apply performs the operation op with the value v on obj, notifies any
+// subscribers, and (if log is set) records the mutation in the mutation log.
+// All changes to the tree go through apply.  It returns the path of the
+// changed object.  A value which is a Validator (or whose pointer is) must be
+// valid to be stored.
+//
+// The ID of the event for each change is the version of the tree after the
+// change, which increases by one with every change, so subscribers can
+// detect missed events.
+//
+// The supported operations are:
+//
+//	post   - replace the value of obj with v
+//	patch  - replace the value of obj with v, which was merged from a patch
+//	put    - append v to the slice held by obj
+//	delete - remove obj from its parent, or zero it if it is a struct field
+//	         (v is unused)
+func (obj *Object) apply(op string, v reflect.Value, log bool) (string, error) {
+	path := obj.path
+	stringer := obj.isStringer()
+	typ := obj.eventType(op)
+	created := op == "put" || ((op == "post" || op == "patch") && !obj.exists())
+	change := obj.startChange(op, created)
+	// Removing a slice element changes the ones after it as well.
+	shifted := op == "delete" && obj.parent != nil && obj.parent.kind == reflect.Slice
+	switch op {
+	case "post", "patch":
+		if err := obj.checkSet(v); err != nil {
+			return "", err
+		}
+		if err := obj.set(v); err != nil {
+			return "", err
+		}
+	case "put":
+		if err := checkEnums(v, obj.opts.enum); err != nil {
+			return "", err
+		}
+		if err := checkValid(v); err != nil {
+			return "", err
+		}
 		// TODO(kevlar) this probably doesn't actually with pointers... should it?
+		root := indirect(obj.root)
+		k, t := root.Kind(), root.Type()
+		if k != reflect.Slice {
+			return "", fmt.Errorf("cannot PUT object in non-slice type %s", t)
+		}
+		stringer = isStringerType(t.Elem())
+		path = pathpkg.Join(obj.path, strconv.Itoa(root.Len()))
+		if err := obj.set(reflect.Append(root, v)); err != nil {
+			return "", err
+		}
+	case "delete":
+		if err := obj.del(); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unknown operation %q", op)
+	}
+
+	if op != "delete" {
+		obj.recordHistory(pathpkg.Base(path), op == "put")
+	}
+	switch {
+	case shifted:
+		obj.markModified(pathpkg.Dir(path))
+	case op == "delete":
+		obj.markRemoved(path)
+	default:
+		obj.markModified(path)
+	}
+	newValue := v
+	if obj.writeOnly() {
+		newValue = reflect.Value{} // clients can't see write-only values
+	}
+	data := eventData(path, change, newValue, stringer)
+	obj.recordChange(op, path, created, func(version uint64) {
+		obj.emitFor(path, esource.Event{
+			ID:   strconv.FormatUint(version, 10),
+			Type: typ,
+			Data: data,
+		})
+	})
+	if log {
+		obj.logMutation(op, path, v, stringer)
+	}
+	return path, nil
+}
+
+// indirect follows non-nil pointers and interfaces in v until it reaches
+// a concrete value.
+func indirect(v reflect.Value) reflect.Value {
+	for {
+		k := v.Kind()
 		if k != reflect.Ptr && k != reflect.Interface {
-			break
+			return v
 		}
-		if root.IsNil() {
-			break
+		if v.IsNil() {
+			return v
+		}
+		v = v.Elem()
+	}
+}
+
+// isNil returns true if v is a nil pointer or interface, or if following
+// the pointers and interfaces in v leads to one.  This treats an interface
+// holding a nil pointer the same as a nil interface, as encoding/json does.
+func isNil(v reflect.Value) bool {
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// putsEntry returns true if a PUT to obj creates or replaces its entry in
+// its parent map, or replaces its element of its parent slice or array.
+// Entries and elements which hold slices are appended to instead (and map
+// entries are created if necessary).
+func (obj *Object) putsEntry() bool {
+	p := obj.parent
+	if p == nil {
+		return false
+	}
+	switch p.kind {
+	case reflect.Map:
+	case reflect.Slice, reflect.Array:
+		if !obj.root.CanSet() {
+			return false
 		}
-		root = root.Elem()
+	default:
+		return false
+	}
+	return indirect(obj.root).Kind() != reflect.Slice
+}
+
+// wantsArray returns true if obj holds a slice encoded as a JSON array, and
+// the JSON body data of r is not an array.
+func (obj *Object) wantsArray(r *http.Request, data []byte) bool {
+	if decoderFor(r) != nil || obj.isStringer() || marshals(obj.typ) {
+		return false
+	}
+	t := indirect(obj.root).Type()
+	if t.Kind() != reflect.Slice || t.Elem().Kind() == reflect.Uint8 {
+		return false
 	}
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && trimmed[0] != '['
+}
+
+// Put appends the body of r to the slice held by obj, and returns 201
+// Created and the path of the new element.  If obj is an entry of a map or
+// an element of a slice or array (and doesn't hold a slice itself), Put sets
+// the entry or element instead (see putEntry), so that repeating it has no
+// further effect.
+func (obj *Object) Put(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	if obj.putsEntry() {
+		return obj.putEntry(w, headers, r)
+	}
+
+	root := indirect(obj.root)
 	k, t := root.Kind(), root.Type()
 
 	if k != reflect.Slice {
-		return http.StatusBadRequest, fmt.Errorf("cannot PUT object in non-slice type %s", t)
+		return http.StatusMethodNotAllowed, fmt.Errorf("cannot PUT object in non-slice type %s", t)
 	}
-	v, err := decodeJSON(r.Body, t.Elem())
+	data, err := obj.readBody(r)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	if decoderFor(r) == nil {
+		data = unquoteBigNums(data, t.Elem(), tagOptions{})
 	}
-	path := pathpkg.Join(obj.path, strconv.Itoa(root.Len()))
-	root = reflect.Append(root, v)
-	if err := obj.set(root); err != nil {
+	v, err := decodeBody(r, data, t.Elem(), isStringerType(t.Elem()), obj.strictDecode(r))
+	if err != nil {
 		return http.StatusBadRequest, err
 	}
-	obj.ESource.Events <- esource.Event{
-		Type: "put",
-		Data: path,
+	if err := obj.restrictFields(data, v); err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	path, err := obj.apply("put", v, true)
+	if err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	if usesPointers(r) {
+		path = pathpkg.Join(obj.pointer(), pathpkg.Base(path))
 	}
 	headers.Set("Content-Type", PlainText)
 	fmt.Fprintln(w, path)
 	return http.StatusCreated, nil
 }
 
-func (obj *Object) Delete(w io.Writer, headers http.Header, r *http.Request) (int, error) {
-	if err := obj.del(); err != nil {
+// putEntry sets the entry for obj in its parent map, or its element of its
+// parent slice or array, to the body of r.  It returns 201 Created and the
+// path of obj if the entry is new, and 204 No Content otherwise.
+func (obj *Object) putEntry(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	data, err := obj.readBody(r)
+	if err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	if decoderFor(r) == nil {
+		data = unquoteBigNums(data, obj.typ, obj.opts)
+	}
+	v, err := decodeBody(r, data, obj.typ, obj.isStringer(), obj.strictDecode(r))
+	if err != nil {
 		return http.StatusBadRequest, err
 	}
-	obj.ESource.Events <- esource.Event{
-		Type: "delete",
-		Data: obj.path,
+	if err := obj.restrictFields(data, v); err != nil {
+		return errorCode(err, http.StatusBadRequest), err
 	}
-	return http.StatusNoContent, nil
+	created := !obj.exists()
+	if _, err := obj.apply("post", v, true); err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	if !created {
+		return http.StatusNoContent, nil
+	}
+	path := obj.path
+	if usesPointers(r) {
+		path = obj.pointer()
+	}
+	headers.Set("Content-Type", PlainText)
+	fmt.Fprintln(w, path)
+	return http.StatusCreated, nil
 }
 
-func (obj *Object) Patch(w io.Writer, headers http.Header, r *http.Request) (int, error) {
-	return http.StatusNotImplemented, nil
+func (obj *Object) Delete(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	if _, err := obj.apply("delete", reflect.Value{}, true); err != nil {
+		return errorCode(err, http.StatusBadRequest), err
+	}
+	return http.StatusNoContent, nil
 }
 
+// Head responds with the headers of the response Get would give, without
+// the body.  Unless HeadComputesLength is set, the value is only encoded if
+// it is a scalar; the response for a map, slice, or struct has no
+// Content-Length or ETag.
 func (obj *Object) Head(w io.Writer, headers http.Header, r *http.Request) (int, error) {
-	return http.StatusNotImplemented, nil
+	if obj.top().HeadComputesLength || obj.isLeaf() {
+		// The body is discarded by writeBody once its length is known.
+		return obj.Get(w, headers, r)
+	}
+	headers.Add("Vary", "Accept")
+	headers.Set("Content-Type", encoderFor(r).ContentType())
+	if modified := obj.lastModified(); !modified.IsZero() {
+		headers.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	return http.StatusOK, nil
 }
@@ -15,15 +15,30 @@
 package rest
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kylelemons/godebug/diff"
+	"kylelemons.net/go/esource"
 )
 
 func TestRequest(t *testing.T) {
@@ -206,3 +221,4740 @@ func TestRequest(t *testing.T) {
 		// TODO(kevlar): test these?
 	}
 }
+
+// serve issues a single request for target against obj and returns the
+// recorded response.
+func serve(t *testing.T, obj *Object, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatalf("parse %q: %s", target, err)
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	req := &http.Request{
+		Method: method,
+		URL:    u,
+		Header: header,
+		Body:   ioutil.NopCloser(strings.NewReader(body)),
+	}
+	rec := httptest.NewRecorder()
+	obj.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPages(t *testing.T) {
+	obj := NewObject(&struct {
+		Items []int `rest:"pagesize=2"`
+		Names []string
+	}{
+		Items: []int{0, 1, 2, 3, 4},
+		Names: []string{"a"},
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+		total  string
+		link   string
+	}{
+		{"/Items/page/1", http.StatusOK, "[0,1]\n", "5", `</Items/page/2>; rel="next"`},
+		{"/Items/page/2", http.StatusOK, "[2,3]\n", "5", `</Items/page/1>; rel="prev", </Items/page/3>; rel="next"`},
+		{"/Items/page/3", http.StatusOK, "[4]\n", "5", `</Items/page/2>; rel="prev"`},
+		{"/Items/page/4", http.StatusOK, "[]\n", "5", `</Items/page/3>; rel="prev"`},
+		{"/Items/page/9", http.StatusOK, "[]\n", "5", ""},
+		{"/Names/page/1", http.StatusOK, `["a"]` + "\n", "1", ""},
+		{"/Items/page/0", http.StatusNotFound, "/Items/0\n/Items/1\n/Items/2\n/Items/3\n/Items/4\n", "", ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("GET %q: body = %q, want %q", test.path, got, want)
+		}
+		if got, want := rec.HeaderMap.Get("X-Total-Count"), test.total; got != want {
+			t.Errorf("GET %q: X-Total-Count = %q, want %q", test.path, got, want)
+		}
+		if got, want := rec.HeaderMap.Get("Link"), test.link; got != want {
+			t.Errorf("GET %q: Link = %q, want %q", test.path, got, want)
+		}
+	}
+
+	if rec := serve(t, obj, "POST", "/Items/page/1", "[7]", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST to a page: code = %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+}
+
+type point struct{ X, Y int }
+
+func (p point) String() string { return fmt.Sprintf("%d,%d", p.X, p.Y) }
+
+func parsePoint(s string) (interface{}, error) {
+	var p point
+	_, err := fmt.Sscanf(s, "%d,%d", &p.X, &p.Y)
+	return p, err
+}
+
+type version struct{ Major int }
+
+func (v version) String() string { return fmt.Sprintf("v%d", v.Major) }
+
+func TestStringers(t *testing.T) {
+	RegisterStringer(point{}, parsePoint)
+
+	obj := NewObject(&struct {
+		Origin  point
+		Extent  *point
+		Missing *point
+		Version version `rest:"stringer"`
+		Raw     version
+		Points  map[string]interface{}
+	}{
+		Origin:  point{1, 2},
+		Extent:  &point{3, 4},
+		Version: version{1},
+		Raw:     version{2},
+		Points:  map[string]interface{}{"a": point{5, 6}},
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		output string
+	}{
+		{"GET", "/", "", http.StatusOK, `{"Origin":"1,2","Extent":"3,4","Missing":null,"Version":"v1","Raw":{"Major":2},"Points":{"a":"5,6"}}` + "\n"},
+		{"GET", "/Origin", "", http.StatusOK, `"1,2"` + "\n"},
+		{"GET", "/Origin/X", "", http.StatusNotFound, ""},
+		{"GET", "/Points/a", "", http.StatusOK, `"5,6"` + "\n"},
+		{"POST", "/Origin", `"7,8"`, http.StatusNoContent, ""},
+		{"POST", "/Missing", `"9,10"`, http.StatusNoContent, ""},
+		{"POST", "/Extent", `"bogus"`, http.StatusBadRequest, ""},
+		{"POST", "/Version", `"v3"`, http.StatusBadRequest, ""},
+		{"GET", "/", "", http.StatusOK, `{"Origin":"7,8","Extent":"3,4","Missing":"9,10","Version":"v1","Raw":{"Major":2},"Points":{"a":"5,6"}}` + "\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v", test.method, test.path, got, want)
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("%s %q: body mismatch:\n%s", test.method, test.path, diff.Diff(got, want))
+		}
+	}
+}
+
+func TestLastEvent(t *testing.T) {
+	obj := NewObject(map[string][]string{
+		"foo": {"bar"},
+		"baz": {},
+	})
+	obj.KeepLastEvent = true
+
+	if rec := serve(t, obj, "GET", "/foo?lastevent", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("before PUT: code = %v, want %v", rec.Code, http.StatusNoContent)
+	}
+	if rec := serve(t, obj, "PUT", "/foo", `"quux"`, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT: code = %v, want %v", rec.Code, http.StatusCreated)
+	}
+	for _, path := range []string{"/foo", "/foo/1"} {
+		rec := serve(t, obj, "GET", path+"?lastevent", "", nil)
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("GET %q: code = %v, want %v", path, got, want)
+		}
+		if got, want := rec.Body.String(), `"Data":"/foo/1"`; !strings.Contains(got, want) {
+			t.Errorf("GET %q: body %q does not contain %q", path, got, want)
+		}
+	}
+	if rec := serve(t, obj, "GET", "/baz?lastevent", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("unchanged path: code = %v, want %v", rec.Code, http.StatusNoContent)
+	}
+}
+
+func TestMapKeys(t *testing.T) {
+	type coord struct{ X, Y int }
+	obj := NewObject(map[coord]string{
+		{1, 2}: "a",
+		{3, 4}: "b",
+	})
+
+	if rec := serve(t, obj, "GET", "/", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET: code = %v, want %v", rec.Code, http.StatusOK)
+	} else if got, want := rec.Body.String(), `{"{1 2}":"a","{3 4}":"b"}`+"\n"; got != want {
+		t.Errorf("GET: body = %q, want %q", got, want)
+	}
+	if rec := serve(t, obj, "GET", "/{3 4}", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET element: code = %v, want %v", rec.Code, http.StatusOK)
+	} else if got, want := rec.Body.String(), `"b"`+"\n"; got != want {
+		t.Errorf("GET element: body = %q, want %q", got, want)
+	}
+
+	// The listed keys can be written as well as read.
+	if rec := serve(t, obj, "POST", "/{3 4}", `"c"`, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("POST element: code = %v, want %v (%s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if rec := serve(t, obj, "DELETE", "/{1 2}", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE element: code = %v, want %v (%s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if got, want := serve(t, obj, "GET", "/", "", nil).Body.String(), `{"{3 4}":"c"}`+"\n"; got != want {
+		t.Errorf("after writes: GET = %q, want %q", got, want)
+	}
+}
+
+// A release is a map key which is encoded as text.
+type release struct{ Major, Minor int }
+
+func (v release) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("v%d.%d", v.Major, v.Minor)), nil
+}
+
+func (v *release) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "v%d.%d", &v.Major, &v.Minor)
+	return err
+}
+
+func TestSetMapKeys(t *testing.T) {
+	type ID string
+	obj := NewObject(&struct {
+		ByNum map[int]string
+		ByID  map[ID]int
+		ByU8  map[uint8]bool
+		ByF   map[float64]string
+		ByB   map[bool]int
+		ByV   map[release]string
+	}{
+		map[int]string{1: "one"}, map[ID]int{}, map[uint8]bool{},
+		map[float64]string{1.5: "x"}, map[bool]int{true: 1}, map[release]string{{1, 0}: "old"},
+	})
+
+	tests := []struct {
+		path, body string
+		code       int
+	}{
+		{"/ByNum/2", `"two"`, http.StatusNoContent},
+		{"/ByNum/1", `"uno"`, http.StatusNoContent},
+		{"/ByNum/x", `"x"`, http.StatusBadRequest},
+		{"/ByID/abc", `5`, http.StatusNoContent},
+		{"/ByU8/200", `true`, http.StatusNoContent},
+		{"/ByU8/300", `true`, http.StatusBadRequest},
+		{"/ByF/1.5", `"y"`, http.StatusNoContent},
+		{"/ByF/2.25", `"z"`, http.StatusNoContent},
+		{"/ByF/x", `"x"`, http.StatusBadRequest},
+		{"/ByB/false", `0`, http.StatusNoContent},
+		{"/ByB/maybe", `2`, http.StatusBadRequest},
+		{"/ByV/v1.0", `"first"`, http.StatusNoContent},
+		{"/ByV/v2.1", `"new"`, http.StatusNoContent},
+		{"/ByV/2", `"bad"`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "POST", test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("POST %q: code = %v, want %v (%s)", test.path, got, want, rec.Body)
+		}
+	}
+	for _, path := range []string{"/ByF/2.25", "/ByB/true", "/ByV/v1.0"} {
+		if rec := serve(t, obj, "DELETE", path, "", nil); rec.Code != http.StatusNoContent {
+			t.Errorf("DELETE %q: code = %v, want %v (%s)", path, rec.Code, http.StatusNoContent, rec.Body)
+		}
+	}
+
+	rec := serve(t, obj, "GET", "/", "", nil)
+	want := `{"ByNum":{"1":"uno","2":"two"},"ByID":{"abc":5},"ByU8":{"200":true},` +
+		`"ByF":{"1.5":"y"},"ByB":{"false":0},"ByV":{"v2.1":"new"}}` + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("GET: body = %q, want %q", got, want)
+	}
+}
+
+func TestCreateOnly(t *testing.T) {
+	obj := NewObject(&struct {
+		Users map[string]string `rest:"createonly"`
+		Other map[string]string
+	}{
+		Users: map[string]string{},
+		Other: map[string]string{},
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"POST", "/Users/bob", `"x"`, http.StatusNoContent},
+		{"POST", "/Users/bob", `"y"`, http.StatusConflict},
+		{"POST", "/Users/sue", `"z"`, http.StatusNoContent},
+		{"POST", "/Other/a", `"1"`, http.StatusNoContent},
+		{"POST", "/Other/a", `"2"`, http.StatusNoContent},
+		{"POST", "/Other/a/b", `"3"`, http.StatusNotFound},
+		{"PUT", "/Users/bob", `"w"`, http.StatusConflict},
+		{"PUT", "/Users/tim", `"v"`, http.StatusCreated},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v", test.method, test.path, got, want)
+		}
+	}
+
+	rec := serve(t, obj, "GET", "/", "", nil)
+	if got, want := rec.Body.String(), `{"Users":{"bob":"x","sue":"z","tim":"v"},"Other":{"a":"2"}}`+"\n"; got != want {
+		t.Errorf("GET: body = %q, want %q", got, want)
+	}
+}
+
+func TestAsync(t *testing.T) {
+	obj := NewObject(map[string][]string{
+		"foo": {"bar"},
+	})
+	obj.AllowAsync = true
+
+	async := http.Header{"Prefer": {"respond-async"}}
+	rec := serve(t, obj, "PUT", "/foo", `"baz"`, async)
+	if got, want := rec.Code, http.StatusAccepted; got != want {
+		t.Fatalf("PUT: code = %v, want %v", got, want)
+	}
+	status := rec.HeaderMap.Get("Location")
+	if got, want := rec.Body.String(), status+"\n"; got != want {
+		t.Errorf("PUT: body = %q, want %q", got, want)
+	}
+
+	// Wait for the job to finish
+	for i := 0; ; i++ {
+		rec = serve(t, obj, "GET", status+"/Status", "", nil)
+		if rec.Body.String() != `"running"`+"\n" {
+			break
+		}
+		if i > 1000 {
+			t.Fatalf("job did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	rec = serve(t, obj, "GET", status, "", nil)
+	if got, want := rec.Body.String(), `"Status":"done","Code":201,"Result":"/foo/1\n"`; !strings.Contains(got, want) {
+		t.Errorf("GET %q: body %q does not contain %q", status, got, want)
+	}
+
+	rec = serve(t, obj, "GET", "/foo", "", nil)
+	if got, want := rec.Body.String(), `["bar","baz"]`+"\n"; got != want {
+		t.Errorf("GET: body = %q, want %q", got, want)
+	}
+}
+
+func TestAsyncPipeline(t *testing.T) {
+	obj := NewObject(map[string]string{"a": "x"})
+	obj.AllowAsync = true
+	var mu sync.Mutex
+	var writes []string
+	obj.Use(func(next MethodHandler) MethodHandler {
+		return func(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+			if r.Method != "GET" {
+				mu.Lock()
+				writes = append(writes, r.Method+" "+ResolvedPath(r))
+				mu.Unlock()
+			}
+			return next(w, headers, r)
+		}
+	})
+	obj.HandleFunc("b", "PUT", func(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+		fmt.Fprint(w, "custom")
+		return http.StatusOK, nil
+	})
+
+	// wait returns the final status of the job at path.
+	wait := func(path string) string {
+		for i := 0; ; i++ {
+			rec := serve(t, obj, "GET", path, "", nil)
+			if !strings.Contains(rec.Body.String(), `"running"`) {
+				return rec.Body.String()
+			}
+			if i > 1000 {
+				t.Fatalf("job did not finish")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	async := http.Header{"Prefer": {"respond-async"}}
+	ifNone := http.Header{"Prefer": {"respond-async"}, "If-None-Match": {"*"}}
+	if got, want := serve(t, obj, "POST", "/a", `"y"`, ifNone).Code, http.StatusPreconditionFailed; got != want {
+		t.Errorf("POST /a with If-None-Match: *: code = %v, want %v", got, want)
+	}
+
+	rec := serve(t, obj, "PUT", "/b", `"z"`, async)
+	if got, want := rec.Code, http.StatusAccepted; got != want {
+		t.Fatalf("PUT /b: code = %v, want %v", got, want)
+	}
+	if got, want := wait(rec.Header().Get("Location")), `"Status":"done","Code":200,"Result":"custom"`; !strings.Contains(got, want) {
+		t.Errorf("PUT /b: job = %s, want it to contain %s", got, want)
+	}
+	rec = serve(t, obj, "POST", "/a", `"w"`, async)
+	if got, want := wait(rec.Header().Get("Location")), `"Status":"done","Code":204`; !strings.Contains(got, want) {
+		t.Errorf("POST /a: job = %s, want it to contain %s", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := strings.Join(writes, ", "), "PUT /b, POST /a"; got != want {
+		t.Errorf("middleware saw %s, want %s", got, want)
+	}
+}
+
+func TestNilInterfaces(t *testing.T) {
+	RegisterStringer(point{}, parsePoint)
+
+	type inner struct{ X int }
+	for _, custom := range []bool{false, true} {
+		input := map[string]interface{}{
+			"Nil":      nil,
+			"TypedNil": (*inner)(nil),
+		}
+		if custom {
+			// Force the tree to be encoded by view
+			input["Point"] = point{1, 2}
+		}
+		obj := NewObject(input)
+
+		for _, field := range []string{"Nil", "TypedNil"} {
+			desc := fmt.Sprintf("custom=%v: %s", custom, field)
+			rec := serve(t, obj, "GET", "/"+field, "", nil)
+			if got, want := rec.Body.String(), "null\n"; got != want {
+				t.Errorf("%s: GET = %q, want %q", desc, got, want)
+			}
+			rec = serve(t, obj, "GET", "/"+field+"/X", "", nil)
+			if got, want := rec.Code, http.StatusNotFound; got != want {
+				t.Errorf("%s: GET child: code = %v, want %v", desc, got, want)
+			}
+			if got, want := rec.Body.String(), ""; got != want {
+				t.Errorf("%s: GET child: listing = %q, want %q", desc, got, want)
+			}
+			rec = serve(t, obj, "POST", "/"+field+"/X", "1", nil)
+			if got, want := rec.Code, http.StatusNotFound; got != want {
+				t.Errorf("%s: POST child: code = %v, want %v", desc, got, want)
+			}
+		}
+		rec := serve(t, obj, "GET", "/", "", nil)
+		for _, want := range []string{`"Nil":null`, `"TypedNil":null`} {
+			if got := rec.Body.String(); !strings.Contains(got, want) {
+				t.Errorf("custom=%v: GET = %q, want %q", custom, got, want)
+			}
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	type user struct {
+		Name  string `json:"name"`
+		Admin bool
+	}
+	obj := NewObject(&struct {
+		Users map[string]*user
+		Tags  [][]string
+	}{
+		Users: map[string]*user{"bob": {Name: "Bob"}},
+		Tags:  [][]string{{"a"}},
+	})
+
+	rec := serve(t, obj, "GET", "/?openapi.json", "", nil)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("code = %v, want %v", got, want)
+	}
+	var doc struct {
+		OpenAPI    string
+		Paths      map[string]map[string]interface{}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+
+	var paths []string
+	for path, ops := range doc.Paths {
+		var methods []string
+		for method := range ops {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		paths = append(paths, path+" "+strings.Join(methods, ","))
+	}
+	sort.Strings(paths)
+	want := []string{
+		"/ get",
+		"/Tags get,post,put",
+		"/Tags/{index} get,parameters,post,put",
+		"/Tags/{index}/{index2} get,parameters,post,put",
+		"/Users get,post",
+		"/Users/{key} get,parameters,post,put",
+		"/Users/{key}/Admin get,parameters,post",
+		"/Users/{key}/name get,parameters,post",
+	}
+	if got, want := strings.Join(paths, "\n"), strings.Join(want, "\n"); got != want {
+		t.Errorf("paths:\n%s", diff.Diff(got, want))
+	}
+	if _, ok := doc.Components.Schemas["rest.user"].Properties["name"]; !ok {
+		t.Errorf("schemas = %+v, want rest.user with name property", doc.Components.Schemas)
+	}
+}
+
+func TestMutationLog(t *testing.T) {
+	newObj := func() *Object {
+		return NewObject(map[string]interface{}{
+			"list": []string{"a"},
+			"map":  map[string]int{},
+		})
+	}
+
+	log := new(bytes.Buffer)
+	obj := newObj()
+	obj.MutationLog = log
+	for _, req := range []struct{ method, path, body string }{
+		{"PUT", "/list", `"b"`},
+		{"POST", "/map/x", `1`},
+		{"POST", "/map/y", `2`},
+		{"POST", "/map/x", `3`},
+		{"POST", "/map/z", `"bad"`},
+	} {
+		serve(t, obj, req.method, req.path, req.body, nil)
+	}
+	if got, want := strings.Count(log.String(), "\n"), 4; got != want {
+		t.Errorf("log has %d entries, want %d:\n%s", got, want, log)
+	}
+
+	replayed := newObj()
+	if err := replayed.Replay(bytes.NewReader(log.Bytes())); err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	for _, o := range []*Object{obj, replayed} {
+		rec := serve(t, o, "GET", "/", "", nil)
+		if got, want := rec.Body.String(), `{"list":["a","b"],"map":{"x":3,"y":2}}`+"\n"; got != want {
+			t.Errorf("GET = %q, want %q", got, want)
+		}
+	}
+}
+
+// A failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, fmt.Errorf("disk full") }
+
+func TestMutationLogFailure(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	obj := NewObject(map[string]int{})
+	obj.MutationLog = failingWriter{}
+	obj.KeepLastEvent = true
+
+	// The change is committed and announced before it is logged, so the
+	// write succeeds and the failure is reported separately.
+	if rec := serve(t, obj, "POST", "/x", `1`, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("POST: code = %v, want %v (%s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if got, want := strings.TrimSpace(serve(t, obj, "GET", "/x", "", nil).Body.String()), "1"; got != want {
+		t.Errorf("after POST: GET /x = %s, want %s", got, want)
+	}
+	if rec := serve(t, obj, "GET", "/x?lastevent", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("after POST: GET /x?lastevent: code = %v, want %v", rec.Code, http.StatusOK)
+	}
+	if got, want := logged.String(), "mutation log: write /x: disk full"; !strings.Contains(got, want) {
+		t.Errorf("logged %q, want it to contain %q", got, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	obj := NewObject(map[string]interface{}{
+		"cfg": map[string]interface{}{
+			"name":  "a",
+			"ports": []int{80, 443},
+			"debug": true,
+		},
+	})
+
+	prefer := http.Header{"Prefer": {"diff"}}
+	rec := serve(t, obj, "POST", "/cfg", `{"name":"b","ports":[80],"trace":false,"debug":true}`, prefer)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("code = %v, want %v", got, want)
+	}
+	want := `[{"Op":"replace","Path":"/cfg/name","Old":"a","New":"b"},` +
+		`{"Op":"remove","Path":"/cfg/ports/1","Old":443},` +
+		`{"Op":"add","Path":"/cfg/trace","New":false}]` + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("diff mismatch:\n%s", diff.Diff(got, want))
+	}
+
+	rec = serve(t, obj, "GET", "/cfg/name", "", nil)
+	if got, want := rec.Body.String(), `"a"`+"\n"; got != want {
+		t.Errorf("after diff: GET = %q, want %q (unchanged)", got, want)
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	type host struct {
+		Name   string
+		Region string `json:"region"`
+		Port   int
+	}
+	obj := NewObject(&struct {
+		Hosts []*host
+		Names []string
+	}{
+		Hosts: []*host{
+			{"a", "us", 80},
+			{"b", "eu", 443},
+			nil,
+			{"c", "us", 80},
+			{"d", "ap", 8080},
+		},
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/Hosts?distinct=region", http.StatusOK, `["ap","eu","us"]` + "\n"},
+		{"/Hosts?distinct=Region", http.StatusOK, `["ap","eu","us"]` + "\n"},
+		{"/Hosts?distinct=Port", http.StatusOK, `[80,443,8080]` + "\n"},
+		{"/Hosts?distinct=Bogus", http.StatusBadRequest, ""},
+		{"/Names?distinct=Name", http.StatusOK, `[]` + "\n"},
+		{"/Hosts/0?distinct=Name", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("GET %q: body = %q, want %q", test.path, got, want)
+		}
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	obj := NewObject(map[string][]string{
+		"foo": {"bar"},
+	})
+
+	create := http.Header{"If-None-Match": {"*"}}
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		header http.Header
+		code   int
+	}{
+		{"POST", "/new", `["x"]`, create, http.StatusNoContent},
+		{"POST", "/new", `["y"]`, create, http.StatusPreconditionFailed},
+		{"POST", "/new", `["z"]`, nil, http.StatusNoContent},
+		{"PUT", "/foo", `"x"`, create, http.StatusPreconditionFailed},
+		{"PUT", "/other", `"x"`, create, http.StatusCreated},
+		{"PUT", "/other", `"y"`, create, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, test.header)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v", test.method, test.path, got, want)
+		}
+	}
+
+	rec := serve(t, obj, "GET", "/", "", nil)
+	if got, want := rec.Body.String(), `{"foo":["bar"],"new":["z"],"other":["x"]}`+"\n"; got != want {
+		t.Errorf("GET = %q, want %q", got, want)
+	}
+}
+
+func TestElementETags(t *testing.T) {
+	obj := NewObject(map[string][]string{
+		"items": {"a", "b"},
+	})
+
+	etags := func() map[string]string {
+		rec := serve(t, obj, "GET", "/items?etags", "", nil)
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("code = %v, want %v", got, want)
+		}
+		var tags map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &tags); err != nil {
+			t.Fatalf("unmarshal: %s", err)
+		}
+		return tags
+	}
+
+	before := etags()
+	if len(before) != 2 || before["0"] == before["1"] {
+		t.Fatalf("etags = %v, want two distinct tags", before)
+	}
+	serve(t, obj, "POST", "/items/1", `"c"`, nil)
+	serve(t, obj, "PUT", "/items", `"d"`, nil)
+	after := etags()
+	if got, want := after["0"], before["0"]; got != want {
+		t.Errorf("unchanged element: etag = %s, want %s", got, want)
+	}
+	if got, old := after["1"], before["1"]; got == old {
+		t.Errorf("changed element: etag = %s, want it to change", got)
+	}
+	if _, ok := after["2"]; !ok {
+		t.Errorf("etags = %v, want new element 2", after)
+	}
+
+	if rec := serve(t, obj, "GET", "/items/0?etags", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("leaf: code = %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	obj := NewObject(map[string]string{"foo": "bar"})
+	obj.KeepLastEvent = true
+
+	rec := serve(t, obj, "POST", "/foo", "", http.Header{"Prefer": {"touch"}})
+	if got, want := rec.Code, http.StatusNoContent; got != want {
+		t.Errorf("touch: code = %v, want %v", got, want)
+	}
+	rec = serve(t, obj, "GET", "/foo?lastevent", "", nil)
+	if got, want := rec.Body.String(), `"Type":"touch"`; !strings.Contains(got, want) {
+		t.Errorf("last event = %q, want it to contain %q", got, want)
+	}
+	rec = serve(t, obj, "GET", "/foo", "", nil)
+	if got, want := rec.Body.String(), `"bar"`+"\n"; got != want {
+		t.Errorf("after touch: GET = %q, want %q", got, want)
+	}
+}
+
+func TestBulkUpsert(t *testing.T) {
+	type acct struct {
+		ID   int `rest:"ro"`
+		Name string
+	}
+	obj := NewObject(&struct {
+		Ports map[string]int
+		Fixed map[string]int `rest:"createonly"`
+		Accts map[string]acct
+	}{
+		Ports: map[string]int{"http": 8080},
+		Fixed: map[string]int{"ssh": 22},
+		Accts: map[string]acct{"a": {1, "x"}},
+	})
+
+	tests := []struct {
+		path   string
+		body   string
+		code   int
+		output string
+	}{
+		{"/Ports", `[{"key":"http","value":80},{"key":"https","value":443}]`, http.StatusNoContent, `{"http":80,"https":443}`},
+		{"/Ports", `[{"key":"dns","value":53},{"key":"bad","value":"x"}]`, http.StatusBadRequest, `{"http":80,"https":443}`},
+		{"/Ports", `[{"value":1}]`, http.StatusBadRequest, `{"http":80,"https":443}`},
+		{"/Ports", `{"smtp":25}`, http.StatusNoContent, `{"smtp":25}`},
+		{"/Fixed", `[{"key":"ssh","value":2222}]`, http.StatusConflict, `{"ssh":22}`},
+		// Nothing is set unless everything can be.
+		{"/Fixed", `[{"key":"ftp","value":21},{"key":"ssh","value":2222}]`, http.StatusConflict, `{"ssh":22}`},
+		{"/Fixed", `[{"key":"ftp","value":21},{"key":"ftp","value":20}]`, http.StatusConflict, `{"ssh":22}`},
+		{"/Fixed", `[{"key":"ftp","value":21}]`, http.StatusNoContent, `{"ftp":21,"ssh":22}`},
+		{"/Accts", `[{"key":"a","value":{"ID":95,"Name":"y"}},{"key":"b","value":{"ID":96,"Name":"z"}}]`, http.StatusNoContent, `{"a":{"ID":1,"Name":"y"},"b":{"ID":0,"Name":"z"}}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "POST", test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("POST %s: code = %v, want %v", test.body, got, want)
+		}
+		rec = serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Body.String(), test.output+"\n"; got != want {
+			t.Errorf("after POST %s: GET = %q, want %q", test.body, got, want)
+		}
+	}
+}
+
+func TestJSONPointer(t *testing.T) {
+	obj := NewObject(map[string]interface{}{
+		"a/b": []string{"x"},
+		"m~n": "tilde",
+		"c":   map[string]string{"d": "e"},
+	})
+	pointer := http.Header{PathSchemeHeader: {JSONPointer}}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		header http.Header
+		code   int
+		output string
+	}{
+		{"GET", "/a~1b/0", "", pointer, http.StatusOK, `"x"` + "\n"},
+		{"GET", "/m~0n", "", pointer, http.StatusOK, `"tilde"` + "\n"},
+		{"GET", "/c/d", "", pointer, http.StatusOK, `"e"` + "\n"},
+		{"GET", "/m~0n", "", nil, http.StatusNotFound, "/a/b\n/c\n/m~n\n"},
+		{"GET", "/bogus", "", pointer, http.StatusNotFound, "/a~1b\n/c\n/m~0n\n"},
+		{"GET", "/m~2n", "", pointer, http.StatusBadRequest, "invalid escape in JSON Pointer token \"m~2n\"\n"},
+		{"PUT", "/a~1b", `"y"`, pointer, http.StatusCreated, "/a~1b/1\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, test.header)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v", test.method, test.path, got, want)
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("%s %q: body = %q, want %q", test.method, test.path, got, want)
+		}
+	}
+}
+
+func TestGranularEvents(t *testing.T) {
+	obj := NewObject(&struct {
+		Names map[string]string
+		Tags  []string
+		Count int
+	}{
+		Names: map[string]string{"a": "x"},
+	})
+	obj.KeepLastEvent = true
+	obj.GranularEvents = true
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		event  string
+	}{
+		{"POST", "/Names/b", `"y"`, EventCreate},
+		{"POST", "/Names/a", `"z"`, EventUpdate},
+		{"POST", "/Count", `3`, EventUpdate},
+		{"PUT", "/Tags", `"t"`, EventCreate},
+		{"POST", "/Names", `{"c":"w"}`, EventReplace},
+	}
+	for _, test := range tests {
+		if rec := serve(t, obj, test.method, test.path, test.body, nil); rec.Code >= 300 {
+			t.Fatalf("%s %q: code = %v", test.method, test.path, rec.Code)
+		}
+		rec := serve(t, obj, "GET", test.path+"?lastevent", "", nil)
+		var ev struct{ Type string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &ev); err != nil {
+			t.Fatalf("%s %q: decoding event %q: %s", test.method, test.path, rec.Body, err)
+		}
+		if got, want := ev.Type, test.event; got != want {
+			t.Errorf("%s %q: event type = %q, want %q", test.method, test.path, got, want)
+		}
+	}
+}
+
+func TestCreateFields(t *testing.T) {
+	type user struct {
+		ID      int    `json:"id"`
+		Name    string `rest:"create"`
+		Email   string `rest:"create"`
+		Created string
+	}
+	obj := NewObject(map[string]user{
+		"bob": {ID: 7, Name: "Bob", Created: "yesterday"},
+	})
+
+	tests := []struct {
+		desc   string
+		drop   bool
+		path   string
+		body   string
+		code   int
+		output string
+	}{
+		{
+			desc:   "allowed fields",
+			path:   "/bob",
+			body:   `{"Name":"Robert","Email":"bob@example.com"}`,
+			code:   http.StatusNoContent,
+			output: `{"id":7,"Name":"Robert","Email":"bob@example.com","Created":"yesterday"}`,
+		},
+		{
+			desc:   "rejected field",
+			path:   "/bob",
+			body:   `{"Name":"Bobby","id":8}`,
+			code:   http.StatusForbidden,
+			output: `{"id":7,"Name":"Robert","Email":"bob@example.com","Created":"yesterday"}`,
+		},
+		{
+			desc:   "dropped field",
+			drop:   true,
+			path:   "/bob",
+			body:   `{"Name":"Bobby","created":"today"}`,
+			code:   http.StatusNoContent,
+			output: `{"id":7,"Name":"Bobby","Email":"","Created":"yesterday"}`,
+		},
+		{
+			desc:   "new entry",
+			drop:   true,
+			path:   "/alice",
+			body:   `{"Name":"Alice","id":9}`,
+			code:   http.StatusNoContent,
+			output: `{"id":0,"Name":"Alice","Email":"","Created":""}`,
+		},
+	}
+	for _, test := range tests {
+		obj.DropRestrictedFields = test.drop
+		if rec := serve(t, obj, "POST", test.path, test.body, nil); rec.Code != test.code {
+			t.Errorf("%s: POST code = %v, want %v (%s)", test.desc, rec.Code, test.code, rec.Body)
+		}
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("%s: GET = %s, want %s", test.desc, got, want)
+		}
+	}
+
+	// The same fields are restricted when entries are written with PUT, or
+	// with a JSON-RPC set.
+	obj.DropRestrictedFields = false
+	users := NewObject(&struct {
+		Users map[string]user
+		List  []user
+	}{
+		Users: map[string]user{"a": {ID: 1, Name: "A"}},
+	})
+	for _, path := range []string{"/Users/a", "/Users/b", "/List"} {
+		rec := serve(t, users, "PUT", path, `{"Name":"y","Created":"root"}`, nil)
+		if got, want := rec.Code, http.StatusForbidden; got != want {
+			t.Errorf("PUT %q: code = %v, want %v (%s)", path, got, want, rec.Body)
+		}
+	}
+	rpc := httptest.NewRecorder()
+	users.JSONRPC().ServeHTTP(rpc, httptest.NewRequest("POST", "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"set","params":{"path":"/Users/a","value":{"id":5}},"id":1}`)))
+	if got, want := rpc.Body.String(), `"status":403`; !strings.Contains(got, want) {
+		t.Errorf("JSON-RPC set = %s, want %s", got, want)
+	}
+	rec := serve(t, users, "GET", "/", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"Users":{"a":{"id":1,"Name":"A","Email":"","Created":""}},"List":null}`; got != want {
+		t.Errorf("GET / = %s, want %s", got, want)
+	}
+}
+
+func TestNav(t *testing.T) {
+	obj := NewObject(&struct {
+		Name  string
+		Users map[string]*struct{ Age int }
+	}{
+		Users: map[string]*struct{ Age int }{
+			"alice": {30},
+			"bob":   {40},
+		},
+	})
+
+	tests := []struct {
+		path   string
+		output string
+	}{
+		{"/", `{"parent":null,"children":["/Name","/Users"],"siblings":[]}`},
+		{"/Users", `{"parent":"/","children":["/Users/alice","/Users/bob"],"siblings":["/Name"]}`},
+		{"/Users/bob", `{"parent":"/Users","children":["/Users/bob/Age"],"siblings":["/Users/alice"]}`},
+		{"/Users/bob/Age", `{"parent":"/Users/bob","children":[],"siblings":[]}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path+"?nav", "", nil)
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: nav = %s, want %s", test.path, got, want)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	type node struct {
+		Label string
+		Next  *node
+	}
+	type address struct {
+		Street string
+		Zip    *int
+	}
+	obj := NewObject(&struct {
+		Home *address `rest:"template"`
+		Work *address
+		List *node `rest:"template"`
+	}{})
+
+	tests := []struct {
+		path   string
+		output string
+	}{
+		{"/Home", `{"Street":"","Zip":0}`},
+		{"/Work", `null`},
+		{"/List", `{"Label":"","Next":null}`},
+		{"/", `{"Home":{"Street":"","Zip":0},"Work":null,"List":{"Label":"","Next":null}}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+
+	if rec := serve(t, obj, "POST", "/Home", `{"Street":"Main"}`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST: code = %v, want %v", rec.Code, http.StatusNoContent)
+	}
+	rec := serve(t, obj, "GET", "/Home", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"Street":"Main","Zip":null}`; got != want {
+		t.Errorf("GET after POST: body = %s, want %s", got, want)
+	}
+}
+
+func TestNoEscape(t *testing.T) {
+	obj := NewObject(map[string]string{"link": "<a href=\"/x?a=1&b=2\">"})
+
+	tests := []struct {
+		target string
+		output string
+	}{
+		{"/link", `"\u003ca href=\"/x?a=1\u0026b=2\"\u003e"`},
+		{"/link?noescape", `"<a href=\"/x?a=1&b=2\">"`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", nil)
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.target, got, want)
+		}
+	}
+}
+
+func TestPretty(t *testing.T) {
+	obj := NewObject(map[string][]int{"a": {1, 2}})
+
+	tests := []struct {
+		target string
+		output string
+	}{
+		{"/?pretty", "{\n  \"a\": [\n    1,\n    2\n  ]\n}\n"},
+		{"/?pretty&canonical", `{"a":[1,2]}` + "\n"},
+		{"/", `{"a":[1,2]}` + "\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", nil)
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("GET %q: body = %q, want %q", test.target, got, want)
+		}
+		if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(len(test.output)); got != want {
+			t.Errorf("GET %q: Content-Length = %s, want %s", test.target, got, want)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	type host struct {
+		Name   string
+		Region string `json:"region"`
+		Tags   []string
+	}
+	obj := NewObject(&struct {
+		Hosts []*host
+	}{
+		Hosts: []*host{
+			{Name: "b", Region: "us"},
+			nil,
+			{Name: "c", Region: "eu"},
+			{Name: "a", Region: "us"},
+		},
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/Hosts?sort=Name", http.StatusOK, `["a","b","c",null]`},
+		{"/Hosts?sort=-Name", http.StatusOK, `["c","b","a",null]`},
+		{"/Hosts?sort=region", http.StatusOK, `["c","b","a",null]`},
+		{"/Hosts?sort=-region", http.StatusOK, `["b","a","c",null]`},
+		{"/Hosts?sort=Tags", http.StatusBadRequest, ""},
+		{"/Hosts?sort=Bogus", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var hosts []*host
+		if err := json.Unmarshal(rec.Body.Bytes(), &hosts); err != nil {
+			t.Fatalf("GET %q: decoding %q: %s", test.path, rec.Body, err)
+		}
+		var names []interface{}
+		for _, h := range hosts {
+			if h == nil {
+				names = append(names, nil)
+				continue
+			}
+			names = append(names, h.Name)
+		}
+		if got, _ := json.Marshal(names); string(got) != test.output {
+			t.Errorf("GET %q: names = %s, want %s", test.path, got, test.output)
+		}
+	}
+
+	if rec := serve(t, obj, "GET", "/Hosts/0/Name", "", nil); strings.TrimSpace(rec.Body.String()) != `"b"` {
+		t.Errorf("storage was reordered: /Hosts/0/Name = %s", rec.Body)
+	}
+}
+
+func TestBigNums(t *testing.T) {
+	type record struct {
+		ID    uint64  `rest:"bignum"`
+		Score float64 `rest:"bignum=1000"`
+		Count int64
+	}
+	obj := NewObject(&struct {
+		Records []record
+		Max     *int64 `rest:"bignum"`
+	}{
+		Records: []record{
+			{ID: 1 << 60, Score: 12.5, Count: 1 << 60},
+			{ID: 42, Score: 1e6, Count: 1},
+		},
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		output string
+	}{
+		{"GET", "/Records/0", "", http.StatusOK, `{"ID":"1152921504606846976","Score":12.5,"Count":1152921504606846976}`},
+		{"GET", "/Records/1", "", http.StatusOK, `{"ID":42,"Score":"1000000","Count":1}`},
+		{"GET", "/Max", "", http.StatusOK, `null`},
+		{"POST", "/Max", `"9007199254740993"`, http.StatusNoContent, ``},
+		{"GET", "/Max", "", http.StatusOK, `"9007199254740993"`},
+		{"POST", "/Max", `5`, http.StatusNoContent, ``},
+		{"GET", "/Max", "", http.StatusOK, `5`},
+		{"PUT", "/Records", `{"ID":"18446744073709551615","Score":"2000"}`, http.StatusCreated, "/Records/2"},
+		{"GET", "/Records/2", "", http.StatusOK, `{"ID":"18446744073709551615","Score":"2000","Count":0}`},
+		{"POST", "/Records/2/ID", `"bogus"`, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v (%s)", test.method, test.path, got, want, rec.Body)
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("%s %q: body = %s, want %s", test.method, test.path, got, want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	type user struct {
+		Name    string
+		Manager string `json:"manager" rest:"ref"`
+	}
+	type task struct {
+		Title string
+		Owner string `rest:"ref"`
+	}
+	obj := NewObject(&struct {
+		Users map[string]*user
+		Tasks []task
+	}{
+		Users: map[string]*user{
+			"alice": {"Alice", "/Users/bob"},
+			"bob":   {"Bob", "/Users/alice"},
+		},
+		Tasks: []task{
+			{"write", "/Users/alice"},
+			{"review", "/Users/nobody"},
+			{"ship", ""},
+		},
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{
+			path: "/Tasks?expand=Owner",
+			code: http.StatusOK,
+			output: `[{"Title":"write","Owner":{"Name":"Alice","manager":"/Users/bob"}},` +
+				`{"Title":"review","Owner":null},{"Title":"ship","Owner":null}]`,
+		},
+		{
+			path:   "/Users/alice?expand=manager",
+			code:   http.StatusOK,
+			output: `{"Name":"Alice","manager":{"Name":"Bob","manager":"/Users/alice"}}`,
+		},
+		{path: "/Tasks?expand=Title", code: http.StatusBadRequest},
+		{path: "/Tasks?expand=Bogus", code: http.StatusBadRequest},
+		{path: "/Users?expand=manager", code: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	type profile struct {
+		Name  string
+		Email string `json:"email"`
+		Age   int
+		Tags  []string
+		Boss  *profile
+	}
+	obj := NewObject(map[string]*profile{
+		"alice": {Name: "Alice", Boss: &profile{Name: "Bob", Age: 50}},
+		"carol": {Tags: []string{""}},
+	})
+
+	tests := []struct {
+		omit   bool
+		path   string
+		output string
+	}{
+		{false, "/carol", `{"Name":"","email":"","Age":0,"Tags":[""],"Boss":null}`},
+		{true, "/carol", `{"Tags":[""]}`},
+		{true, "/alice", `{"Name":"Alice","Boss":{"Name":"Bob","Age":50}}`},
+		{true, "/", `{"alice":{"Name":"Alice","Boss":{"Name":"Bob","Age":50}},"carol":{"Tags":[""]}}`},
+		{true, "/alice/Age", `0`},
+	}
+	for _, test := range tests {
+		obj.OmitEmpty = test.omit
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q (omit=%v): body = %s, want %s", test.path, test.omit, got, want)
+		}
+	}
+}
+
+type port int
+
+func (p port) Validate() error {
+	if p <= 0 || p > 65535 {
+		return fmt.Errorf("port %d out of range", p)
+	}
+	return nil
+}
+
+type listener struct {
+	Host string
+	Port port
+}
+
+func (l *listener) Validate() error {
+	if l.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+func TestValidateOnGet(t *testing.T) {
+	obj := NewObject(&struct {
+		Listeners []*listener
+		Admin     listener
+	}{
+		Listeners: []*listener{
+			{"localhost", 80},
+			{"", 70000},
+		},
+		Admin: listener{"admin", 8080},
+	})
+
+	tests := []struct {
+		path     string
+		warnings []string
+		report   string
+	}{
+		{
+			path:     "/",
+			warnings: []string{`199 - "/Listeners/1: missing host"`, `199 - "/Listeners/1/Port: port 70000 out of range"`},
+			report:   `[{"Path":"/Listeners/1","Error":"missing host"},{"Path":"/Listeners/1/Port","Error":"port 70000 out of range"}]`,
+		},
+		{
+			path:   "/Admin",
+			report: `[]`,
+		},
+	}
+	for _, test := range tests {
+		obj.ValidateOnGet = false
+		if rec := serve(t, obj, "GET", test.path, "", nil); len(rec.HeaderMap["Warning"]) > 0 {
+			t.Errorf("GET %q: unexpected warnings %q", test.path, rec.HeaderMap["Warning"])
+		}
+
+		obj.ValidateOnGet = true
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+		}
+		if got, want := strings.Join(rec.HeaderMap["Warning"], "\n"), strings.Join(test.warnings, "\n"); got != want {
+			t.Errorf("GET %q: warnings = %q, want %q", test.path, got, want)
+		}
+
+		rec = serve(t, obj, "GET", test.path+"?validate", "", nil)
+		if got, want := strings.TrimSpace(rec.Body.String()), test.report; got != want {
+			t.Errorf("GET %q?validate: body = %s, want %s", test.path, got, want)
+		}
+	}
+}
+
+func TestItemCount(t *testing.T) {
+	obj := NewObject(&struct {
+		Names []string
+		Ages  map[string]int
+		Empty map[string]int
+		Nil   *[]int
+		Leaf  string
+	}{
+		Names: []string{"a", "b", "c"},
+		Ages:  map[string]int{"a": 1, "b": 2},
+	})
+
+	tests := []struct {
+		path  string
+		count string
+	}{
+		{"/Names", "3"},
+		{"/Ages", "2"},
+		{"/Empty", "0"},
+		{"/Nil", ""},
+		{"/Leaf", ""},
+		{"/", ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.HeaderMap.Get("X-Item-Count"), test.count; got != want {
+			t.Errorf("GET %q: X-Item-Count = %q, want %q", test.path, got, want)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	obj := NewObject(&struct {
+		Page   string `rest:"contenttype=text/html; charset=utf-8"`
+		Report []byte `rest:"contenttype=text/csv"`
+		Plain  string
+	}{
+		Page:   "<p>hi</p>",
+		Report: []byte("a,b\n1,2\n"),
+		Plain:  "hi",
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		ctype  string
+		output string
+	}{
+		{"GET", "/Page", "", http.StatusOK, "text/html; charset=utf-8", "<p>hi</p>"},
+		{"GET", "/Report", "", http.StatusOK, "text/csv", "a,b\n1,2\n"},
+		{"GET", "/Plain", "", http.StatusOK, ApplicationJSON, `"hi"` + "\n"},
+		{"POST", "/Page", "<h1>bye</h1>", http.StatusNoContent, "", ""},
+		{"GET", "/Page", "", http.StatusOK, "text/html; charset=utf-8", "<h1>bye</h1>"},
+		{"POST", "/Report", "x\n", http.StatusNoContent, "", ""},
+		{"GET", "/Report", "", http.StatusOK, "text/csv", "x\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v", test.method, test.path, got, want)
+		}
+		if got, want := rec.HeaderMap.Get("Content-Type"), test.ctype; got != want {
+			t.Errorf("%s %q: Content-Type = %q, want %q", test.method, test.path, got, want)
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("%s %q: body = %q, want %q", test.method, test.path, got, want)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	type point struct {
+		Y, X float64
+	}
+	obj := NewObject(&struct {
+		Zeta  string
+		Alpha map[string]interface{}
+		Point point
+		Tiny  float64
+		Huge  float64
+		Big   uint64
+	}{
+		Zeta:  "<z>",
+		Alpha: map[string]interface{}{"b": 1.0, "a": []int{2, 1}},
+		Point: point{Y: 1.5, X: -0.25},
+		Tiny:  1e-7,
+		Huge:  1e21,
+		Big:   1<<64 - 1,
+	})
+
+	tests := []struct {
+		target string
+		output string
+	}{
+		{
+			"/?canonical",
+			`{"Alpha":{"a":[2,1],"b":1},"Big":18446744073709551615,"Huge":1e+21,"Point":{"X":-0.25,"Y":1.5},"Tiny":1e-7,"Zeta":"\u003cz\u003e"}` + "\n",
+		},
+		{
+			"/?canonical&noescape",
+			`{"Alpha":{"a":[2,1],"b":1},"Big":18446744073709551615,"Huge":1e+21,"Point":{"X":-0.25,"Y":1.5},"Tiny":1e-7,"Zeta":"<z>"}` + "\n",
+		},
+		{"/Point?canonical", `{"X":-0.25,"Y":1.5}` + "\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", nil)
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("GET %q: body = %q, want %q", test.target, got, want)
+		}
+	}
+}
+
+func TestEnum(t *testing.T) {
+	type ticket struct {
+		Title    string
+		State    string `rest:"enum=open,closed,won't fix"`
+		Priority int    `rest:"enum=1,2,3"`
+	}
+	obj := NewObject(&struct {
+		Tickets []ticket
+		Labels  []string `rest:"enum=bug,feature"`
+		Current ticket
+	}{
+		Tickets: []ticket{{"a", "open", 1}},
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"POST", "/Current/State", `"closed"`, http.StatusNoContent},
+		{"POST", "/Current/State", `"won't fix"`, http.StatusNoContent},
+		{"POST", "/Current/State", `"reopened"`, http.StatusUnprocessableEntity},
+		{"POST", "/Current/Priority", `4`, http.StatusUnprocessableEntity},
+		{"POST", "/Current", `{"State":"open","Priority":2}`, http.StatusNoContent},
+		{"POST", "/Current", `{"State":"open","Priority":0}`, http.StatusUnprocessableEntity},
+		{"PUT", "/Tickets", `{"State":"closed","Priority":3}`, http.StatusCreated},
+		{"PUT", "/Tickets", `{"State":"new","Priority":3}`, http.StatusUnprocessableEntity},
+		{"POST", "/Tickets/0/State", `"bogus"`, http.StatusUnprocessableEntity},
+		{"PUT", "/Labels", `"bug"`, http.StatusCreated},
+		{"PUT", "/Labels", `"question"`, http.StatusUnprocessableEntity},
+		{"POST", "/Labels/0", `"feature"`, http.StatusNoContent},
+		{"POST", "/Labels/0", `"question"`, http.StatusUnprocessableEntity},
+		{"POST", "/Labels", `["feature","question"]`, http.StatusUnprocessableEntity},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q %s: code = %v, want %v (%s)", test.method, test.path, test.body, got, want, rec.Body)
+		}
+	}
+
+	rec := serve(t, obj, "GET", "/?openapi.json", "", nil)
+	var doc struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]struct {
+					Enum []interface{} `json:"enum"`
+				} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decoding OpenAPI document: %s", err)
+	}
+	props := doc.Components.Schemas["rest.ticket"].Properties
+	for field, want := range map[string]string{
+		"State":    `["open","closed","won't fix"]`,
+		"Priority": `[1,2,3]`,
+	} {
+		if got, _ := json.Marshal(props[field].Enum); string(got) != want {
+			t.Errorf("%s enum = %s, want %s", field, got, want)
+		}
+	}
+}
+
+func TestEntries(t *testing.T) {
+	type coord struct{ X, Y int }
+	obj := NewObject(&struct {
+		Names  map[string]int
+		Ports  map[int]string
+		Coords map[coord]string
+		List   []string
+	}{
+		Names:  map[string]int{"b": 2, "a": 1},
+		Ports:  map[int]string{443: "https", 80: "http", 8080: "alt"},
+		Coords: map[coord]string{{1, 2}: "a"},
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/Names?as=entries", http.StatusOK, `[{"key":"a","value":1},{"key":"b","value":2}]`},
+		{"/Ports?as=entries", http.StatusOK, `[{"key":80,"value":"http"},{"key":443,"value":"https"},{"key":8080,"value":"alt"}]`},
+		{"/Coords?as=entries", http.StatusOK, `[{"key":"{1 2}","value":"a"}]`},
+		{"/Names", http.StatusOK, `{"a":1,"b":2}`},
+		{"/List?as=entries", http.StatusBadRequest, ""},
+		{"/Names?as=bogus", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+
+	// The entries can be posted back to the map.
+	entries := serve(t, obj, "GET", "/Names?as=entries", "", nil).Body.String()
+	copied := NewObject(map[string]int{})
+	if rec := serve(t, copied, "POST", "/", entries, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST entries: code = %v, want %v (%s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if got, want := strings.TrimSpace(serve(t, copied, "GET", "/", "", nil).Body.String()), `{"a":1,"b":2}`; got != want {
+		t.Errorf("GET copy: body = %s, want %s", got, want)
+	}
+}
+
+func TestIdempotentDelete(t *testing.T) {
+	obj := NewObject(map[string]string{"a": "x"})
+
+	for _, test := range []struct {
+		idempotent bool
+		code       int
+	}{
+		{false, http.StatusNotFound},
+		{true, http.StatusNoContent},
+	} {
+		obj.IdempotentDelete = test.idempotent
+		for _, path := range []string{"/missing", "/missing/deeper"} {
+			rec := serve(t, obj, "DELETE", path, "", nil)
+			if got, want := rec.Code, test.code; got != want {
+				t.Errorf("DELETE %q (idempotent=%v): code = %v, want %v", path, test.idempotent, got, want)
+			}
+		}
+		if rec := serve(t, obj, "GET", "/missing", "", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %q (idempotent=%v): code = %v, want %v", "/missing", test.idempotent, rec.Code, http.StatusNotFound)
+		}
+	}
+
+	// The option is taken from the root when serving a subtree.
+	tree := NewObject(&struct{ Names map[string]string }{map[string]string{}})
+	tree.IdempotentDelete = true
+	if rec := serve(t, tree.child["Names"], "DELETE", "/missing", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE /missing in a subtree: code = %v, want %v", rec.Code, http.StatusNoContent)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	obj := NewObject(map[string]string{
+		"small":  "x",
+		"medium": strings.Repeat("x", 100),
+		"large":  strings.Repeat("x", 2000),
+	})
+	accept := http.Header{"Accept-Encoding": {"deflate, gzip"}}
+
+	tests := []struct {
+		desc    string
+		min     int
+		level   int
+		path    string
+		header  http.Header
+		encoded bool
+	}{
+		{"small body", 0, 0, "/small", accept, false},
+		{"large body", 0, 0, "/large", accept, true},
+		{"not accepted", 0, 0, "/large", nil, false},
+		{"refused", 0, 0, "/large", http.Header{"Accept-Encoding": {"gzip;q=0"}}, false},
+		{"lower threshold", 1, 0, "/medium", accept, true},
+		{"no smaller", 1, 0, "/small", accept, false},
+		{"wildcard", 0, 0, "/large", http.Header{"Accept-Encoding": {"*"}}, true},
+		{"refused over wildcard", 0, 0, "/large", http.Header{"Accept-Encoding": {"*;q=1, gzip;q=0"}}, false},
+		{"disabled", -1, 0, "/large", accept, false},
+		{"best speed", 0, 1, "/large", accept, true},
+		{"bad level", 0, 42, "/large", accept, false},
+	}
+	for _, test := range tests {
+		obj.CompressMinSize, obj.CompressLevel = test.min, test.level
+		rec := serve(t, obj, "GET", test.path, "", test.header)
+		if got, want := rec.HeaderMap.Get("Content-Encoding") == "gzip", test.encoded; got != want {
+			t.Errorf("%s: compressed = %v, want %v", test.desc, got, want)
+		}
+		if got, want := rec.HeaderMap.Get("Content-Length"), strconv.Itoa(rec.Body.Len()); got != want {
+			t.Errorf("%s: Content-Length = %s, want %s", test.desc, got, want)
+		}
+		body := rec.Body.String()
+		if test.encoded {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%s: %s", test.desc, err)
+			}
+			data, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("%s: %s", test.desc, err)
+			}
+			body = string(data)
+		}
+		if !strings.HasPrefix(body, `"x`) {
+			t.Errorf("%s: body = %.20q..., want a JSON string", test.desc, body)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	type config struct {
+		Name  string
+		Limit int
+	}
+	obj := NewObject(&struct {
+		Config config
+		Hosts  []string
+	}{})
+
+	if rec := serve(t, obj, "GET", "/Config/Limit?history", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("history disabled: code = %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+	obj.HistorySize = 3
+
+	writes := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/Config/Limit", `1`},
+		{"POST", "/Config/Limit", `2`},
+		{"POST", "/Config", `{"Name":"a","Limit":2}`},
+		{"POST", "/Config/Limit", `3`},
+		{"POST", "/Config/Limit", `4`},
+		{"PUT", "/Hosts", `"h0"`},
+		{"PUT", "/Hosts", `"h1"`},
+		{"POST", "/Hosts/0", `"h2"`},
+	}
+	for _, write := range writes {
+		if rec := serve(t, obj, write.method, write.path, write.body, nil); rec.Code >= 300 {
+			t.Fatalf("%s %q: code = %v (%s)", write.method, write.path, rec.Code, rec.Body)
+		}
+	}
+
+	tests := []struct {
+		path   string
+		values string
+	}{
+		{"/Config/Limit", "4 3 2"},
+		{"/Config/Name", `"a"`},
+		{"/Hosts/0", `"h2" "h0"`},
+		{"/Hosts/1", `"h1"`},
+		{"/Config", ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path+"?history", "", nil)
+		var entries []HistoryEntry
+		if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("GET %q: decoding %q: %s", test.path, rec.Body, err)
+		}
+		var values []string
+		for _, e := range entries {
+			values = append(values, string(e.Value))
+		}
+		if got, want := strings.Join(values, " "), test.values; got != want {
+			t.Errorf("GET %q: history = %s, want %s", test.path, got, want)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	type server struct {
+		Host string
+		Port int
+	}
+	old := NewObject(&struct {
+		Name    string
+		Servers map[string]*server
+		Tags    []string
+		Retired string
+	}{
+		Name: "prod",
+		Servers: map[string]*server{
+			"a": {"a.example.com", 80},
+		},
+		Tags:    []string{"x", "y"},
+		Retired: "gone",
+	})
+	buf := new(bytes.Buffer)
+	if err := old.Export(buf); err != nil {
+		t.Fatalf("Export: %s", err)
+	}
+
+	// The new schema has dropped a field, changed the type of another, and
+	// added a field to the elements of a map.
+	type serverV2 struct {
+		Host string
+		Port string
+		TLS  bool
+	}
+	obj := NewObject(&struct {
+		Name    string
+		Servers map[string]*serverV2
+		Tags    []string
+	}{
+		Servers: map[string]*serverV2{},
+	})
+	err := obj.Import(buf)
+	ierr, ok := err.(*ImportError)
+	if !ok {
+		t.Fatalf("Import: err = %v, want *ImportError", err)
+	}
+	var skipped []string
+	for _, s := range ierr.Skipped {
+		skipped = append(skipped, s[:strings.Index(s, ":")])
+	}
+	if got, want := strings.Join(skipped, " "), "/Retired /Servers/a/Port"; got != want {
+		t.Errorf("skipped = %s, want %s", got, want)
+	}
+
+	rec := serve(t, obj, "GET", "/", "", nil)
+	want := `{"Name":"prod","Servers":{"a":{"Host":"a.example.com","Port":"","TLS":false}},"Tags":["x","y"]}`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("GET after import = %s, want %s", got, want)
+	}
+}
+
+func TestJSONRPC(t *testing.T) {
+	obj := NewObject(&struct {
+		Name  string
+		Users map[string]int
+	}{
+		Name:  "test",
+		Users: map[string]int{"alice": 30},
+	})
+	srv := httptest.NewServer(obj.JSONRPC())
+	defer srv.Close()
+
+	tests := []struct {
+		desc   string
+		body   string
+		output string
+	}{
+		{
+			desc:   "get",
+			body:   `{"jsonrpc":"2.0","method":"get","params":{"path":"/Users/alice"},"id":1}`,
+			output: `{"jsonrpc":"2.0","result":30,"id":1}`,
+		},
+		{
+			desc:   "set new key",
+			body:   `{"jsonrpc":"2.0","method":"set","params":{"path":"/Users/bob","value":40},"id":"a"}`,
+			output: `{"jsonrpc":"2.0","result":null,"id":"a"}`,
+		},
+		{
+			desc:   "list",
+			body:   `{"jsonrpc":"2.0","method":"list","params":{"path":"/Users"},"id":2}`,
+			output: `{"jsonrpc":"2.0","result":["/Users/alice","/Users/bob"],"id":2}`,
+		},
+		{
+			desc:   "not found",
+			body:   `{"jsonrpc":"2.0","method":"get","params":{"path":"/Bogus"},"id":3}`,
+			output: `{"jsonrpc":"2.0","error":{"code":-32000,"message":"/Bogus not found","data":{"status":404}},"id":3}`,
+		},
+		{
+			desc:   "unknown method",
+			body:   `{"jsonrpc":"2.0","method":"frob","id":4}`,
+			output: `{"jsonrpc":"2.0","error":{"code":-32601,"message":"unknown method \"frob\""},"id":4}`,
+		},
+		{
+			desc:   "notification",
+			body:   `{"jsonrpc":"2.0","method":"set","params":{"path":"/Name","value":"notified"}}`,
+			output: ``,
+		},
+		{
+			desc: "batch",
+			body: `[{"jsonrpc":"2.0","method":"get","params":{"path":"/Name"},"id":5},` +
+				`{"jsonrpc":"2.0","method":"set","params":{"path":"/Name","value":"x"}},` +
+				`{"jsonrpc":"2.0","method":"get","params":{"path":"/Name"},"id":6}]`,
+			output: `[{"jsonrpc":"2.0","result":"notified","id":5},{"jsonrpc":"2.0","result":"x","id":6}]`,
+		},
+		{
+			desc:   "parse error",
+			body:   `{`,
+			output: `{"jsonrpc":"2.0","error":{"code":-32700,"message":"unexpected end of JSON input"},"id":null}`,
+		},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(srv.URL, ApplicationJSON, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("%s: %s", test.desc, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.desc, err)
+		}
+		if got, want := strings.TrimSpace(string(body)), test.output; got != want {
+			t.Errorf("%s: response = %s, want %s", test.desc, got, want)
+		}
+	}
+
+	// Each call is authorized as the equivalent HTTP request would be.
+	var methods []string
+	obj.Authorizer = func(r *http.Request, path, method string) error {
+		methods = append(methods, method+" "+path)
+		if path == "/Users/alice" {
+			return fmt.Errorf("private")
+		}
+		return nil
+	}
+	for _, test := range []struct {
+		body   string
+		output string
+	}{
+		{
+			body:   `{"jsonrpc":"2.0","method":"get","params":{"path":"/Users/alice"},"id":7}`,
+			output: `{"jsonrpc":"2.0","error":{"code":-32000,"message":"private","data":{"status":403}},"id":7}`,
+		},
+		{
+			body:   `{"jsonrpc":"2.0","method":"set","params":{"path":"/Users/alice","value":1},"id":8}`,
+			output: `{"jsonrpc":"2.0","error":{"code":-32000,"message":"private","data":{"status":403}},"id":8}`,
+		},
+		{
+			body:   `{"jsonrpc":"2.0","method":"delete","params":{"path":"/Users/bob"},"id":9}`,
+			output: `{"jsonrpc":"2.0","result":null,"id":9}`,
+		},
+	} {
+		resp, err := http.Post(srv.URL, ApplicationJSON, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("%s: %s", test.body, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.body, err)
+		}
+		if got, want := strings.TrimSpace(string(body)), test.output; got != want {
+			t.Errorf("with Authorizer: response = %s, want %s", got, want)
+		}
+	}
+	if got, want := strings.Join(methods, ", "), "GET /Users/alice, POST /Users/alice, DELETE /Users/bob"; got != want {
+		t.Errorf("authorized %s, want %s", got, want)
+	}
+	if got, want := strings.TrimSpace(serve(t, obj, "GET", "/Users", "", nil).Body.String()), `{"alice":30}`; got != want {
+		t.Errorf("GET /Users = %s, want %s", got, want)
+	}
+}
+
+func TestLeafChildren(t *testing.T) {
+	obj := NewObject(&struct {
+		ProtoMajor int
+		Owner      *struct{ Name string }
+		Tags       []string
+	}{
+		Tags: []string{"a"},
+	})
+
+	tests := []struct {
+		path   string
+		output string
+	}{
+		{"/ProtoMajor/extra", "/ProtoMajor is a scalar and has no children\n"},
+		{"/ProtoMajor/extra/more", "/ProtoMajor is a scalar and has no children\n"},
+		{"/Owner/Name", ""},
+		{"/Tags/0/x", "/Tags/0 is a scalar and has no children\n"},
+		{"/Bogus", "/Owner\n/ProtoMajor\n/Tags\n"},
+		{"/Tags/5", "/Tags/0\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, http.StatusNotFound; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("GET %q: body = %q, want %q", test.path, got, want)
+		}
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	obj := NewObject(map[string]string{"name": strings.Repeat("x", 100)})
+
+	tests := []struct {
+		target string
+		header http.Header
+		code   int
+	}{
+		{"/name", nil, http.StatusOK},
+		{"/name?maxbytes=200", nil, http.StatusOK},
+		{"/name?maxbytes=50", nil, http.StatusRequestEntityTooLarge},
+		{"/name", http.Header{MaxResponseBytesHeader: {"50"}}, http.StatusRequestEntityTooLarge},
+		{"/name?maxbytes=200", http.Header{MaxResponseBytesHeader: {"50"}}, http.StatusOK},
+		{"/name?maxbytes=0", nil, http.StatusBadRequest},
+		{"/name?maxbytes=lots", nil, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", test.header)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q %v: code = %v, want %v", test.target, test.header, got, want)
+		}
+	}
+}
+
+func TestChildrenSince(t *testing.T) {
+	obj := NewObject(&struct {
+		Items []string
+		Users map[string]int
+	}{
+		Items: []string{"a"},
+		Users: map[string]int{"alice": 1},
+	})
+
+	list := func(path, token string) ChildList {
+		rec := serve(t, obj, "GET", path+"?children-since="+token, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %q since %q: code = %v (%s)", path, token, rec.Code, rec.Body)
+		}
+		var list ChildList
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("GET %q since %q: decoding %q: %s", path, token, rec.Body, err)
+		}
+		return list
+	}
+
+	first := list("/Users", "")
+	if got, want := strings.Join(first.Children, " "), "/Users/alice"; got != want {
+		t.Errorf("initial listing = %q, want %q", got, want)
+	}
+
+	writes := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"PUT", "/Items", `"b"`},
+		{"POST", "/Users/bob", `2`},
+		{"POST", "/Users/alice", `3`},
+		{"PUT", "/Items", `"c"`},
+	}
+	for _, write := range writes {
+		if rec := serve(t, obj, write.method, write.path, write.body, nil); rec.Code >= 300 {
+			t.Fatalf("%s %q: code = %v (%s)", write.method, write.path, rec.Code, rec.Body)
+		}
+	}
+
+	users := list("/Users", first.Version)
+	if got, want := strings.Join(users.Children, " "), "/Users/bob"; got != want {
+		t.Errorf("users since %s = %q, want %q", first.Version, got, want)
+	}
+	if got, want := strings.Join(list("/Items", first.Version).Children, " "), "/Items/1 /Items/2"; got != want {
+		t.Errorf("items since %s = %q, want %q", first.Version, got, want)
+	}
+	if got := list("/Users", users.Version).Children; len(got) != 0 {
+		t.Errorf("users since %s = %q, want none", users.Version, got)
+	}
+	if rec := serve(t, obj, "GET", "/Users?children-since=bogus", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("bogus token: code = %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+
+	// Removing an element from the middle of a slice moves the later ones
+	// down, along with the versions at which they were added.
+	if rec := serve(t, obj, "DELETE", "/Items/1", "", nil); rec.Code >= 300 {
+		t.Fatalf("DELETE /Items/1: code = %v (%s)", rec.Code, rec.Body)
+	}
+	if got, want := strings.Join(list("/Items", first.Version).Children, " "), "/Items/1"; got != want {
+		t.Errorf("items since %s after DELETE = %q, want %q", first.Version, got, want)
+	}
+	if got := list("/Items", users.Version).Children; len(got) != 0 {
+		t.Errorf("items since %s after DELETE = %q, want none", users.Version, got)
+	}
+}
+
+func TestSize(t *testing.T) {
+	obj := NewObject(&struct {
+		Name string
+		Tags []string
+	}{
+		Name: "<x>",
+		Tags: []string{"a", "b"},
+	})
+
+	for _, path := range []string{"/", "/Name", "/Tags", "/Tags/0"} {
+		for _, query := range []string{"", "&noescape", "&canonical"} {
+			body := serve(t, obj, "GET", path+"?"+query, "", nil).Body.Len()
+			rec := serve(t, obj, "GET", path+"?size"+query, "", nil)
+			if got, want := strings.TrimSpace(rec.Body.String()), strconv.Itoa(body); got != want {
+				t.Errorf("GET %q?size%s = %s, want %s", path, query, got, want)
+			}
+		}
+	}
+}
+
+func TestMerged(t *testing.T) {
+	type limits struct {
+		CPU    *int              `json:",omitempty"`
+		Memory *int              `json:",omitempty"`
+		Labels map[string]string `json:",omitempty"`
+	}
+	two, four, eight := 2, 4, 8
+	base := NewObject(&struct {
+		Name   string
+		Limits limits
+	}{
+		Name:   "base",
+		Limits: limits{CPU: &two, Memory: &four, Labels: map[string]string{"env": "prod", "team": "a"}},
+	})
+	override := NewObject(map[string]*limits{
+		"Limits": {Memory: &eight, Labels: map[string]string{"team": "b"}},
+	})
+	obj := NewMerged(base, override)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		output string
+	}{
+		{"GET", "/", "", http.StatusOK, `{"Limits":{"CPU":2,"Labels":{"env":"prod","team":"b"},"Memory":8},"Name":"base"}`},
+		{"GET", "/Limits/Memory", "", http.StatusOK, `8`},
+		{"GET", "/Name", "", http.StatusOK, `"base"`},
+		{"GET", "/Bogus", "", http.StatusNotFound, "/Limits\n/Name"},
+		{"POST", "/Limits/CPU", "16", http.StatusNoContent, ""},
+		{"GET", "/Limits/CPU", "", http.StatusOK, `16`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v (%s)", test.method, test.path, got, want, rec.Body)
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("%s %q: body = %s, want %s", test.method, test.path, got, want)
+		}
+	}
+
+	// The write went to the last layer only.
+	if got, want := strings.TrimSpace(serve(t, base, "GET", "/Limits/CPU", "", nil).Body.String()), "2"; got != want {
+		t.Errorf("base CPU = %s, want %s", got, want)
+	}
+
+	// A layer which denies a GET denies the merged GET too.
+	base.Authorizer = func(r *http.Request, path, method string) error {
+		if strings.HasPrefix(path, "/Name") {
+			return fmt.Errorf("private")
+		}
+		return nil
+	}
+	for _, path := range []string{"/Name", "/Name/x"} {
+		if got, want := serve(t, obj, "GET", path, "", nil).Code, http.StatusForbidden; got != want {
+			t.Errorf("GET %q with Authorizer: code = %v, want %v", path, got, want)
+		}
+	}
+	if got, want := serve(t, obj, "GET", "/Limits/CPU", "", nil).Code, http.StatusOK; got != want {
+		t.Errorf("GET /Limits/CPU with Authorizer: code = %v, want %v", got, want)
+	}
+}
+
+func TestEventSequence(t *testing.T) {
+	obj := NewObject(&struct {
+		A, B string
+		List []int
+	}{})
+	obj.KeepLastEvent = true
+
+	writes := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/A", `"x"`},
+		{"POST", "/B", `"y"`},
+		{"PUT", "/List", `1`},
+		{"POST", "/A", `"z"`},
+	}
+	for i, write := range writes {
+		if rec := serve(t, obj, write.method, write.path, write.body, nil); rec.Code >= 300 {
+			t.Fatalf("%s %q: code = %v (%s)", write.method, write.path, rec.Code, rec.Body)
+		}
+		rec := serve(t, obj, "GET", write.path+"?lastevent", "", nil)
+		var ev struct{ ID string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &ev); err != nil {
+			t.Fatalf("%s %q: decoding event %q: %s", write.method, write.path, rec.Body, err)
+		}
+		if got, want := ev.ID, strconv.Itoa(i+1); got != want {
+			t.Errorf("%s %q: event ID = %q, want %q", write.method, write.path, got, want)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	type doc struct {
+		Tags  map[string]string
+		Items []string
+		Owner struct{ Name, Email string }
+	}
+	d := &doc{
+		Tags:  map[string]string{"a": "x", "b": "y"},
+		Items: []string{"zero", "one", "two", "three"},
+	}
+	d.Owner.Name, d.Owner.Email = "alice", "alice@example.com"
+	obj := NewObject(d)
+
+	tests := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"DELETE", "/Tags/a", http.StatusNoContent, ""},
+		{"GET", "/Tags", http.StatusOK, `{"b":"y"}`},
+		{"GET", "/Tags/a", http.StatusNotFound, ""},
+		{"DELETE", "/Items/1", http.StatusNoContent, ""},
+		{"GET", "/Items", http.StatusOK, `["zero","two","three"]`},
+		{"GET", "/Items/1", http.StatusOK, `"two"`},
+		{"GET", "/Items/2", http.StatusOK, `"three"`},
+		{"GET", "/Items/3", http.StatusNotFound, ""},
+		{"DELETE", "/Items/2", http.StatusNoContent, ""},
+		{"GET", "/Items", http.StatusOK, `["zero","two"]`},
+		{"DELETE", "/Owner/Name", http.StatusNoContent, ""},
+		{"GET", "/Owner", http.StatusOK, `{"Name":"","Email":"alice@example.com"}`},
+		{"DELETE", "/Owner", http.StatusNoContent, ""},
+		{"GET", "/Owner/Email", http.StatusOK, `""`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v", test.method, test.path, got, want)
+			continue
+		}
+		if test.body == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.body; got != want {
+			t.Errorf("%s %q: body = %s, want %s", test.method, test.path, got, want)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	type server struct {
+		Host string
+		Port int
+	}
+	type config struct {
+		Name   string
+		Server server
+		Labels map[string]string
+		Nested map[string]*server
+	}
+	obj := NewObject(&config{
+		Name:   "prod",
+		Server: server{"example.com", 80},
+		Labels: map[string]string{"team": "web", "tier": "1"},
+		Nested: map[string]*server{"a": {"a.example.com", 80}},
+	})
+	obj.KeepLastEvent = true
+
+	tests := []struct {
+		desc, path, body string
+		code             int
+		want             string
+	}{
+		{
+			desc: "struct field",
+			path: "/Server",
+			body: `{"Port":8080}`,
+			code: http.StatusNoContent,
+			want: `{"Name":"prod","Server":{"Host":"example.com","Port":8080},"Labels":{"team":"web","tier":"1"},"Nested":{"a":{"Host":"a.example.com","Port":80}}}`,
+		},
+		{
+			desc: "map keys",
+			path: "/Labels",
+			body: `{"tier":null,"env":"prod"}`,
+			code: http.StatusNoContent,
+			want: `{"Name":"prod","Server":{"Host":"example.com","Port":8080},"Labels":{"env":"prod","team":"web"},"Nested":{"a":{"Host":"a.example.com","Port":80}}}`,
+		},
+		{
+			desc: "nested map",
+			path: "/Nested",
+			body: `{"a":{"Port":443}}`,
+			code: http.StatusNoContent,
+			want: `{"Name":"prod","Server":{"Host":"example.com","Port":8080},"Labels":{"env":"prod","team":"web"},"Nested":{"a":{"Host":"a.example.com","Port":443}}}`,
+		},
+		{
+			desc: "root",
+			path: "/",
+			body: `{"Name":"staging","Labels":{"env":null},"Nested":{"b":{"Host":"b.example.com"}}}`,
+			code: http.StatusNoContent,
+			want: `{"Name":"staging","Server":{"Host":"example.com","Port":8080},"Labels":{"team":"web"},"Nested":{"a":{"Host":"a.example.com","Port":443},"b":{"Host":"b.example.com","Port":0}}}`,
+		},
+		{
+			desc: "unknown field",
+			path: "/Server",
+			body: `{"Nope":1}`,
+			code: http.StatusBadRequest,
+		},
+		{
+			desc: "not an object",
+			path: "/Server",
+			body: `[1]`,
+			code: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "PATCH", test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s: code = %v, want %v (%s)", test.desc, got, want, rec.Body)
+			continue
+		}
+		if test.want == "" {
+			continue
+		}
+		rec = serve(t, obj, "GET", "/", "", nil)
+		if got, want := strings.TrimSpace(rec.Body.String()), test.want; got != want {
+			t.Errorf("%s: GET = %s, want %s", test.desc, got, want)
+		}
+		rec = serve(t, obj, "GET", test.path+"?lastevent", "", nil)
+		var ev struct{ Type string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &ev); err != nil {
+			t.Fatalf("%s: decoding event %q: %s", test.desc, rec.Body, err)
+		}
+		if got, want := ev.Type, "patch"; got != want {
+			t.Errorf("%s: event type = %q, want %q", test.desc, got, want)
+		}
+	}
+
+	// The root of a map is merged in place.
+	labels := NewObject(map[string]string{"a": "1", "b": "2"})
+	if rec := serve(t, labels, "PATCH", "/", `{"a":null,"c":"3"}`, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("PATCH / of map: code = %v, want %v (%s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if got, want := strings.TrimSpace(serve(t, labels, "GET", "/", "", nil).Body.String()), `{"b":"2","c":"3"}`; got != want {
+		t.Errorf("after PATCH / of map: GET / = %s, want %s", got, want)
+	}
+	if rec := serve(t, labels, "GET", "/c", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("after PATCH / of map: GET /c: code = %v, want %v", rec.Code, http.StatusOK)
+	}
+
+	generic := NewObject(&struct {
+		Any   interface{}
+		Extra map[string]interface{}
+	}{Extra: map[string]interface{}{"keep": "x"}})
+	genericTests := []struct {
+		desc, path, body string
+		want             string
+	}{
+		{
+			desc: "nil interface",
+			path: "/Any",
+			body: `{"k":2.5,"gone":null,"sub":{"n":1,"gone":null}}`,
+			want: `{"Any":{"k":2.5,"sub":{"n":1}},"Extra":{"keep":"x"}}`,
+		},
+		{
+			desc: "interface holding a map",
+			path: "/Any",
+			body: `{"k":null,"sub":{"m":[1,2]}}`,
+			want: `{"Any":{"sub":{"m":[1,2],"n":1}},"Extra":{"keep":"x"}}`,
+		},
+		{
+			desc: "nested object in a map of interfaces",
+			path: "/Extra",
+			body: `{"keep":null,"obj":{"a":1.5,"b":null}}`,
+			want: `{"Any":{"sub":{"m":[1,2],"n":1}},"Extra":{"obj":{"a":1.5}}}`,
+		},
+	}
+	for _, test := range genericTests {
+		if rec := serve(t, generic, "PATCH", test.path, test.body, nil); rec.Code != http.StatusNoContent {
+			t.Errorf("%s: code = %v, want %v (%s)", test.desc, rec.Code, http.StatusNoContent, rec.Body)
+			continue
+		}
+		rec := serve(t, generic, "GET", "/", "", nil)
+		if got, want := strings.TrimSpace(rec.Body.String()), test.want; got != want {
+			t.Errorf("%s: GET = %s, want %s", test.desc, got, want)
+		}
+	}
+	// Numbers are stored as they would be by a POST, not as json.Numbers.
+	extra, _ := generic.child["Extra"].root.Interface().(map[string]interface{})
+	nested, _ := extra["obj"].(map[string]interface{})
+	if got, want := nested["a"], interface{}(1.5); got != want {
+		t.Errorf("after PATCH, Extra.obj.a = %#v, want %#v", got, want)
+	}
+}
+
+type xmlCodec struct{}
+
+func (xmlCodec) Encode(w io.Writer, v interface{}) error { return xml.NewEncoder(w).Encode(v) }
+func (xmlCodec) Decode(r io.Reader, v interface{}) error { return xml.NewDecoder(r).Decode(v) }
+func (xmlCodec) ContentType() string                     { return "application/xml" }
+
+func TestCodecs(t *testing.T) {
+	RegisterEncoder("application/xml", xmlCodec{})
+	RegisterDecoder("application/xml", xmlCodec{})
+
+	type point struct{ X, Y int }
+	obj := NewObject(&struct{ P point }{point{1, 2}})
+
+	tests := []struct {
+		desc   string
+		accept string
+		ctype  string
+		body   string
+	}{
+		{"no accept", "", ApplicationJSON, `{"X":1,"Y":2}` + "\n"},
+		{"xml", "application/xml", "application/xml", `<point><X>1</X><Y>2</Y></point>`},
+		{"preferred", "application/json;q=0.5, application/xml", "application/xml", `<point><X>1</X><Y>2</Y></point>`},
+		{"wildcard", "*/*", ApplicationJSON, `{"X":1,"Y":2}` + "\n"},
+		{"unknown", "text/yaml", ApplicationJSON, `{"X":1,"Y":2}` + "\n"},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.accept != "" {
+			header.Set("Accept", test.accept)
+		}
+		rec := serve(t, obj, "GET", "/P", "", header)
+		if got, want := rec.Header().Get("Content-Type"), test.ctype; got != want {
+			t.Errorf("%s: Content-Type = %q, want %q", test.desc, got, want)
+		}
+		if got, want := rec.Body.String(), test.body; got != want {
+			t.Errorf("%s: body = %q, want %q", test.desc, got, want)
+		}
+	}
+
+	header := http.Header{"Content-Type": {"application/xml"}}
+	if rec := serve(t, obj, "POST", "/P", `<point><X>3</X><Y>4</Y></point>`, header); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST xml: code = %v (%s)", rec.Code, rec.Body)
+	}
+	if got, want := serve(t, obj, "GET", "/P", "", nil).Body.String(), `{"X":3,"Y":4}`+"\n"; got != want {
+		t.Errorf("after POST: body = %q, want %q", got, want)
+	}
+}
+
+func TestJSONTagPaths(t *testing.T) {
+	obj := NewObject(&struct {
+		UserID int    `json:"user_id"`
+		Email  string `json:"email,omitempty"`
+		Secret string `json:"-"`
+		Plain  bool
+	}{UserID: 7, Secret: "s"})
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/user_id", http.StatusOK, "7\n"},
+		{"/UserID", http.StatusNotFound, ""},
+		{"/email", http.StatusOK, `""` + "\n"},
+		{"/Secret", http.StatusNotFound, ""},
+		{"/Plain", http.StatusOK, "false\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if test.body == "" {
+			continue
+		}
+		if got, want := rec.Body.String(), test.body; got != want {
+			t.Errorf("GET %q: body = %q, want %q", test.path, got, want)
+		}
+	}
+
+	rec := serve(t, obj, "GET", "/missing", "", nil)
+	for _, name := range []string{"user_id", "email", "Plain"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("404 listing %q does not include %q", rec.Body, name)
+		}
+	}
+	if strings.Contains(rec.Body.String(), "Secret") {
+		t.Errorf("404 listing %q includes %q", rec.Body, "Secret")
+	}
+}
+
+func TestFields(t *testing.T) {
+	type address struct {
+		Street string
+		City   string `json:"city"`
+	}
+	type person struct {
+		Name    string
+		Age     int
+		Address *address
+		Tags    map[string]string
+	}
+	obj := NewObject(&struct{ People []person }{[]person{
+		{"Alice", 30, &address{"1 Main St", "Springfield"}, map[string]string{"a": "x", "b": "y"}},
+		{"Bob", 40, nil, nil},
+	}})
+
+	tests := []struct {
+		target string
+		output string
+	}{
+		{"/People/0?fields=Name", `{"Name":"Alice"}`},
+		{"/People/0?fields=Name,Address.City", `{"Address":{"city":"Springfield"},"Name":"Alice"}`},
+		{"/People/0?fields=Address.city,Address", `{"Address":{"Street":"1 Main St","city":"Springfield"}}`},
+		{"/People/0?fields=Tags.b,Missing", `{"Tags":{"b":"y"}}`},
+		{"/People?fields=Name,Address.City", `[{"Address":{"city":"Springfield"},"Name":"Alice"},{"Address":null,"Name":"Bob"}]`},
+		{"/People/1?fields=", `{"Name":"Bob","Age":40,"Address":null,"Tags":null}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", nil)
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.target, got, want)
+		}
+	}
+}
+
+func TestValueEvents(t *testing.T) {
+	obj := NewObject(&struct {
+		Name string
+		List []int
+		Tags map[string]string
+	}{"a", []int{1}, map[string]string{"k": "v"}})
+	obj.KeepLastEvent = true
+	obj.ValueEvents = true
+
+	tests := []struct {
+		method, path, body string
+		event              string // the path with the last event
+		want               Change
+	}{
+		{"POST", "/Name", `"b"`, "/Name", Change{"replace", "/Name", "a", "b"}},
+		{"PUT", "/List", `2`, "/List/1", Change{"add", "/List/1", nil, 2.0}},
+		{"POST", "/Tags/new", `"x"`, "/Tags/new", Change{"add", "/Tags/new", nil, "x"}},
+	}
+	for _, test := range tests {
+		if rec := serve(t, obj, test.method, test.path, test.body, nil); rec.Code >= 300 {
+			t.Fatalf("%s %q: code = %v (%s)", test.method, test.path, rec.Code, rec.Body)
+		}
+		rec := serve(t, obj, "GET", test.event+"?lastevent", "", nil)
+		var ev struct{ Data string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &ev); err != nil {
+			t.Fatalf("%s %q: decoding event %q: %s", test.method, test.path, rec.Body, err)
+		}
+		var got Change
+		if err := json.Unmarshal([]byte(ev.Data), &got); err != nil {
+			t.Fatalf("%s %q: decoding data %q: %s", test.method, test.path, ev.Data, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q: change = %+v, want %+v", test.method, test.path, got, test.want)
+		}
+	}
+
+	// A deleted path has no last event, so check the data directly.
+	target, _ := obj.find([]string{"Tags", "k"})
+	c := target.startChange("delete", false)
+	if got, want := eventData("/Tags/k", c, reflect.Value{}, false), `{"Op":"remove","Path":"/Tags/k","Old":"v"}`; got != want {
+		t.Errorf("delete: data = %s, want %s", got, want)
+	}
+}
+
+func TestPutEntry(t *testing.T) {
+	obj := NewObject(&struct {
+		Config map[string]int
+	}{map[string]int{"a": 1}})
+
+	tests := []struct {
+		path, body string
+		code       int
+		output     string
+	}{
+		{"/Config/b", `2`, http.StatusCreated, "/Config/b\n"},
+		{"/Config/a", `10`, http.StatusNoContent, ""},
+		{"/Config/c", `"x"`, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "PUT", test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("PUT %q: code = %v, want %v (%s)", test.path, got, want, rec.Body)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("PUT %q: body = %q, want %q", test.path, got, want)
+		}
+	}
+
+	rec := serve(t, obj, "GET", "/Config", "", nil)
+	if got, want := rec.Body.String(), `{"a":10,"b":2}`+"\n"; got != want {
+		t.Errorf("GET = %q, want %q", got, want)
+	}
+	if rec := serve(t, obj, "GET", "/Config/b", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET new entry: code = %v, want %v", rec.Code, http.StatusOK)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	obj := NewObject(&struct {
+		Name string
+		List []string
+		Meta struct{ Note string }
+	}{})
+	obj.MaxBodyBytes = 16
+
+	long := `"` + strings.Repeat("x", 20) + `"`
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/Name", `"short"`, http.StatusNoContent},
+		{"POST", "/Name", long, http.StatusRequestEntityTooLarge},
+		{"PUT", "/List", `"short"`, http.StatusCreated},
+		{"PUT", "/List", long, http.StatusRequestEntityTooLarge},
+		{"PATCH", "/Meta", `{"Note":` + long + `}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q (%d bytes): code = %v, want %v", test.method, test.path, len(test.body), got, want)
+		}
+	}
+	if got, want := serve(t, obj, "GET", "/Name", "", nil).Body.String(), `"short"`+"\n"; got != want {
+		t.Errorf("GET after rejected POST = %q, want %q", got, want)
+	}
+}
+
+func TestGetETag(t *testing.T) {
+	obj := NewObject(map[string]string{"a": "x"})
+
+	rec := serve(t, obj, "GET", "/a", "", nil)
+	tag := rec.Header().Get("ETag")
+	if tag == "" {
+		t.Fatalf("GET: no ETag")
+	}
+
+	for _, inm := range []string{tag, "W/" + tag, `"other", ` + tag, "*"} {
+		rec = serve(t, obj, "GET", "/a", "", http.Header{"If-None-Match": {inm}})
+		if got, want := rec.Code, http.StatusNotModified; got != want {
+			t.Errorf("If-None-Match %s: code = %v, want %v", inm, got, want)
+		}
+		if got := rec.Body.Len(); got != 0 {
+			t.Errorf("If-None-Match %s: body has %d bytes, want none", inm, got)
+		}
+		if got, want := rec.Header().Get("Content-Type"), ApplicationJSON; got != want {
+			t.Errorf("If-None-Match %s: Content-Type = %q, want %q", inm, got, want)
+		}
+		if got, want := rec.Header().Get("Content-Length"), "0"; got != want {
+			t.Errorf("If-None-Match %s: Content-Length = %q, want %q", inm, got, want)
+		}
+	}
+
+	if rec := serve(t, obj, "POST", "/a", `"y"`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST: code = %v", rec.Code)
+	}
+	rec = serve(t, obj, "GET", "/a", "", http.Header{"If-None-Match": {tag}})
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("after change: code = %v, want %v", got, want)
+	}
+	if got := rec.Header().Get("ETag"); got == tag || got == "" {
+		t.Errorf("after change: ETag = %q, want a new tag", got)
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	obj := NewObject(map[string]map[string]string{
+		"a": {"x": "1"},
+		"b": {"y": "2"},
+	})
+	obj.modified.start = time.Now().Add(-time.Hour)
+	created := obj.modified.start.UTC().Format(http.TimeFormat)
+	since := func(ts string) http.Header { return http.Header{"If-Modified-Since": {ts}} }
+
+	rec := serve(t, obj, "GET", "/a", "", nil)
+	if got, want := rec.Header().Get("Last-Modified"), created; got != want {
+		t.Errorf("before change: Last-Modified = %q, want %q", got, want)
+	}
+	if rec := serve(t, obj, "GET", "/a", "", since(created)); rec.Code != http.StatusNotModified {
+		t.Errorf("before change: code = %v, want %v", rec.Code, http.StatusNotModified)
+	}
+
+	if rec := serve(t, obj, "POST", "/a/x", `"3"`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST: code = %v", rec.Code)
+	}
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/", http.StatusOK},
+		{"/a", http.StatusOK},
+		{"/a/x", http.StatusOK},
+		{"/b", http.StatusNotModified},
+		{"/b/y", http.StatusNotModified},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", since(created))
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q after change: code = %v, want %v", test.path, got, want)
+		}
+	}
+
+	// If-None-Match takes precedence
+	header := since(created)
+	header.Set("If-None-Match", `"stale"`)
+	if rec := serve(t, obj, "GET", "/b", "", header); rec.Code != http.StatusOK {
+		t.Errorf("with If-None-Match: code = %v, want %v", rec.Code, http.StatusOK)
+	}
+}
+
+func TestForgetRemovedPaths(t *testing.T) {
+	obj := NewObject(map[string]map[string]string{
+		"a": {"x": "1"},
+		"b": {"y": "2"},
+	})
+	obj.modified.start = time.Now().Add(-time.Hour)
+	created := obj.modified.start.UTC().Format(http.TimeFormat)
+	since := func(ts string) http.Header { return http.Header{"If-Modified-Since": {ts}} }
+
+	for i := 0; i < 100; i++ {
+		key := "/a/k" + strconv.Itoa(i)
+		if rec := serve(t, obj, "POST", key, `"v"`, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("POST %q: code = %v", key, rec.Code)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		key := "/a/k" + strconv.Itoa(i)
+		if rec := serve(t, obj, "DELETE", key, "", nil); rec.Code >= 300 {
+			t.Fatalf("DELETE %q: code = %v", key, rec.Code)
+		}
+	}
+	if got, want := len(obj.modified.root.child["a"].child), 50; got != want {
+		t.Errorf("after deletes: %d modification times below /a, want %d", got, want)
+	}
+	if got, want := len(obj.changes.added.child["a"].child), 50; got != want {
+		t.Errorf("after deletes: %d added versions below /a, want %d", got, want)
+	}
+
+	// Replacing /a forgets everything below it which no longer exists.
+	if rec := serve(t, obj, "POST", "/a", `{"k99":"w"}`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /a: code = %v", rec.Code)
+	}
+	if got := len(obj.modified.root.child["a"].child); got != 0 {
+		t.Errorf("after replace: %d modification times below /a, want none", got)
+	}
+	if got, want := len(obj.changes.added.child["a"].child), 1; got != want {
+		t.Errorf("after replace: %d added versions below /a, want %d", got, want)
+	}
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/a", http.StatusOK},
+		{"/a/k99", http.StatusOK},
+		{"/b", http.StatusNotModified},
+		{"/b/y", http.StatusNotModified},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", since(created))
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q after changes: code = %v, want %v", test.path, got, want)
+		}
+	}
+}
+
+// A cancelAfter cancels a context once it has been marshaled n times.
+type cancelAfter struct {
+	n      *int
+	cancel context.CancelFunc
+}
+
+func (c cancelAfter) MarshalJSON() ([]byte, error) {
+	if *c.n--; *c.n == 0 {
+		c.cancel()
+	}
+	return []byte("0"), nil
+}
+
+func TestCancelEncoding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const total, stop = 1000, 10
+	remaining := stop
+	items := make([]cancelAfter, total)
+	for i := range items {
+		items[i] = cancelAfter{&remaining, cancel}
+	}
+	obj := NewObject(&struct{ Items []cancelAfter }{items})
+
+	req := (&http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/Items"},
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(strings.NewReader("")),
+	}).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	obj.ServeHTTP(rec, req)
+
+	if got, want := rec.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("code = %v, want %v", got, want)
+	}
+	if encoded := stop - remaining; encoded > stop {
+		t.Errorf("encoded %d of %d items after cancelling at %d", encoded, total, stop)
+	}
+}
+
+func TestClient(t *testing.T) {
+	obj := NewObject(&struct {
+		Name   string
+		Tags   []string
+		Config map[string]int
+	}{"test", []string{"a"}, map[string]int{"x": 1}})
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+	c := NewClient(srv.URL + "/")
+
+	if err := c.Post("/Name", "renamed"); err != nil {
+		t.Errorf("Post: %s", err)
+	}
+	var name string
+	if err := c.Get("/Name", &name); err != nil {
+		t.Errorf("Get: %s", err)
+	}
+	if got, want := name, "renamed"; got != want {
+		t.Errorf("Get = %q, want %q", got, want)
+	}
+
+	if got, err := c.Put("/Tags", "b"); err != nil || got != "/Tags/1" {
+		t.Errorf("Put(slice) = %q, %v, want %q", got, err, "/Tags/1")
+	}
+	if got, err := c.Put("/Config/y", 2); err != nil || got != "/Config/y" {
+		t.Errorf("Put(new entry) = %q, %v, want %q", got, err, "/Config/y")
+	}
+	if got, err := c.Put("/Config/x", 10); err != nil || got != "/Config/x" {
+		t.Errorf("Put(replace entry) = %q, %v, want %q", got, err, "/Config/x")
+	}
+	if err := c.Delete("/Config/y"); err != nil {
+		t.Errorf("Delete: %s", err)
+	}
+	var config map[string]int
+	if err := c.Get("/Config", &config); err != nil {
+		t.Errorf("Get: %s", err)
+	}
+	if got, want := config, map[string]int{"x": 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Get = %v, want %v", got, want)
+	}
+
+	err := c.Get("/Missing", &name)
+	if cerr, ok := err.(*ClientError); !ok || cerr.Code != http.StatusNotFound {
+		t.Errorf("Get(missing) = %v, want a %d ClientError", err, http.StatusNotFound)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	obj := NewObject(&struct {
+		Public  map[string]string
+		Private map[string]string
+	}{map[string]string{"a": "x"}, map[string]string{"b": "y"}})
+
+	var seen []string
+	obj.Authorizer = func(r *http.Request, path, method string) error {
+		seen = append(seen, method+" "+path)
+		switch {
+		case r.Header.Get("Authorization") == "":
+			return ErrUnauthorized
+		case strings.HasPrefix(path, "/Private") && method != "GET":
+			return fmt.Errorf("%s is read-only", path)
+		}
+		return nil
+	}
+	auth := http.Header{"Authorization": {"yes"}}
+
+	tests := []struct {
+		method, path, body string
+		header             http.Header
+		code               int
+	}{
+		{"GET", "/Public/a", "", nil, http.StatusUnauthorized},
+		{"GET", "/Public/a", "", auth, http.StatusOK},
+		{"GET", "/Private/b", "", auth, http.StatusOK},
+		{"POST", "/Public/c", `"z"`, auth, http.StatusNoContent},
+		{"POST", "/Private/c", `"z"`, auth, http.StatusForbidden},
+		{"DELETE", "/Private/b", "", auth, http.StatusForbidden},
+		{"GET", "/Private/missing/deep", "", nil, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		seen = nil
+		rec := serve(t, obj, test.method, test.path, test.body, test.header)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v (%s)", test.method, test.path, got, want, rec.Body)
+		}
+		if got, want := seen, []string{test.method + " " + test.path}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s %q: authorized %q, want %q", test.method, test.path, got, want)
+		}
+	}
+}
+
+// A ptrMarshaler encodes itself with a pointer receiver.
+type ptrMarshaler struct{ secret string }
+
+func (p *ptrMarshaler) MarshalText() ([]byte, error) {
+	return []byte("marshaled"), nil
+}
+
+func TestMarshalerLeaves(t *testing.T) {
+	created := time.Date(2013, 7, 1, 12, 0, 0, 0, time.UTC)
+	obj := NewObject(&struct {
+		CreatedAt time.Time
+		Custom    ptrMarshaler
+		Tags      []string `rest:"pagesize=10"`
+	}{CreatedAt: created})
+
+	if got, want := len(obj.child["CreatedAt"].child), 0; got != want {
+		t.Errorf("CreatedAt has %d children, want %d", got, want)
+	}
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/CreatedAt", http.StatusOK, `"2013-07-01T12:00:00Z"` + "\n"},
+		{"/Custom", http.StatusOK, `"marshaled"` + "\n"},
+		{"/CreatedAt/wall", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("GET %q = %q, want %q", test.path, got, want)
+		}
+	}
+
+	// The pagesize option makes the whole tree custom, so this is the view.
+	rec := serve(t, obj, "GET", "/?canonical", "", nil)
+	want := `{"CreatedAt":"2013-07-01T12:00:00Z","Custom":"marshaled","Tags":null}` + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("GET view = %q, want %q", got, want)
+	}
+
+	if rec := serve(t, obj, "POST", "/CreatedAt", `"2014-01-02T03:04:05Z"`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST: code = %v, want %v (%s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	rec = serve(t, obj, "GET", "/CreatedAt", "", nil)
+	if got, want := rec.Body.String(), `"2014-01-02T03:04:05Z"`+"\n"; got != want {
+		t.Errorf("GET after POST = %q, want %q", got, want)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	obj := NewObject(&struct {
+		Name   string
+		Tags   []string
+		Config map[string]int
+		Owner  struct{ Name string }
+	}{"test", []string{"a"}, map[string]int{"x": 1}, struct{ Name string }{"bob"}})
+
+	tests := []struct {
+		path  string
+		allow string
+	}{
+		{"/", "GET, HEAD, OPTIONS"},
+		{"/Name", "GET, HEAD, POST, DELETE, OPTIONS"},
+		{"/Tags", "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+		{"/Tags/0", "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+		{"/Config", "GET, HEAD, POST, PATCH, DELETE, OPTIONS"},
+		{"/Config/x", "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+		{"/Owner", "GET, HEAD, POST, PATCH, DELETE, OPTIONS"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "OPTIONS", test.path, "", nil)
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Errorf("OPTIONS %q: code = %v, want %v", test.path, got, want)
+		}
+		if got, want := rec.Header().Get("Allow"), test.allow; got != want {
+			t.Errorf("OPTIONS %q: Allow = %q, want %q", test.path, got, want)
+		}
+	}
+
+	rec := serve(t, obj, "TRACE", "/Tags", "", nil)
+	if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("TRACE: code = %v, want %v", got, want)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET, HEAD, POST, PUT, DELETE, OPTIONS"; got != want {
+		t.Errorf("TRACE: Allow = %q, want %q", got, want)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	obj := NewObject(&struct {
+		Name string
+		Tags []string
+	}{"test", nil})
+
+	tests := []struct {
+		method, path string
+		allow        string
+	}{
+		{"PUT", "/Name", "GET, HEAD, POST, DELETE, OPTIONS"},
+		{"TRACE", "/", "GET, HEAD, OPTIONS"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, `"x"`, nil)
+		if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+			t.Errorf("%s %q: code = %v, want %v", test.method, test.path, got, want)
+		}
+		if got, want := rec.Header().Get("Allow"), test.allow; got != want {
+			t.Errorf("%s %q: Allow = %q, want %q", test.method, test.path, got, want)
+		}
+	}
+
+	// Entries can be posted to a map even at the root, and it can be
+	// emptied.
+	rec := serve(t, NewObject(map[string]int{}), "OPTIONS", "/", "", nil)
+	if got, want := rec.Header().Get("Allow"), "GET, HEAD, POST, DELETE, OPTIONS"; got != want {
+		t.Errorf("OPTIONS map root: Allow = %q, want %q", got, want)
+	}
+}
+
+func TestWindows(t *testing.T) {
+	obj := NewObject(&struct {
+		List  []int
+		Ports map[int]string
+		Name  string
+	}{
+		List:  []int{0, 1, 2, 3, 4},
+		Ports: map[int]string{443: "https", 80: "http", 8080: "alt"},
+		Name:  "test",
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/List?limit=2", http.StatusOK, `{"items":[0,1],"total":5,"next":2}`},
+		{"/List?offset=2&limit=2", http.StatusOK, `{"items":[2,3],"total":5,"next":4}`},
+		{"/List?offset=4&limit=2", http.StatusOK, `{"items":[4],"total":5,"next":null}`},
+		{"/List?offset=10", http.StatusOK, `{"items":[],"total":5,"next":null}`},
+		{"/Ports?limit=2", http.StatusOK, `{"items":{"80":"http","443":"https"},"total":3,"next":2}`},
+		{"/Ports?offset=2", http.StatusOK, `{"items":{"8080":"alt"},"total":3,"next":null}`},
+		{"/List?limit=-1", http.StatusBadRequest, ""},
+		{"/List?offset=x", http.StatusBadRequest, ""},
+		{"/Name?limit=1", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+}
+
+func TestDepth(t *testing.T) {
+	type owner struct {
+		Name string
+		Tags []string
+	}
+	obj := NewObject(&struct {
+		Name   string
+		Owner  owner
+		Groups map[string][]string
+	}{
+		Name:   "test",
+		Owner:  owner{"bob", []string{"admin"}},
+		Groups: map[string][]string{"b": {"x"}, "a": nil},
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/?depth=0", http.StatusOK, `{"Name":{"$ref":"/Name"},"Owner":{"$ref":"/Owner"},"Groups":{"$ref":"/Groups"}}`},
+		{"/?depth=1", http.StatusOK, `{"Name":"test","Owner":{"Name":{"$ref":"/Owner/Name"},"Tags":{"$ref":"/Owner/Tags"}},"Groups":{"a":{"$ref":"/Groups/a"},"b":{"$ref":"/Groups/b"}}}`},
+		{"/Owner?depth=1", http.StatusOK, `{"Name":"bob","Tags":[{"$ref":"/Owner/Tags/0"}]}`},
+		{"/Groups?depth=1", http.StatusOK, `{"a":null,"b":[{"$ref":"/Groups/b/0"}]}`},
+		{"/Name?depth=0", http.StatusOK, `"test"`},
+		{"/?depth=-1", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+}
+
+// A chain is a linked list, which can be arbitrarily deep.
+type chain struct {
+	V    int
+	Next *chain
+}
+
+func newChain(n int) *chain {
+	var c *chain
+	for i := n; i > 0; i-- {
+		c = &chain{i, c}
+	}
+	return c
+}
+
+func TestMaxDepth(t *testing.T) {
+	// Deeper than the old hard limit, but within the default.
+	if obj := NewObject(newChain(20)); obj == nil {
+		t.Fatalf("NewObject returned nil")
+	}
+
+	obj, err := NewObjectWithOptions(newChain(4), Options{MaxDepth: 2})
+	if err == nil {
+		t.Errorf("NewObjectWithOptions: no error for a chain deeper than the limit")
+	}
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/Next/V", http.StatusOK, `2`},
+		{"/Next/Next", http.StatusOK, `{"V":3,"Next":{"V":4,"Next":null}}`},
+		{"/", http.StatusOK, `{"V":1,"Next":{"V":2,"Next":{"V":3,"Next":{"V":4,"Next":null}}}}`},
+		{"/Next/Next/V", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+
+	// Writes rebuild the tree to the same depth.
+	if rec := serve(t, obj, "POST", "/Next", `{"V":20,"Next":{"V":30}}`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST: code = %v (%s)", rec.Code, rec.Body)
+	}
+	if rec := serve(t, obj, "GET", "/Next/Next/V", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET below the limit after POST: code = %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	ring := &chain{V: 1}
+	ring.Next = &chain{V: 2, Next: ring}
+	shared := &chain{V: 9}
+	m := map[string]interface{}{"name": "m"}
+	m["self"] = m
+
+	obj := NewObject(&struct {
+		Ring   *chain
+		A, B   *chain
+		Nested map[string]interface{}
+	}{ring, shared, shared, m})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/Ring", http.StatusOK, `{"V":1,"Next":{"V":2,"Next":{"$ref":"/Ring"}}}`},
+		{"/Ring/Next/Next", http.StatusOK, `{"$ref":"/Ring"}`},
+		{"/Ring/Next/Next/V", http.StatusNotFound, ""},
+		{"/B", http.StatusOK, `{"V":9,"Next":null}`},
+		{"/Nested", http.StatusOK, `{"name":"m","self":{"$ref":"/Nested"}}`},
+		{"/Nested?depth=0", http.StatusOK, `{"name":{"$ref":"/Nested/name"},"self":{"$ref":"/Nested/self"}}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+}
+
+// A stalledWriter is a ResponseWriter for a client which stops reading: its
+// Write blocks until release is closed.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	writing chan bool
+	release chan bool
+}
+
+func (s stalledWriter) Write(b []byte) (int, error) {
+	s.writing <- true
+	<-s.release
+	return s.ResponseRecorder.Write(b)
+}
+
+func TestSlowClient(t *testing.T) {
+	obj := NewObject(&struct{ List []int }{[]int{1, 2, 3}})
+
+	slow := stalledWriter{httptest.NewRecorder(), make(chan bool, 1), make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/List"},
+			Header: http.Header{},
+			Body:   ioutil.NopCloser(strings.NewReader("")),
+		}
+		obj.ServeHTTP(slow, req)
+		close(done)
+	}()
+	<-slow.writing
+
+	wrote := make(chan int, 1)
+	go func() {
+		wrote <- serve(t, obj, "PUT", "/List", "4", nil).Code
+	}()
+	select {
+	case code := <-wrote:
+		if code != http.StatusCreated {
+			t.Errorf("PUT: code = %v, want %v", code, http.StatusCreated)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("PUT blocked by a slow reader")
+	}
+	close(slow.release)
+	<-done
+}
+
+func TestStuckEventConsumer(t *testing.T) {
+	obj := NewObject(&struct{ Count int }{})
+	// Nothing ever receives from this channel.
+	stuck := make(chan esource.Event)
+	obj.ESource.Events = stuck
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			serve(t, obj, "POST", "/Count", strconv.Itoa(i), nil)
+			serve(t, obj, "GET", "/Count", "", nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("writes blocked by a stuck event consumer")
+	}
+
+	// The events are delivered, in order, once the consumer catches up.
+	for i := 0; i < 100; i++ {
+		select {
+		case ev := <-stuck:
+			if got, want := ev.Data, "/Count"; got != want {
+				t.Errorf("event %d: data = %q, want %q", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d was not delivered", i)
+		}
+	}
+}
+
+func TestEventQueueLimit(t *testing.T) {
+	obj := NewObject(&struct{ Count int }{})
+	obj.MaxQueuedEvents = 10
+	stuck := make(chan esource.Event)
+	obj.ESource.Events = stuck
+
+	for i := 0; i < 30; i++ {
+		serve(t, obj, "POST", "/Count", strconv.Itoa(i), nil)
+	}
+	if got, want := obj.DroppedEvents(), uint64(20); got != want {
+		t.Errorf("DroppedEvents() = %d, want %d", got, want)
+	}
+
+	// The queued events are delivered in order, and later ones are queued
+	// again once there is room.
+	for i := 1; i <= 10; i++ {
+		select {
+		case ev := <-stuck:
+			if got, want := ev.ID, strconv.Itoa(i); got != want {
+				t.Errorf("event %d: ID = %q, want %q", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d was not delivered", i)
+		}
+	}
+	serve(t, obj, "POST", "/Count", "30", nil)
+	select {
+	case ev := <-stuck:
+		if got, want := ev.ID, "31"; got != want {
+			t.Errorf("event after draining: ID = %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event after draining was not delivered")
+	}
+	if got, want := obj.DroppedEvents(), uint64(20); got != want {
+		t.Errorf("after draining: DroppedEvents() = %d, want %d", got, want)
+	}
+}
+
+func TestDisjointLocks(t *testing.T) {
+	type item struct {
+		Name  string
+		Count int
+	}
+	obj := NewObject(&struct {
+		A, B  item
+		Names map[string]string
+	}{Names: map[string]string{}})
+
+	// Holding a read lock on /A blocks writes to /A, but not writes to /B
+	// or other reads.
+	unlock := obj.child["A"].lockRead()
+	if rec := serve(t, obj, "POST", "/B/Count", "1", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("POST /B/Count: code = %v", rec.Code)
+	}
+	if rec := serve(t, obj, "GET", "/", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /: code = %v", rec.Code)
+	}
+	wrote := make(chan bool)
+	go func() {
+		serve(t, obj, "POST", "/A/Count", "1", nil)
+		close(wrote)
+	}()
+	select {
+	case <-wrote:
+		t.Errorf("POST /A/Count finished while /A was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-wrote
+
+	// Concurrent requests on disjoint paths (run with -race).
+	var wg sync.WaitGroup
+	for _, path := range []string{"/A", "/B"} {
+		for _, method := range []string{"GET", "POST"} {
+			path, method := path, method
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					switch method {
+					case "GET":
+						serve(t, obj, "GET", path, "", nil)
+					case "POST":
+						serve(t, obj, "POST", path+"/Count", strconv.Itoa(i), nil)
+						serve(t, obj, "POST", "/Names/"+path[1:]+strconv.Itoa(i), `"x"`, nil)
+					}
+				}
+			}()
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			serve(t, obj, "GET", "/", "", nil)
+		}
+	}()
+	wg.Wait()
+
+	rec := serve(t, obj, "GET", "/A/Count", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), "99"; got != want {
+		t.Errorf("GET /A/Count = %s, want %s", got, want)
+	}
+	if got, want := len(obj.child["Names"].child), 200; got != want {
+		t.Errorf("%d names, want %d", got, want)
+	}
+}
+
+func TestPostAppend(t *testing.T) {
+	obj := NewObject(&struct {
+		Tags []string
+		Name string
+	}{Tags: []string{"a"}})
+
+	tests := []struct {
+		path, body string
+		code       int
+		output     string
+	}{
+		{"/Tags?append", `"b"`, http.StatusCreated, "/Tags/1\n"},
+		{"/Tags?append=true", `"c"`, http.StatusCreated, "/Tags/2\n"},
+		{"/Tags?append=false", `["x","y"]`, http.StatusNoContent, ""},
+		{"/Tags?append=maybe", `"d"`, http.StatusBadRequest, ""},
+		{"/Name?append", `"d"`, http.StatusBadRequest, ""},
+		{"/Tags", `"d"`, http.StatusBadRequest, "POST replaces the whole of slice /Tags, so the body must be an array; use PUT or POST /Tags?append to append one element\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "POST", test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("POST %q: code = %v, want %v (%s)", test.path, got, want, rec.Body)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("POST %q: body = %q, want %q", test.path, got, want)
+		}
+	}
+	rec := serve(t, obj, "GET", "/Tags", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `["x","y"]`; got != want {
+		t.Errorf("GET /Tags = %s, want %s", got, want)
+	}
+
+	rec = serve(t, obj, "OPTIONS", "/Tags", "", nil)
+	if got, want := rec.Header().Get("Link"), `</Tags?openapi.json>; rel="describedby"`; got != want {
+		t.Errorf("OPTIONS: Link = %q, want %q", got, want)
+	}
+}
+
+func TestNotFoundListing(t *testing.T) {
+	obj := NewObject(map[string]int{"bar": 1, "baz": 2})
+
+	tests := []struct {
+		accept string
+		ctype  string
+		output string
+	}{
+		{"", PlainText, "/bar\n/baz\n"},
+		{"text/plain", PlainText, "/bar\n/baz\n"},
+		{"application/json", ApplicationJSON, `{"path":"/","children":["bar","baz"]}` + "\n"},
+		{"application/json, text/plain;q=0.5", ApplicationJSON, `{"path":"/","children":["bar","baz"]}` + "\n"},
+		{"application/json;q=0.5, */*", PlainText, "/bar\n/baz\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", "/qux", "", http.Header{"Accept": {test.accept}})
+		if got, want := rec.Code, http.StatusNotFound; got != want {
+			t.Errorf("Accept %q: code = %v, want %v", test.accept, got, want)
+		}
+		if got, want := rec.Header().Get("Content-Type"), test.ctype; !strings.HasPrefix(got, want) {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", test.accept, got, want)
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("Accept %q: body = %q, want %q", test.accept, got, want)
+		}
+	}
+}
+
+func TestHandleFunc(t *testing.T) {
+	cart := &struct {
+		Items []int
+		Total int
+	}{Items: []int{1, 2}}
+	obj := NewObject(cart)
+
+	obj.HandleFunc("Total", "GET", func(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+		total := 0
+		for _, item := range cart.Items {
+			total += item
+		}
+		headers.Set("Content-Type", PlainText)
+		fmt.Fprintln(w, total)
+		return http.StatusOK, nil
+	})
+	purged := false
+	obj.HandleFunc("/Items", "PURGE", func(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+		purged = true
+		return http.StatusNoContent, nil
+	})
+
+	if rec := serve(t, obj, "GET", "/Total", "", nil); rec.Body.String() != "3\n" {
+		t.Errorf("GET /Total = %d %q, want %q", rec.Code, rec.Body, "3\n")
+	}
+	serve(t, obj, "PUT", "/Items", "4", nil)
+	if rec := serve(t, obj, "GET", "/Total", "", nil); rec.Body.String() != "7\n" {
+		t.Errorf("GET /Total after PUT = %d %q, want %q", rec.Code, rec.Body, "7\n")
+	}
+
+	if rec := serve(t, obj, "PURGE", "/Items", "", nil); rec.Code != http.StatusNoContent || !purged {
+		t.Errorf("PURGE /Items: code = %v, purged = %v; want %v, true", rec.Code, purged, http.StatusNoContent)
+	}
+	if rec := serve(t, obj, "PURGE", "/Total", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PURGE /Total: code = %v, want %v", rec.Code, http.StatusMethodNotAllowed)
+	}
+	rec := serve(t, obj, "OPTIONS", "/Items", "", nil)
+	if got, want := rec.Header().Get("Allow"), "GET, HEAD, POST, PUT, DELETE, OPTIONS, PURGE"; got != want {
+		t.Errorf("OPTIONS /Items: Allow = %q, want %q", got, want)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	obj := NewObject(&struct{ Name string }{"a"})
+
+	var calls []string
+	trace := func(name string) func(MethodHandler) MethodHandler {
+		return func(next MethodHandler) MethodHandler {
+			return func(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+				calls = append(calls, name+" "+r.Method+" "+ResolvedPath(r))
+				return next(w, headers, r)
+			}
+		}
+	}
+	obj.Use(trace("outer"))
+	obj.Use(trace("inner"))
+	obj.Use(func(next MethodHandler) MethodHandler {
+		return func(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+			if r.Method == "DELETE" {
+				return http.StatusForbidden, fmt.Errorf("no deleting")
+			}
+			return next(w, headers, r)
+		}
+	})
+
+	serve(t, obj, "GET", "/Name", "", nil)
+	serve(t, obj, "POST", "/Name", `"b"`, nil)
+	if got, want := calls, []string{
+		"outer GET /Name", "inner GET /Name",
+		"outer POST /Name", "inner POST /Name",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+	if rec := serve(t, obj, "DELETE", "/Name", "", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("DELETE: code = %v, want %v", rec.Code, http.StatusForbidden)
+	}
+	if rec := serve(t, obj, "GET", "/Name", "", nil); strings.TrimSpace(rec.Body.String()) != `"b"` {
+		t.Errorf("GET after DELETE = %s, want %q", rec.Body, "b")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	obj := NewObject(&struct{ Name string }{"a"})
+	var entries []LogEntry
+	obj.Logger = func(e LogEntry) {
+		e.Duration, e.RequestID = 0, "" // these vary
+		entries = append(entries, e)
+	}
+
+	serve(t, obj, "GET", "/Name", "", nil)
+	serve(t, obj, "POST", "/Name", `"bob"`, nil)
+	serve(t, obj, "GET", "/Missing/Child", "", nil)
+	serve(t, obj, "BREW", "/", "", nil)
+
+	want := []LogEntry{
+		{Method: "GET", Path: "/Name", Found: true, Dispatched: "GET", Code: http.StatusOK, Bytes: 4},
+		{Method: "POST", Path: "/Name", Found: true, Dispatched: "POST", Code: http.StatusNoContent},
+		{Method: "GET", Path: "/Missing/Child", Code: http.StatusNotFound, Bytes: 6},
+		{Method: "BREW", Path: "/", Found: true, Dispatched: "BREW", Code: http.StatusMethodNotAllowed, Bytes: 17},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries:\n%+v\nwant:\n%+v", entries, want)
+	}
+}
+
+type requestCounter map[string]int
+
+func (c requestCounter) ObserveRequest(method, path string, code int, dur time.Duration) {
+	c[fmt.Sprintf("%s %s %d", method, path, code)]++
+}
+
+func TestMetrics(t *testing.T) {
+	obj := NewObject(&struct {
+		Users map[string]string
+		Count int
+	}{Users: map[string]string{"bob": "Bob"}})
+	counts := requestCounter{}
+	obj.Metrics = counts
+
+	serve(t, obj, "GET", "/Users/bob", "", nil)
+	serve(t, obj, "GET", "/Users/alice", "", nil)
+	serve(t, obj, "POST", "/Users/alice", `"Alice"`, nil)
+	serve(t, obj, "GET", "/Users/alice", "", nil)
+	serve(t, obj, "GET", "/Count", "", nil)
+	serve(t, obj, "GET", "/", "", nil)
+	// Paths which don't exist are observed as one, however many there are.
+	serve(t, obj, "GET", "/Bogus", "", nil)
+	serve(t, obj, "POST", "/Bogus2/x", `1`, nil)
+
+	want := requestCounter{
+		"GET /Users 200":     2,
+		"GET /Users 404":     1,
+		"POST /Users 204":    1,
+		"GET /Count 200":     1,
+		"GET / 200":          1,
+		"GET <unknown> 404":  1,
+		"POST <unknown> 404": 1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
+
+func TestValidateOnWrite(t *testing.T) {
+	obj := NewObject(&struct {
+		Listeners []*listener
+		Admin     listener
+		Ports     map[string]port
+	}{Ports: map[string]port{}})
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		output             string
+	}{
+		{"POST", "/Admin", `{"Host":"admin","Port":80}`, http.StatusNoContent, ""},
+		{"POST", "/Admin", `{"Port":80}`, http.StatusBadRequest, "missing host\n"},
+		{"PATCH", "/Admin", `{"Host":""}`, http.StatusBadRequest, "missing host\n"},
+		{"PUT", "/Listeners", `{"Host":"a","Port":1}`, http.StatusCreated, "/Listeners/0\n"},
+		{"PUT", "/Listeners", `{"Port":1}`, http.StatusBadRequest, "missing host\n"},
+		{"POST", "/Ports/http", `80`, http.StatusNoContent, ""},
+		{"PUT", "/Ports/bad", `70000`, http.StatusBadRequest, "port 70000 out of range\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v (%s)", test.method, test.path, got, want, rec.Body)
+			continue
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("%s %q: body = %q, want %q", test.method, test.path, got, want)
+		}
+	}
+	rec := serve(t, obj, "GET", "/", "", nil)
+	want := `{"Listeners":[{"Host":"a","Port":1}],"Admin":{"Host":"admin","Port":80},"Ports":{"http":80}}`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("GET / = %s, want %s", got, want)
+	}
+}
+
+func TestStrictDecode(t *testing.T) {
+	obj := NewObject(&struct {
+		Admin     listener
+		Listeners []listener
+		ByName    map[string]listener
+	}{ByName: map[string]listener{}})
+
+	tests := []struct {
+		method, path, body string
+		strict             bool
+		code               int
+	}{
+		{"POST", "/Admin", `{"Host":"a","Prot":80}`, false, http.StatusNoContent},
+		{"POST", "/Admin", `{"Host":"a","Prot":80}`, true, http.StatusBadRequest},
+		{"POST", "/Admin?strict", `{"Host":"a","Prot":80}`, false, http.StatusBadRequest},
+		{"POST", "/Admin?strict", `{"Host":"a","Port":80}`, false, http.StatusNoContent},
+		{"PUT", "/Listeners", `{"Host":"a","Prot":80}`, true, http.StatusBadRequest},
+		{"PUT", "/Listeners", `{"Host":"a","Port":80}`, true, http.StatusCreated},
+		{"PUT", "/ByName/a", `{"Host":"a","Prot":80}`, true, http.StatusBadRequest},
+		{"POST", "/ByName", `[{"Key":"a","Value":{"Host":"a","Prot":80}}]`, true, http.StatusBadRequest},
+		{"POST", "/ByName", `[{"Key":"a","Value":{"Host":"a","Prot":80}}]`, false, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		obj.StrictDecode = test.strict
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q %s (strict=%v): code = %v, want %v (%s)", test.method, test.path, test.body, test.strict, got, want, rec.Body)
+		}
+	}
+}
+
+type Timestamps struct {
+	Created string
+	Updated string
+}
+
+type Owner struct {
+	Name    string
+	Updated string `json:"Updated"`
+}
+
+type labels struct {
+	Label string
+}
+
+func TestEmbeddedFields(t *testing.T) {
+	type doc struct {
+		Timestamps
+		*Owner
+		labels
+		Meta  Timestamps `json:"meta"`
+		Title string
+		Name  string
+	}
+	obj := NewObject(&struct {
+		Doc    doc
+		NilPtr struct{ *Owner }
+	}{
+		Doc: doc{
+			Timestamps: Timestamps{"mon", "tue"},
+			Owner:      &Owner{"bob", "wed"},
+			labels:     labels{"red"},
+			Meta:       Timestamps{"thu", "fri"},
+			Title:      "a",
+			Name:       "b",
+		},
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/Doc/Created", http.StatusOK, `"mon"`},
+		{"/Doc/Updated", http.StatusOK, `"wed"`}, // the tagged field wins
+		{"/Doc/Name", http.StatusOK, `"b"`},      // the shallower field wins
+		{"/Doc/Label", http.StatusOK, `"red"`},
+		{"/Doc/meta/Created", http.StatusOK, `"thu"`},
+		{"/Doc/Timestamps", http.StatusNotFound, ""},
+		{"/Doc/Owner", http.StatusNotFound, ""},
+		{"/NilPtr/Name", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+
+	if rec := serve(t, obj, "POST", "/Doc/Label", `"blue"`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /Doc/Label: code = %v (%s)", rec.Code, rec.Body)
+	}
+	if rec := serve(t, obj, "POST", "/Doc/Updated", `"sat"`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /Doc/Updated: code = %v (%s)", rec.Code, rec.Body)
+	}
+	want := `{"Created":"mon","Updated":"sat","Label":"blue","meta":{"Created":"thu","Updated":"fri"},"Title":"a","Name":"b"}`
+	for _, query := range []string{"", "?omitempty"} {
+		obj.OmitEmpty = query != ""
+		rec := serve(t, obj, "GET", "/Doc", "", nil)
+		if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Errorf("GET /Doc (OmitEmpty=%v) = %s, want %s", obj.OmitEmpty, got, want)
+		}
+	}
+	obj.OmitEmpty = false
+}
+
+func TestPostNilPointer(t *testing.T) {
+	type address struct{ City, Zip string }
+	obj := NewObject(&struct {
+		Addr *address
+	}{})
+	obj.KeepLastEvent = true
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		output             string
+	}{
+		{"GET", "/Addr", "", http.StatusOK, "null"},
+		{"GET", "/Addr/City", "", http.StatusNotFound, ""},
+		{"POST", "/Addr", `{"City":"x"}`, http.StatusNoContent, ""},
+		{"GET", "/Addr?lastevent", "", http.StatusOK, `{"ID":"1","Type":"post","Data":"/Addr"}`},
+		{"GET", "/Addr/City", "", http.StatusOK, `"x"`},
+		{"POST", "/Addr/Zip", `"9"`, http.StatusNoContent, ""},
+		{"GET", "/", "", http.StatusOK, `{"Addr":{"City":"x","Zip":"9"}}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v (%s)", test.method, test.path, got, want, rec.Body)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("%s %q: body = %s, want %s", test.method, test.path, got, want)
+		}
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	type user struct {
+		Name string
+		Tags []string
+	}
+	data := &struct {
+		Users map[string]*user
+		Count int
+	}{Users: map[string]*user{"bob": {Name: "Bob"}}}
+	obj := NewObject(data)
+
+	get := func(path string) string {
+		rec := serve(t, obj, "GET", path, "", nil)
+		return fmt.Sprintf("%d %s", rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+
+	data.Users["bob"].Tags = []string{"admin"}
+	data.Users["alice"] = &user{Name: "Alice"}
+	data.Count = 2
+	if got, want := get("/Users/bob/Tags/0"), "404 "; !strings.HasPrefix(got, want) {
+		t.Errorf("before rebuild: GET /Users/bob/Tags/0 = %q, want prefix %q", got, want)
+	}
+
+	obj.RebuildPath("/Users/bob/Tags")
+	if got, want := get("/Users/bob/Tags/0"), `200 "admin"`; got != want {
+		t.Errorf("after RebuildPath(Tags): GET /Users/bob/Tags/0 = %q, want %q", got, want)
+	}
+	if got, want := get("/Users/alice"), "404 "; !strings.HasPrefix(got, want) {
+		t.Errorf("after RebuildPath(Tags): GET /Users/alice = %q, want prefix %q", got, want)
+	}
+
+	// A new key is found by rebuilding its parent map.
+	obj.RebuildPath("/Users/alice/Name")
+	if got, want := get("/Users/alice/Name"), `200 "Alice"`; got != want {
+		t.Errorf("after RebuildPath(alice): GET /Users/alice/Name = %q, want %q", got, want)
+	}
+
+	delete(data.Users, "bob")
+	obj.Rebuild()
+	if got, want := get("/"), `200 {"Users":{"alice":{"Name":"Alice","Tags":null}},"Count":2}`; got != want {
+		t.Errorf("after Rebuild: GET / = %q, want %q", got, want)
+	}
+	if got, want := get("/Users/bob"), "404 "; !strings.HasPrefix(got, want) {
+		t.Errorf("after Rebuild: GET /Users/bob = %q, want prefix %q", got, want)
+	}
+}
+
+// countingLocker is a sync.RWMutex which counts how it is locked.
+type countingLocker struct {
+	sync.RWMutex
+	locks, rlocks int
+}
+
+func (l *countingLocker) Lock()  { l.RWMutex.Lock(); l.locks++ }
+func (l *countingLocker) RLock() { l.RWMutex.RLock(); l.rlocks++ }
+
+func TestLocker(t *testing.T) {
+	data := &struct {
+		Names []string
+	}{}
+	obj := NewObject(data)
+	l := new(countingLocker)
+	obj.Locker = l
+
+	serve(t, obj, "GET", "/Names", "", nil)
+	serve(t, obj, "PUT", "/Names", `"a"`, nil)
+	// Each request also holds it for reading while its path is resolved.
+	if l.locks != 1 || l.rlocks != 3 {
+		t.Errorf("after GET and PUT: locks = %d, rlocks = %d; want 1, 3", l.locks, l.rlocks)
+	}
+
+	// The program changes the value under the lock, and rebuilds the tree
+	// while it still holds it.
+	l.Lock()
+	data.Names = append(data.Names, "b")
+	obj.Rebuild()
+	l.Unlock()
+
+	rec := serve(t, obj, "GET", "/Names/1", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `"b"`; got != want {
+		t.Errorf("GET /Names/1 = %s, want %s", got, want)
+	}
+}
+
+func TestSyntheticConcurrentWrites(t *testing.T) {
+	type item struct{ Count int }
+	obj := NewObject(&struct {
+		List []item
+	}{List: []item{{0}, {0}, {0}}})
+
+	// Pages and ranges are copied while elements are written (run with
+	// -race).
+	var wg sync.WaitGroup
+	for _, path := range []string{"/List/page/1", "/List/0:2", "/List/-1"} {
+		path := path
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				serve(t, obj, "GET", path, "", nil)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		serve(t, obj, "POST", "/List/"+strconv.Itoa(i%3)+"/Count", strconv.Itoa(i), nil)
+		serve(t, obj, "PUT", "/List/"+strconv.Itoa(i%3), `{"Count":1}`, nil)
+	}
+	wg.Wait()
+
+	rec := serve(t, obj, "GET", "/List/0:3", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `[{"Count":1},{"Count":1},{"Count":1}]`; got != want {
+		t.Errorf("GET /List/0:3 = %s, want %s", got, want)
+	}
+}
+
+func TestJSONP(t *testing.T) {
+	obj := NewObject(&struct {
+		Name string
+		Page string `rest:"contenttype=text/html"`
+	}{"bob", "<p>"})
+
+	tests := []struct {
+		path   string
+		enable bool
+		code   int
+		ctype  string
+		output string
+	}{
+		{"/Name?callback=show", false, http.StatusOK, ApplicationJSON, `"bob"` + "\n"},
+		{"/Name?callback=show", true, http.StatusOK, ApplicationJavaScript, `/**/show("bob");` + "\n"},
+		{"/Name?callback=app.cb_1", true, http.StatusOK, ApplicationJavaScript, `/**/app.cb_1("bob");` + "\n"},
+		{"/Name?callback=alert(1)//", true, http.StatusBadRequest, "text/plain; charset=utf-8", ""},
+		{"/Name?callback=1abc", true, http.StatusBadRequest, "text/plain; charset=utf-8", ""},
+		{"/Page?callback=show", true, http.StatusOK, "text/html", "<p>"},
+	}
+	for _, test := range tests {
+		obj.EnableJSONP = test.enable
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if got, want := rec.Header().Get("Content-Type"), test.ctype; got != want {
+			t.Errorf("GET %q: Content-Type = %q, want %q", test.path, got, want)
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := rec.Body.String(), test.output; got != want {
+			t.Errorf("GET %q: body = %q, want %q", test.path, got, want)
+		}
+	}
+}
+
+func TestIndexRanges(t *testing.T) {
+	obj := NewObject(&struct {
+		Items []string
+		Fixed [3]int
+	}{Items: []string{"a", "b", "c", "d"}, Fixed: [3]int{1, 2, 3}})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/Items/-1", http.StatusOK, `"d"`},
+		{"/Items/-4", http.StatusOK, `"a"`},
+		{"/Items/-5", http.StatusNotFound, "/Items/0\n/Items/1\n/Items/2\n/Items/3"},
+		{"/Items/1:3", http.StatusOK, `["b","c"]`},
+		{"/Items/:2", http.StatusOK, `["a","b"]`},
+		{"/Items/2:", http.StatusOK, `["c","d"]`},
+		{"/Items/-2:", http.StatusOK, `["c","d"]`},
+		{"/Items/:", http.StatusOK, `["a","b","c","d"]`},
+		{"/Items/2:2", http.StatusOK, `[]`},
+		{"/Items/3:1", http.StatusNotFound, ""},
+		{"/Items/0:5", http.StatusNotFound, ""},
+		{"/Items/a:b", http.StatusNotFound, ""},
+		{"/Fixed/-1", http.StatusOK, `3`},
+		{"/Fixed/0:2", http.StatusOK, `[1,2]`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v", test.path, got, want)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+
+	// Negative indices name the elements themselves, so they can be set.
+	if rec := serve(t, obj, "POST", "/Items/-1", `"z"`, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("POST /Items/-1: code = %v (%s)", rec.Code, rec.Body)
+	}
+	rec := serve(t, obj, "GET", "/Items/3", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `"z"`; got != want {
+		t.Errorf("GET /Items/3 after POST = %s, want %s", got, want)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	type account struct {
+		ID    string `rest:"ro"`
+		Name  string
+		Roles map[string]bool `rest:"ro"`
+	}
+	obj := NewObject(&struct {
+		Account account
+	}{account{"42", "bob", map[string]bool{"admin": true}}})
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		allow              string
+	}{
+		{"GET", "/Account/ID", "", http.StatusOK, ""},
+		{"POST", "/Account/ID", `"43"`, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"DELETE", "/Account/ID", "", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"POST", "/Account/Roles/root", `true`, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"PATCH", "/Account/Roles", `{"root":true}`, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"OPTIONS", "/Account/ID", "", http.StatusNoContent, "GET, HEAD, OPTIONS"},
+		{"POST", "/Account/Name", `"alice"`, http.StatusNoContent, ""},
+		// Writing the struct leaves the read-only fields as they were.
+		{"POST", "/Account", `{"ID":"43","Name":"carol","Roles":{}}`, http.StatusNoContent, ""},
+		{"PATCH", "/Account", `{"ID":"44","Name":"dave"}`, http.StatusNoContent, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v (%s)", test.method, test.path, got, want, rec.Body)
+			continue
+		}
+		if got, want := rec.Header().Get("Allow"), test.allow; got != want {
+			t.Errorf("%s %q: Allow = %q, want %q", test.method, test.path, got, want)
+		}
+	}
+	rec := serve(t, obj, "GET", "/Account", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"ID":"42","Name":"dave","Roles":{"admin":true}}`; got != want {
+		t.Errorf("GET /Account = %s, want %s", got, want)
+	}
+
+	// Read-only fields keep their values however deeply they are written.
+	type acct struct {
+		ID   int `rest:"ro"`
+		Name string
+	}
+	obj = NewObject(&struct {
+		List  []acct
+		Accts map[string]acct
+		Outer struct{ Inner acct }
+	}{
+		List:  []acct{{1, "a"}},
+		Accts: map[string]acct{"a": {2, "b"}},
+	})
+	writes := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PUT", "/Accts/a", `{"ID":99,"Name":"x"}`, http.StatusNoContent},
+		{"PUT", "/Accts/b", `{"ID":97,"Name":"y"}`, http.StatusCreated},
+		{"PUT", "/List/0", `{"ID":98,"Name":"z"}`, http.StatusNoContent},
+		{"PUT", "/List", `{"ID":96,"Name":"w"}`, http.StatusCreated},
+		{"POST", "/Outer", `{"Inner":{"ID":95,"Name":"v"}}`, http.StatusNoContent},
+		{"POST", "/Accts/a", `{"ID":94,"Name":"u"}`, http.StatusNoContent},
+		{"POST", "/Accts", `{"a":{"ID":93,"Name":"t"},"b":{"ID":92,"Name":"y"}}`, http.StatusNoContent},
+		{"POST", "/List", `[{"ID":91,"Name":"z"},{"ID":90,"Name":"w"}]`, http.StatusNoContent},
+	}
+	for _, test := range writes {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v (%s)", test.method, test.path, got, want, rec.Body)
+		}
+	}
+	rec = serve(t, obj, "GET", "/", "", nil)
+	want := `{"List":[{"ID":1,"Name":"z"},{"ID":0,"Name":"w"}],"Accts":{"a":{"ID":2,"Name":"t"},"b":{"ID":0,"Name":"y"}},"Outer":{"Inner":{"ID":0,"Name":"v"}}}`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("GET / = %s, want %s", got, want)
+	}
+}
+
+func TestWriteOnly(t *testing.T) {
+	type login struct {
+		User     string
+		Password string `rest:"wo"`
+	}
+	obj := NewObject(&struct {
+		Logins []login
+		Admin  login
+	}{Logins: []login{{"bob", "hunter2"}}, Admin: login{"root", "toor"}})
+	obj.KeepLastEvent = true
+	obj.ValueEvents = true
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		output             string
+	}{
+		{"GET", "/", "", http.StatusOK, `{"Logins":[{"User":"bob"}],"Admin":{"User":"root"}}`},
+		{"GET", "/Admin", "", http.StatusOK, `{"User":"root"}`},
+		{"GET", "/Admin?fields=User,Password", "", http.StatusOK, `{"User":"root"}`},
+		{"GET", "/Admin/Password", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/Admin/Missing", "", http.StatusNotFound, "/Admin/User"},
+		{"POST", "/Admin/Password", `"secret"`, http.StatusNoContent, ""},
+		{"GET", "/Admin/Password?lastevent", "", http.StatusMethodNotAllowed, ""},
+		{"PUT", "/Logins", `{"User":"eve","Password":"pw"}`, http.StatusCreated, "/Logins/1"},
+		{"GET", "/Logins/1?lastevent", "", http.StatusOK, `{"ID":"2","Type":"put","Data":"{\"Op\":\"add\",\"Path\":\"/Logins/1\",\"New\":{\"User\":\"eve\"}}"}`},
+		{"OPTIONS", "/Admin/Password", "", http.StatusNoContent, ""},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.path, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %q: code = %v, want %v (%s)", test.method, test.path, got, want, rec.Body)
+			continue
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("%s %q: body = %s, want %s", test.method, test.path, got, want)
+		}
+	}
+	if got, want := serve(t, obj, "OPTIONS", "/Admin/Password", "", nil).Header().Get("Allow"), "POST, DELETE, OPTIONS"; got != want {
+		t.Errorf("OPTIONS /Admin/Password: Allow = %q, want %q", got, want)
+	}
+	// The event for the write-only value leaves the values out.
+	if got, want := obj.last.event["/Admin/Password"].Data, `{"Op":"replace","Path":"/Admin/Password"}`; got != want {
+		t.Errorf("event data for /Admin/Password = %s, want %s", got, want)
+	}
+}
+
+func TestWriteOnlyReadPaths(t *testing.T) {
+	type acct struct {
+		ID     int
+		Secret string `rest:"wo"`
+	}
+	obj := NewObject(&struct {
+		One   acct
+		List  []acct
+		Accts map[string]acct
+	}{
+		One:   acct{1, "pw1"},
+		List:  []acct{{2, "pw2"}, {3, "pw3"}},
+		Accts: map[string]acct{"a": {4, "pw4"}},
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/List?distinct=Secret", http.StatusMethodNotAllowed, ""},
+		{"/List?sort=Secret", http.StatusMethodNotAllowed, ""},
+		{"/List?distinct=ID", http.StatusOK, `[2,3]`},
+		{"/?depth=3", http.StatusOK, `{"One":{"ID":1},"List":[{"ID":2},{"ID":3}],"Accts":{"a":{"ID":4}}}`},
+		{"/List/page/1", http.StatusOK, `[{"ID":2},{"ID":3}]`},
+		{"/List/0:1", http.StatusOK, `[{"ID":2}]`},
+		{"/List/0:1/0/Secret", http.StatusMethodNotAllowed, ""},
+		{"/?fields=One", http.StatusOK, `{"One":{"ID":1}}`},
+		{"/?fields=List", http.StatusOK, `{"List":[{"ID":2},{"ID":3}]}`},
+		{"/?fields=Accts", http.StatusOK, `{"Accts":{"a":{"ID":4}}}`},
+		{"/List?offset=1", http.StatusOK, `{"items":[{"ID":3}],"total":2,"next":null}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %q: code = %v, want %v (%s)", test.path, got, want, rec.Body)
+			continue
+		}
+		if strings.Contains(rec.Body.String(), "pw") {
+			t.Errorf("GET %q: body %s contains a write-only value", test.path, rec.Body)
+		}
+		if test.output == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.output; got != want {
+			t.Errorf("GET %q: body = %s, want %s", test.path, got, want)
+		}
+	}
+
+	merged := NewMerged(NewObject(&struct{ One acct }{acct{5, "pw5"}}), obj)
+	for _, test := range []struct {
+		path string
+		code int
+	}{
+		{"/One", http.StatusOK},
+		{"/One/Secret", http.StatusMethodNotAllowed},
+	} {
+		rec := serve(t, merged, "GET", test.path, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("merged GET %q: code = %v, want %v (%s)", test.path, got, want, rec.Body)
+		}
+		if strings.Contains(rec.Body.String(), "pw") {
+			t.Errorf("merged GET %q: body %s contains a write-only value", test.path, rec.Body)
+		}
+	}
+}
+
+func TestBulkGet(t *testing.T) {
+	obj := NewObject(&struct {
+		Name   string
+		Stats  map[string]int
+		Secret string `rest:"wo"`
+	}{"bob", map[string]int{"a": 1, "b": 2}, "x"})
+
+	rec := serve(t, obj, "GET", "/?paths=Name,Stats/b,/Stats/c,Secret", "", nil)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("code = %v, want %v (%s)", got, want, rec.Body)
+	}
+	want := `{"values":{"/Name":"bob","/Stats/b":2},"errors":{"/Secret":"/Secret is write-only","/Stats/c":"/Stats/c not found"}}`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+
+	rec = serve(t, obj, "GET", "/Stats?paths=a,b", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"values":{"/Stats/a":1,"/Stats/b":2}}`; got != want {
+		t.Errorf("GET /Stats?paths=a,b = %s, want %s", got, want)
+	}
+
+	obj.Authorizer = func(r *http.Request, path, method string) error {
+		if path == "/Name" {
+			return fmt.Errorf("private")
+		}
+		return nil
+	}
+	rec = serve(t, obj, "GET", "/?paths=Name,Stats/a", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"values":{"/Stats/a":1},"errors":{"/Name":"private"}}`; got != want {
+		t.Errorf("with Authorizer: body = %s, want %s", got, want)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	type record struct {
+		ID   int
+		Name string
+	}
+	obj := NewObject(&struct {
+		Records []record
+		Empty   []record
+		Name    string
+	}{Records: []record{{1, "a"}, {2, "b"}, {3, "c"}}, Name: "x"})
+	ndjson := http.Header{"Accept": {ApplicationNDJSON}}
+
+	rec := serve(t, obj, "GET", "/Records", "", ndjson)
+	if got, want := rec.Header().Get("Content-Type"), ApplicationNDJSON; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	if !rec.Flushed {
+		t.Errorf("response was not flushed")
+	}
+	want := `{"ID":1,"Name":"a"}` + "\n" + `{"ID":2,"Name":"b"}` + "\n" + `{"ID":3,"Name":"c"}` + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		desc, target string
+		header       http.Header
+		ctype, body  string
+	}{
+		{"empty", "/Empty", ndjson, ApplicationNDJSON, ""},
+		{"not a slice", "/Name", ndjson, ApplicationJSON, `"x"`},
+		{"query options", "/Records?fields=ID", ndjson, ApplicationJSON, `[{"ID":1},{"ID":2},{"ID":3}]`},
+		{"prefers JSON", "/Records/0", http.Header{"Accept": {"application/json, application/x-ndjson;q=0.5"}}, ApplicationJSON, `{"ID":1,"Name":"a"}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", test.header)
+		if got := rec.Header().Get("Content-Type"); got != test.ctype {
+			t.Errorf("%s: Content-Type = %q, want %q", test.desc, got, test.ctype)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != test.body {
+			t.Errorf("%s: body = %q, want %q", test.desc, got, test.body)
+		}
+	}
+
+	// Streams are dispatched through the middleware, which can refuse them.
+	var seen []string
+	obj.Use(func(next MethodHandler) MethodHandler {
+		return func(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+			seen = append(seen, ResolvedPath(r))
+			if ResolvedPath(r) == "/Empty" {
+				return http.StatusForbidden, fmt.Errorf("private")
+			}
+			headers.Set("X-Seen", "yes")
+			return next(w, headers, r)
+		}
+	})
+	rec = serve(t, obj, "GET", "/Records", "", ndjson)
+	if got, want := rec.Header().Get("X-Seen"), "yes"; got != want {
+		t.Errorf("with middleware: X-Seen = %q, want %q", got, want)
+	}
+	if got, want := strings.Count(rec.Body.String(), "\n"), 3; got != want {
+		t.Errorf("with middleware: %d lines, want %d", got, want)
+	}
+	if got, want := serve(t, obj, "GET", "/Empty", "", ndjson).Code, http.StatusForbidden; got != want {
+		t.Errorf("refused by middleware: code = %v, want %v", got, want)
+	}
+	if got, want := strings.Join(seen, ","), "/Records,/Empty"; got != want {
+		t.Errorf("middleware saw %s, want %s", got, want)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	stream := ": hello\n\n" +
+		"event: update\ndata: /Items/a\n\n" +
+		"event: update\ndata: /Itemsx\n\n" +
+		`data: {"Op":"replace","Path":"/Items/b/c","New":1}` + "\n\n" +
+		`data: {"Op":"replace","Path":"/Other","New":1}` + "\n\n" +
+		"event: touch\ndata: /Items\n\n" +
+		"retry: 10"
+
+	rec := httptest.NewRecorder()
+	ef := &eventFilter{ResponseWriter: rec, prefix: "/Items"}
+	// Write a byte at a time, since events may be split across writes.
+	for i := range stream {
+		ef.Write([]byte{stream[i]})
+	}
+	ef.flushPartial()
+
+	want := ": hello\n\n" +
+		"event: update\ndata: /Items/a\n\n" +
+		`data: {"Op":"replace","Path":"/Items/b/c","New":1}` + "\n\n" +
+		"event: touch\ndata: /Items\n\n" +
+		"retry: 10"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("filtered stream = %q, want %q", got, want)
+	}
+}
+
+func TestEventsPath(t *testing.T) {
+	obj := NewObject(map[string]string{"_events": "data"})
+
+	rec := serve(t, obj, "GET", "/_events", "", nil)
+	if got, want := strings.TrimSpace(rec.Body.String()), `"data"`; got != want {
+		t.Errorf("without EventsPath: GET /_events = %q, want %q", got, want)
+	}
+
+	obj.EventsPath = "_events"
+	var authorized []string
+	obj.Authorizer = func(r *http.Request, path, method string) error {
+		authorized = append(authorized, method+" "+path)
+		return nil
+	}
+	rec = serve(t, obj, "GET", "/_events", "", nil)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("GET /_events: code = %v, want %v", got, want)
+	}
+	if strings.Contains(rec.Body.String(), "data") {
+		t.Errorf("GET /_events served the value: %q", rec.Body)
+	}
+	rec = serve(t, obj, "POST", "/_events", `"x"`, nil)
+	if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("POST /_events: code = %v, want %v", got, want)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET"; got != want {
+		t.Errorf("POST /_events: Allow = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(authorized, ","), "GET /_events,POST /_events"; got != want {
+		t.Errorf("authorized %q, want %q", got, want)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	obj := NewObject(map[string]*struct{ N int }{"a": {1}})
+
+	tag := serve(t, obj, "GET", "/a", "", nil).Header().Get("ETag")
+	if tag == "" {
+		t.Fatalf("GET /a has no ETag")
+	}
+	match := func(tag string) http.Header { return http.Header{"If-Match": {tag}} }
+
+	tests := []struct {
+		desc, method, target, body string
+		header                     http.Header
+		code                       int
+	}{
+		{"stale", "POST", "/a", `{"N":2}`, match(`"stale"`), http.StatusPreconditionFailed},
+		{"current", "POST", "/a", `{"N":2}`, match(tag), http.StatusNoContent},
+		{"after update", "POST", "/a", `{"N":3}`, match(tag), http.StatusPreconditionFailed},
+		{"one of several", "POST", "/a/N", `4`, match(`"x", *`), http.StatusNoContent},
+		{"star on missing", "POST", "/b", `{"N":1}`, match("*"), http.StatusPreconditionFailed},
+		{"put stale", "PUT", "/c", `{"N":1}`, match(`"stale"`), http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.target, test.body, test.header)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s: %s %s: code = %v, want %v (%s)", test.desc, test.method, test.target, got, want, rec.Body)
+		}
+	}
+	if got, want := strings.TrimSpace(serve(t, obj, "GET", "/", "", nil).Body.String()), `{"a":{"N":4}}`; got != want {
+		t.Errorf("final value = %s, want %s", got, want)
+	}
+
+	// The tag compared is the ETag of the same GET, however it is encoded,
+	// and weak tags never match.
+	doc := NewObject(&struct {
+		Page string `rest:"contenttype=text/html"`
+		Info map[string]int
+	}{"<p>", map[string]int{"x": 1}})
+	for _, test := range []struct {
+		desc, path, query, body string
+		weak                    bool
+		code                    int
+	}{
+		{"weak", "/Info", "", `{"x":2}`, true, http.StatusPreconditionFailed},
+		{"content type", "/Page", "", `<p>new</p>`, false, http.StatusNoContent},
+		{"pretty", "/Info", "?pretty", `{"x":3}`, false, http.StatusNoContent},
+	} {
+		tag := serve(t, doc, "GET", test.path+test.query, "", nil).Header().Get("ETag")
+		if test.weak {
+			tag = "W/" + tag
+		}
+		rec := serve(t, doc, "POST", test.path+test.query, test.body, match(tag))
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s: POST %s: code = %v, want %v (%s)", test.desc, test.path, got, want, rec.Body)
+		}
+	}
+	var tags map[string]string
+	if err := json.Unmarshal(serve(t, doc, "GET", "/Info?etags", "", nil).Body.Bytes(), &tags); err != nil {
+		t.Fatalf("GET /Info?etags: %s", err)
+	}
+	if got, want := tags["x"], serve(t, doc, "GET", "/Info/x", "", nil).Header().Get("ETag"); got != want {
+		t.Errorf("GET /Info?etags: tag of x = %s, want the ETag of /Info/x, %s", got, want)
+	}
+}
+
+func TestPutElement(t *testing.T) {
+	obj := NewObject(&struct {
+		Items  []string
+		Nested [][]int
+	}{Items: []string{"a", "b"}, Nested: [][]int{{1}}})
+
+	tests := []struct {
+		method, target, body string
+		code                 int
+		resp                 string
+	}{
+		{"PUT", "/Items/1", `"c"`, http.StatusNoContent, ""},
+		{"PUT", "/Items/1", `"c"`, http.StatusNoContent, ""},
+		{"PUT", "/Items", `"d"`, http.StatusCreated, "/Items/2"},
+		{"PUT", "/Items/-1", `"e"`, http.StatusNoContent, ""},
+		{"PUT", "/Items/5", `"f"`, http.StatusNotFound, ""},
+		{"PUT", "/Items/0", `1`, http.StatusBadRequest, ""},
+		{"PUT", "/Nested/0", `2`, http.StatusCreated, "/Nested/0/1"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.target, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %s: code = %v, want %v (%s)", test.method, test.target, got, want, rec.Body)
+			continue
+		}
+		if test.resp == "" {
+			continue
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.resp; got != want {
+			t.Errorf("%s %s = %q, want %q", test.method, test.target, got, want)
+		}
+	}
+	want := `{"Items":["a","c","e"],"Nested":[[1,2]]}`
+	if got := strings.TrimSpace(serve(t, obj, "GET", "/", "", nil).Body.String()); got != want {
+		t.Errorf("final value = %s, want %s", got, want)
+	}
+
+	rec := serve(t, obj, "OPTIONS", "/Items/0", "", nil)
+	if got, want := rec.Header().Get("Allow"), "PUT"; !strings.Contains(got, want) {
+		t.Errorf("OPTIONS /Items/0: Allow = %q, want it to include %q", got, want)
+	}
+}
+
+func TestHead(t *testing.T) {
+	obj := NewObject(&struct {
+		Name  string
+		Items []int
+	}{"bob", []int{1, 2, 3}})
+
+	get := serve(t, obj, "GET", "/Name", "", nil)
+	rec := serve(t, obj, "HEAD", "/Name", "", nil)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("HEAD /Name: code = %v, want %v", got, want)
+	}
+	if got := rec.Body.Len(); got != 0 {
+		t.Errorf("HEAD /Name: body has %d bytes, want none", got)
+	}
+	for _, h := range []string{"Content-Length", "Content-Type", "ETag"} {
+		if got, want := rec.Header().Get(h), get.Header().Get(h); got != want {
+			t.Errorf("HEAD /Name: %s = %q, want %q", h, got, want)
+		}
+	}
+
+	rec = serve(t, obj, "HEAD", "/Items", "", nil)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("HEAD /Items: code = %v, want %v", got, want)
+	}
+	for _, h := range []string{"Content-Length", "ETag"} {
+		if got := rec.Header().Get(h); got != "" {
+			t.Errorf("HEAD /Items: %s = %q, want none", h, got)
+		}
+	}
+	if got, want := rec.Header().Get("Content-Type"), ApplicationJSON; got != want {
+		t.Errorf("HEAD /Items: Content-Type = %q, want %q", got, want)
+	}
+
+	obj.HeadComputesLength = true
+	get = serve(t, obj, "GET", "/Items", "", nil)
+	rec = serve(t, obj, "HEAD", "/Items", "", nil)
+	if got := rec.Body.Len(); got != 0 {
+		t.Errorf("HeadComputesLength: body has %d bytes, want none", got)
+	}
+	for _, h := range []string{"Content-Length", "ETag"} {
+		if got, want := rec.Header().Get(h), get.Header().Get(h); got == "" || got != want {
+			t.Errorf("HeadComputesLength: %s = %q, want %q", h, got, want)
+		}
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	obj := NewObject(&struct {
+		Runs map[string]int
+		Log  []string
+	}{
+		Runs: map[string]int{"9": 9, "10": 10, "1": 1, "last": 0},
+		Log:  make([]string, 11),
+	})
+
+	lexical := `{"1":1,"10":10,"9":9,"last":0}`
+	if got := strings.TrimSpace(serve(t, obj, "GET", "/Runs", "", nil).Body.String()); got != lexical {
+		t.Errorf("without KeyOrder: GET /Runs = %s, want %s", got, lexical)
+	}
+
+	obj.KeyOrder = NumericKeyOrder
+	tests := []struct {
+		target string
+		header http.Header
+		want   string
+	}{
+		{"/Runs", nil, `{"1":1,"9":9,"10":10,"last":0}`},
+		{"/Runs?pretty", nil, "{\n  \"1\": 1,\n  \"9\": 9,\n  \"10\": 10,\n  \"last\": 0\n}"},
+		{"/Runs?limit=2&offset=1", nil, `"items":{"9":9,"10":10}`},
+		{"/Runs/missing/x", nil, "/Runs/1\n/Runs/9\n/Runs/10\n/Runs/last"},
+		{"/Log/x", nil, "/Log/0\n/Log/1\n/Log/2"},
+	}
+	for _, test := range tests {
+		got := strings.TrimSpace(serve(t, obj, "GET", test.target, "", test.header).Body.String())
+		if !strings.Contains(got, test.want) {
+			t.Errorf("GET %s = %q, want it to contain %q", test.target, got, test.want)
+		}
+	}
+}
+
+func TestNotFoundListingOrder(t *testing.T) {
+	obj := NewObject(&struct {
+		List  []int
+		Names map[string]int
+	}{make([]int, 12), map[string]int{"10": 0, "9": 0, "b": 0}})
+
+	tests := []struct {
+		target, want string
+	}{
+		{"/List/x", "/List/0\n/List/1\n/List/2\n/List/3\n/List/4\n/List/5\n/List/6\n/List/7\n/List/8\n/List/9\n/List/10\n/List/11\n"},
+		{"/Names/x", "/Names/10\n/Names/9\n/Names/b\n"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", nil)
+		if got, want := rec.Code, http.StatusNotFound; got != want {
+			t.Errorf("GET %s: code = %v, want %v", test.target, got, want)
+		}
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("GET %s = %q, want %q", test.target, got, test.want)
+		}
+	}
+}
+
+func TestDeleteContainer(t *testing.T) {
+	obj := NewObject(&struct {
+		Items []int
+		Names map[string]int
+		Fixed [2]int
+	}{[]int{1, 2, 3}, map[string]int{"a": 1, "b": 2}, [2]int{1, 2}})
+	obj.KeepLastEvent = true
+
+	for _, path := range []string{"/Items", "/Names"} {
+		if rec := serve(t, obj, "DELETE", path, "", nil); rec.Code != http.StatusNoContent {
+			t.Errorf("DELETE %s: code = %v, want %v (%s)", path, rec.Code, http.StatusNoContent, rec.Body)
+		}
+		if ev := obj.last.event[path]; ev.Type != "delete" || ev.Data != path {
+			t.Errorf("DELETE %s: last event = %+v, want a delete of %s", path, ev, path)
+		}
+	}
+	for _, path := range []string{"/Items/0", "/Names/a"} {
+		if rec := serve(t, obj, "GET", path, "", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: code = %v, want %v", path, rec.Code, http.StatusNotFound)
+		}
+	}
+	want := `{"Items":[],"Names":{},"Fixed":[1,2]}`
+	if got := strings.TrimSpace(serve(t, obj, "GET", "/", "", nil).Body.String()); got != want {
+		t.Errorf("after DELETE: GET / = %s, want %s", got, want)
+	}
+
+	root := NewObject(map[string]int{"a": 1})
+	if rec := serve(t, root, "DELETE", "/", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE / of map: code = %v, want %v (%s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if got, want := strings.TrimSpace(serve(t, root, "GET", "/", "", nil).Body.String()), `{}`; got != want {
+		t.Errorf("after DELETE /: GET / = %s, want %s", got, want)
+	}
+}
+
+// A panicky value panics when it is marshaled.
+type panicky struct{}
+
+func (panicky) MarshalJSON() ([]byte, error) { panic("broken marshaler") }
+
+func TestEncodeErrors(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	obj := NewObject(&struct {
+		Broken panicky
+		NaN    float64
+	}{NaN: math.NaN()})
+
+	tests := []struct {
+		target string
+		code   int
+		msg    string
+	}{
+		{"/Broken?canonical", http.StatusInternalServerError, "encode rest.panicky: broken marshaler"},
+		{"/NaN?canonical", http.StatusInternalServerError, "encode float64: json: unsupported value: NaN"},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %s: code = %v, want %v", test.target, got, want)
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.msg; got != want {
+			t.Errorf("GET %s = %q, want %q", test.target, got, want)
+		}
+	}
+	if got, want := logged.String(), "rest: panic encoding rest.panicky: broken marshaler"; !strings.Contains(got, want) {
+		t.Errorf("log = %q, want it to contain %q", got, want)
+	}
+}
+
+type tracedCounter map[string]string
+
+func (tracedCounter) ObserveRequest(method, path string, code int, dur time.Duration) {}
+
+func (c tracedCounter) ObserveTracedRequest(id, method, path string, code int, dur time.Duration) {
+	c[method+" "+path] = id
+}
+
+func TestRequestID(t *testing.T) {
+	obj := NewObject(&struct{ Name string }{"a"})
+	var logged, handled string
+	obj.Logger = func(e LogEntry) { logged = e.RequestID }
+	metrics := tracedCounter{}
+	obj.Metrics = metrics
+	obj.Use(func(next MethodHandler) MethodHandler {
+		return func(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+			handled = RequestID(r)
+			return next(w, headers, r)
+		}
+	})
+
+	header := http.Header{}
+	header.Set(RequestIDHeader, "abc")
+	rec := serve(t, obj, "GET", "/Name", "", header)
+	if got, want := rec.Header().Get(RequestIDHeader), "abc"; got != want {
+		t.Errorf("echoed ID = %q, want %q", got, want)
+	}
+	for desc, got := range map[string]string{"logged": logged, "handled": handled, "observed": metrics["GET /Name"]} {
+		if got != "abc" {
+			t.Errorf("%s ID = %q, want %q", desc, got, "abc")
+		}
+	}
+
+	rec = serve(t, obj, "GET", "/Missing", "", nil)
+	id := rec.Header().Get(RequestIDHeader)
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		t.Errorf("generated ID = %q, want 32 hex digits", id)
+	}
+	if logged != id {
+		t.Errorf("logged ID = %q, want %q", logged, id)
+	}
+	if other := serve(t, obj, "GET", "/Name", "", nil).Header().Get(RequestIDHeader); other == id {
+		t.Errorf("generated the same ID %q twice", id)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	rt := NewRouter()
+	rt.Add("users", NewObject(map[string]string{"bob": "admin"}))
+	rt.Add("config", NewObject(&struct{ Debug bool }{true}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", rt.Handler("/api"))
+
+	tests := []struct {
+		method, target string
+		header         http.Header
+		code           int
+		body           string
+	}{
+		{"GET", "/api/users/bob", nil, http.StatusOK, `"admin"`},
+		{"GET", "/api/config", nil, http.StatusOK, `{"Debug":true}`},
+		{"POST", "/api/config/Debug", nil, http.StatusNoContent, ""},
+		{"GET", "/api/config/Debug", nil, http.StatusOK, `false`},
+		{"GET", "/api/", nil, http.StatusOK, "/config\n/users"},
+		{"GET", "/api/", http.Header{"Accept": {"application/json"}}, http.StatusOK, `{"path":"/","children":["config","users"]}`},
+		{"GET", "/api/missing/x", nil, http.StatusNotFound, "/config\n/users"},
+		{"DELETE", "/api/", nil, http.StatusMethodNotAllowed, "DELETE not allowed"},
+	}
+	for _, test := range tests {
+		body := ""
+		if test.method == "POST" {
+			body = "false"
+		}
+		req := httptest.NewRequest(test.method, test.target, strings.NewReader(body))
+		for k, v := range test.header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %s: code = %v, want %v", test.method, test.target, got, want)
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), test.body; got != want {
+			t.Errorf("%s %s = %q, want %q", test.method, test.target, got, want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	// Two servers for different objects at the same path don't conflict.
+	for _, name := range []string{"a", "b"} {
+		mux := http.NewServeMux()
+		mux.Handle("/api/", Handler("/api/", NewObject(&struct{ Name string }{name})))
+
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/Name", nil))
+		if got, want := strings.TrimSpace(rec.Body.String()), strconv.Quote(name); got != want {
+			t.Errorf("GET /api/Name = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestHiddenFieldsNotSelectable(t *testing.T) {
+	type item struct {
+		Name     string `json:"name"`
+		Internal string `json:"-"`
+	}
+	obj := NewObject(&struct{ Items []item }{[]item{{"b", "hidden1"}, {"a", "hidden2"}}})
+
+	tests := []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/Items?distinct=Internal", http.StatusBadRequest, ""},
+		{"/Items?sort=Internal", http.StatusBadRequest, ""},
+		{"/Items?fields=Internal", http.StatusOK, `[{},{}]`},
+		{"/Items?distinct=name", http.StatusOK, `["a","b"]`},
+		{"/Items?distinct=Name", http.StatusOK, `["a","b"]`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, "GET", test.target, "", nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("GET %s: code = %v, want %v", test.target, got, want)
+		}
+		if strings.Contains(rec.Body.String(), "hidden") {
+			t.Errorf("GET %s = %s, which has a hidden value", test.target, rec.Body)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); test.body != "" && got != test.body {
+			t.Errorf("GET %s = %s, want %s", test.target, got, test.body)
+		}
+	}
+}
+
+func TestEmbeddedFieldsByName(t *testing.T) {
+	type rec struct {
+		*Timestamps
+		labels
+		ID int
+	}
+	shared := &Timestamps{Created: "c1", Updated: "u1"}
+	obj := NewObject(&struct{ Recs []rec }{[]rec{
+		{shared, labels{"b"}, 1},
+		{&Timestamps{Created: "c0"}, labels{"a"}, 2},
+		{nil, labels{"a"}, 3},
+	}})
+
+	tests := []struct {
+		method, target, body string
+		code                 int
+		want                 string
+	}{
+		{"GET", "/Recs?distinct=Label", "", http.StatusOK, `["a","b"]`},
+		{"GET", "/Recs?sort=Created", "", http.StatusOK, `[{"Created":"c0","Updated":"","Label":"a","ID":2},{"Created":"c1","Updated":"u1","Label":"b","ID":1},{"Label":"a","ID":3}]`},
+		{"GET", "/Recs?fields=Label,Created", "", http.StatusOK, `[{"Created":"c1","Label":"b"},{"Created":"c0","Label":"a"},{"Label":"a"}]`},
+		{"PATCH", "/Recs/0", `{"Updated":"u2","Label":"c"}`, http.StatusNoContent, ""},
+		{"PATCH", "/Recs/2", `{"Created":"c2"}`, http.StatusNoContent, ""},
+		{"GET", "/Recs/0", "", http.StatusOK, `{"Created":"c1","Updated":"u2","Label":"c","ID":1}`},
+		{"GET", "/Recs/2", "", http.StatusOK, `{"Created":"c2","Updated":"","Label":"a","ID":3}`},
+	}
+	for _, test := range tests {
+		rec := serve(t, obj, test.method, test.target, test.body, nil)
+		if got, want := rec.Code, test.code; got != want {
+			t.Errorf("%s %s: code = %v, want %v (%s)", test.method, test.target, got, want, rec.Body)
+			continue
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != test.want {
+			t.Errorf("%s %s = %s, want %s", test.method, test.target, got, test.want)
+		}
+	}
+	// The patch replaced the embedded struct rather than changing it.
+	if shared.Updated != "u1" {
+		t.Errorf("PATCH changed the original embedded struct: Updated = %q", shared.Updated)
+	}
+}
+
+func TestPatchFieldsAndNumbers(t *testing.T) {
+	type record struct {
+		Big      int64
+		Ratio    float64
+		Internal string `json:"-"`
+	}
+	val := &record{Internal: "secret"}
+	obj := NewObject(&struct{ Rec *record }{val})
+
+	if rec := serve(t, obj, "PATCH", "/Rec", `{"Big":9007199254740993,"Ratio":0.1}`, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: code = %v, want %v (%s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if got, want := strings.TrimSpace(serve(t, obj, "GET", "/Rec", "", nil).Body.String()), `{"Big":9007199254740993,"Ratio":0.1}`; got != want {
+		t.Errorf("after PATCH: GET /Rec = %s, want %s", got, want)
+	}
+
+	if rec := serve(t, obj, "PATCH", "/Rec", `{"Internal":"x"}`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("PATCH of a json:\"-\" field: code = %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+	if got := indirect(obj.child["Rec"].root).Interface().(record).Internal; got != "secret" {
+		t.Errorf("after PATCH, Internal = %q, want %q", got, "secret")
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// readOnly returns true if obj or one of its ancestors is tagged `rest:"ro"`.
+func (obj *Object) readOnly() bool {
+	for p := obj; p != nil; p = p.parent {
+		if p.opts.readOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWritable returns 405 Method Not Allowed, and sets the Allow header in
+// headers, if method would write to obj but obj is read-only.  Methods with
+// overrides registered with HandleFunc are allowed regardless.
+func (obj *Object) checkWritable(headers http.Header, method string) (int, error) {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return 0, nil
+	}
+	if !obj.readOnly() || obj.handlerFor(method) != nil {
+		return 0, nil
+	}
+	if headers != nil {
+		defer obj.lockRead()()
+		headers.Set("Allow", strings.Join(obj.allowedMethods(), ", "))
+	}
+	return http.StatusMethodNotAllowed, &statusError{http.StatusMethodNotAllowed, fmt.Sprintf("%s is read-only", obj.path)}
+}
+
+// writeOnly returns true if obj or one of its ancestors is tagged
+// `rest:"wo"`.
+func (obj *Object) writeOnly() bool {
+	for p := obj; p != nil; p = p.parent {
+		if p.opts.writeOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReadable is like checkWritable, but for methods which would read obj
+// when obj is write-only.
+func (obj *Object) checkReadable(headers http.Header, method string) (int, error) {
+	switch method {
+	case "GET", "HEAD":
+	default:
+		return 0, nil
+	}
+	if !obj.writeOnly() || obj.handlerFor(method) != nil {
+		return 0, nil
+	}
+	if headers != nil {
+		defer obj.lockRead()()
+		headers.Set("Allow", strings.Join(obj.allowedMethods(), ", "))
+	}
+	return http.StatusMethodNotAllowed, &statusError{http.StatusMethodNotAllowed, fmt.Sprintf("%s is write-only", obj.path)}
+}
+
+// hasWriteOnly returns true if values of type typ may hold fields tagged
+// `rest:"wo"`.  Interfaces may hold anything.
+func hasWriteOnly(typ reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[typ] {
+		return false
+	}
+	seen[typ] = true
+	switch typ.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return hasWriteOnly(typ.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if opts, _ := parseTag(field.Tag.Get("rest")); opts.writeOnly {
+				return true
+			}
+			if hasWriteOnly(field.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// visibleValue returns v as it would be encoded for a GET, without any
+// write-only fields.
+func visibleValue(v reflect.Value) interface{} {
+	if !hasWriteOnly(v.Type(), map[reflect.Type]bool{}) {
+		return v.Interface()
+	}
+	return newObject([]string{""}, v, nil, nil, tagOptions{}).viewData()
+}
+
+// creatable returns the indices of the fields of the struct type typ which
+// are tagged `rest:"create"`, or nil if none of them are.
+func creatable(typ reflect.Type) map[int]bool {
+	var fields map[int]bool
+	for i := 0; i < typ.NumField(); i++ {
+		opts, err := parseTag(typ.Field(i).Tag.Get("rest"))
+		if err != nil || !opts.create {
+			continue
+		}
+		if fields == nil {
+			fields = map[int]bool{}
+		}
+		fields[i] = true
+	}
+	return fields
+}
+
+// restrictFields enforces the `rest:"create"` and `rest:"ro"` tags on the
+// fields of the structs in v, which has been decoded from data to replace
+// the value held by obj.  If any field of a struct is tagged create, only the
+// tagged fields can be set by a client; the others keep their current value
+// (or are zero if there is no current value).  Setting one of them
+// explicitly is an error unless DropRestrictedFields is set.
+//
+// Fields tagged `rest:"ro"` always keep their current value.  Structs in
+// fields, elements, and map entries of v are restricted in the same way,
+// compared with the field, element, or entry they replace.
+func (obj *Object) restrictFields(data []byte, v reflect.Value) error {
+	if !restricted(v.Type(), map[reflect.Type]bool{}) {
+		return nil
+	}
+	return restrict(data, v, obj.root, obj.top().DropRestrictedFields)
+}
+
+// restricted returns true if values of type typ may hold structs with
+// fields tagged `rest:"create"` or `rest:"ro"`.
+func restricted(typ reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[typ] {
+		return false
+	}
+	seen[typ] = true
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return restricted(typ.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if opts, _ := parseTag(field.Tag.Get("rest")); opts.create || opts.readOnly {
+				return true
+			}
+			if restricted(field.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restrict implements restrictFields for the value v decoded from data
+// (which may be nil if it is not known), which replaces cur (which may be
+// invalid if nothing is replaced).
+func restrict(data []byte, v, cur reflect.Value, drop bool) error {
+	v, cur = indirect(v), indirect(cur)
+	if cur.IsValid() && cur.Type() != v.Type() {
+		cur = reflect.Value{}
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if !v.CanSet() {
+			return nil
+		}
+		return restrictStruct(data, v, cur, drop)
+	case reflect.Slice, reflect.Array:
+		var items []json.RawMessage
+		json.Unmarshal(data, &items)
+		for i := 0; i < v.Len(); i++ {
+			var item []byte
+			if i < len(items) {
+				item = items[i]
+			}
+			var c reflect.Value
+			if cur.IsValid() && i < cur.Len() {
+				c = cur.Index(i)
+			}
+			if err := restrict(item, v.Index(i), c, drop); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		var items map[string]json.RawMessage
+		json.Unmarshal(data, &items)
+		for _, key := range v.MapKeys() {
+			// Map entries can't be changed in place, so each is copied.
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			var c reflect.Value
+			if cur.IsValid() && !cur.IsNil() {
+				c = cur.MapIndex(key)
+			}
+			if err := restrict(items[keyString(key)], elem, c, drop); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+	return nil
+}
+
+// restrictStruct implements restrict for the settable struct v.
+func restrictStruct(data []byte, v, cur reflect.Value, drop bool) error {
+	typ := v.Type()
+	if !cur.IsValid() {
+		cur = reflect.Zero(typ)
+	}
+	var present map[string]json.RawMessage
+	json.Unmarshal(data, &present)
+	// lookup returns the value of the key for name, which encoding/json
+	// matches without regard to case.
+	lookup := func(name string) (string, []byte) {
+		if val, ok := present[name]; ok {
+			return name, val
+		}
+		for key, val := range present {
+			if strings.EqualFold(key, name) {
+				return key, val
+			}
+		}
+		return "", nil
+	}
+
+	allowed := creatable(typ)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name, ok := jsonName(field)
+		opts, _ := parseTag(field.Tag.Get("rest"))
+		switch {
+		case opts.readOnly:
+			v.Field(i).Set(cur.Field(i))
+			continue
+		case allowed != nil && !allowed[i] && ok:
+			if key, _ := lookup(name); key != "" && !drop {
+				return &statusError{http.StatusForbidden, fmt.Sprintf("field %q cannot be set", key)}
+			}
+			v.Field(i).Set(cur.Field(i))
+			continue
+		}
+
+		var sub []byte
+		switch {
+		case field.Anonymous && field.Tag.Get("json") == "":
+			// The fields of embedded structs are promoted into data.
+			sub = data
+		case ok:
+			_, sub = lookup(name)
+		}
+		if err := restrict(sub, v.Field(i), cur.Field(i), drop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
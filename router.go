@@ -0,0 +1,109 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Router serves several trees, each under its own name.  A request for
+// /name/path is served by the Object added as name, with the path /path.  A
+// GET of / lists the paths of the trees (as a NotFound does), and a request
+// for any other name is answered with the listing and 404 Not Found.
+//
+// A Router is itself an http.Handler which serves paths starting at /; see
+// Handler to mount it elsewhere.
+type Router struct {
+	mu    sync.RWMutex
+	roots map[string]*Object
+}
+
+// NewRouter returns a Router with no trees.
+func NewRouter() *Router {
+	return &Router{roots: make(map[string]*Object)}
+}
+
+// Add adds obj to rt under name, replacing any Object already added with
+// that name.  The name must be a single path element.
+func (rt *Router) Add(name string, obj *Object) {
+	if name == "" || strings.Contains(name, "/") {
+		panic(fmt.Sprintf("rest: invalid router name %q", name))
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.roots[name] = obj
+}
+
+// Handler returns an http.Handler which serves rt under prefix (such as
+// "/api"), for mounting on a ServeMux as prefix+"/".
+func (rt *Router) Handler(prefix string) http.Handler {
+	return http.StripPrefix(strings.TrimSuffix(prefix, "/"), rt)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	rt.mu.RLock()
+	obj, ok := rt.roots[name]
+	rt.mu.RUnlock()
+	switch {
+	case ok:
+		http.StripPrefix("/"+name, obj).ServeHTTP(w, r)
+	case name != "":
+		rt.serveIndex(w, r, http.StatusNotFound)
+	case r.Method == "GET" || r.Method == "HEAD":
+		rt.serveIndex(w, r, http.StatusOK)
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, r.Method+" not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveIndex responds to r with the paths of the trees in rt, like
+// serveNotFound.
+func (rt *Router) serveIndex(w http.ResponseWriter, r *http.Request, code int) {
+	index := NotFound{Path: "/", Children: []string{}}
+	rt.mu.RLock()
+	for name := range rt.roots {
+		index.Children = append(index.Children, name)
+	}
+	rt.mu.RUnlock()
+	sort.Strings(index.Children)
+
+	if prefersPlainText(r) {
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("Content-Type", PlainText)
+		w.WriteHeader(code)
+		for _, name := range index.Children {
+			fmt.Fprintln(w, "/"+name)
+		}
+		return
+	}
+	buf := new(bytes.Buffer)
+	if code, err := encodeAccepted(buf, w.Header(), r, reflect.ValueOf(index)); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteHeader(code)
+	buf.WriteTo(w)
+}
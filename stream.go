@@ -0,0 +1,198 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// encodeTree writes the value of obj to w like encodeAccepted.  JSON is
+// written one node of the tree at a time, and the encoding stops (with 503
+// Service Unavailable) as soon as the context of r is cancelled, so that
+// large trees aren't encoded for clients which have gone away.
+func (obj *Object) encodeTree(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	query := r.URL.Query()
+	_, canonical := query["canonical"]
+	if _, ok := encoderFor(r).(jsonCodec); !ok || canonical {
+		return encodeAccepted(w, headers, r, obj.view())
+	}
+	headers.Add("Vary", "Accept")
+	headers.Set("Content-Type", ApplicationJSON)
+
+	_, noescape := query["noescape"]
+	s := &streamer{ctx: r.Context(), escape: !noescape}
+	if err := s.node(obj); err != nil {
+		if r.Context().Err() != nil {
+			return http.StatusServiceUnavailable, fmt.Errorf("request cancelled: %s", err)
+		}
+		return http.StatusInternalServerError, fmt.Errorf("encode %s: %s", obj.path, err)
+	}
+	s.buf.WriteByte('\n')
+
+	if _, ok := query["pretty"]; ok {
+		var out bytes.Buffer
+		if err := json.Indent(&out, s.buf.Bytes(), "", "  "); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		out.WriteTo(w)
+		return http.StatusOK, nil
+	}
+	s.buf.WriteTo(w)
+	return http.StatusOK, nil
+}
+
+// A streamer writes the JSON encoding of a tree of objects, checking its
+// context before each node.  The output is the same as encoding the view of
+// the tree with a json.Encoder.
+type streamer struct {
+	ctx    context.Context
+	escape bool // escape <, >, and & as json.Encoder does by default
+	buf    bytes.Buffer
+}
+
+// node writes the encoding of obj.
+func (s *streamer) node(obj *Object) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	if obj.opaque() {
+		return s.value(obj.viewData())
+	}
+
+	o := obj.deref()
+	v := indirect(o.root)
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := o.viewStruct(v)
+		s.buf.WriteByte('{')
+		for i, field := range fields {
+			if i > 0 {
+				s.buf.WriteByte(',')
+			}
+			if err := s.value(field.Name); err != nil {
+				return err
+			}
+			s.buf.WriteByte(':')
+			// Scalars are encoded from the view, since the field options
+			// may change how they are encoded.
+			if child, ok := o.child[field.Name]; ok && (!child.isLeaf() || child.opaque()) {
+				if err := s.node(child); err != nil {
+					return err
+				}
+			} else if err := s.value(field.Value); err != nil {
+				return err
+			}
+		}
+		s.buf.WriteByte('}')
+		return nil
+	case reflect.Map:
+		if v.IsNil() {
+			s.buf.WriteString("null")
+			return nil
+		}
+		keys := make([]string, 0, len(o.child))
+		for key := range o.child {
+			keys = append(keys, key)
+		}
+		o.sortKeys(keys)
+		s.buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				s.buf.WriteByte(',')
+			}
+			if err := s.value(key); err != nil {
+				return err
+			}
+			s.buf.WriteByte(':')
+			if err := s.node(o.child[key]); err != nil {
+				return err
+			}
+		}
+		s.buf.WriteByte('}')
+		return nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			s.buf.WriteString("null")
+			return nil
+		}
+		s.buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				s.buf.WriteByte(',')
+			}
+			child, ok := o.child[strconv.Itoa(i)]
+			if !ok {
+				if err := s.value(v.Index(i).Interface()); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.node(child); err != nil {
+				return err
+			}
+		}
+		s.buf.WriteByte(']')
+		return nil
+	}
+	return s.value(obj.viewData())
+}
+
+// value writes the encoding of v, which is encoded all at once.
+func (s *streamer) value(v interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(s.escape)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	s.buf.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return nil
+}
+
+// opaque returns true if obj must be encoded all at once, because its
+// encoding isn't made up of the encodings of its children.
+func (obj *Object) opaque() bool {
+	if obj.isStringer() || obj.opts.bigNum > 0 || obj.truncated || isNil(obj.root) {
+		return true
+	}
+	o := obj.deref()
+	if o.cycle != nil || o.isStringer() || stringerParser(indirect(o.root).Type()) != nil {
+		return true
+	}
+	if marshals(obj.typ) || marshals(o.typ) {
+		return true
+	}
+	switch v := indirect(o.root); v.Kind() {
+	case reflect.Slice:
+		// encoding/json writes []byte as a base64 string
+		return v.Type().Elem().Kind() == reflect.Uint8
+	case reflect.Struct:
+		// Embedded fields are promoted by encoding/json, but only by
+		// viewStruct if they are walked.
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).Anonymous {
+				return true
+			}
+		}
+	}
+	return false
+}
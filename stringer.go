@@ -0,0 +1,119 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+var stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+
+// A ParseFunc parses the output of a String method back into a value.
+type ParseFunc func(string) (interface{}, error)
+
+var stringers = struct {
+	sync.RWMutex
+	parse map[reflect.Type]ParseFunc
+}{
+	parse: map[reflect.Type]ParseFunc{},
+}
+
+// RegisterStringer causes all leaves with the same type as example to be
+// encoded as the JSON string returned by their String method.  The parse
+// function is used to decode such leaves when they are written.
+//
+// Fields which are tagged `rest:"stringer"` are also encoded as strings, but
+// they can only be written if a parse function is registered for their type.
+//
+// Types must be registered before the objects containing them are created.
+func RegisterStringer(example fmt.Stringer, parse ParseFunc) {
+	stringers.Lock()
+	defer stringers.Unlock()
+	stringers.parse[reflect.TypeOf(example)] = parse
+}
+
+func stringerParser(typ reflect.Type) ParseFunc {
+	stringers.RLock()
+	defer stringers.RUnlock()
+	return stringers.parse[typ]
+}
+
+// isStringer returns true if obj is encoded using its String method.
+func (obj *Object) isStringer() bool {
+	return obj.opts.stringer || isStringerType(obj.typ)
+}
+
+// isStringerType returns true if values of the given type (or the type it
+// points to) have a registered ParseFunc.
+func isStringerType(typ reflect.Type) bool {
+	if stringerParser(typ) != nil {
+		return true
+	}
+	return typ.Kind() == reflect.Ptr && stringerParser(typ.Elem()) != nil
+}
+
+// stringify returns the result of calling String on v, or nil if v is a nil
+// pointer or interface.
+func stringify(v reflect.Value) interface{} {
+	if isNil(v) {
+		return nil
+	}
+	for {
+		if v.Type().Implements(stringerType) {
+			return v.Interface().(fmt.Stringer).String()
+		}
+		if v.CanAddr() && v.Addr().Type().Implements(stringerType) {
+			return v.Addr().Interface().(fmt.Stringer).String()
+		}
+		if k := v.Kind(); k != reflect.Ptr && k != reflect.Interface {
+			return v.Interface()
+		}
+		v = v.Elem()
+	}
+}
+
+// decodeString decodes a JSON string from r and parses it into a value of
+// the given type using the registered ParseFunc.
+func decodeString(r io.Reader, typ reflect.Type) (reflect.Value, error) {
+	parse, elem := stringerParser(typ), typ
+	if parse == nil && typ.Kind() == reflect.Ptr {
+		parse, elem = stringerParser(typ.Elem()), typ.Elem()
+	}
+	if parse == nil {
+		return reflect.Value{}, fmt.Errorf("no parse function registered for %s", typ)
+	}
+	var str string
+	if err := json.NewDecoder(r).Decode(&str); err != nil {
+		return reflect.Value{}, fmt.Errorf("failed to decode body as JSON string: %s", err)
+	}
+	val, err := parse(str)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("failed to parse %q: %s", str, err)
+	}
+	v := reflect.ValueOf(val)
+	if !v.IsValid() || !v.Type().AssignableTo(elem) {
+		return reflect.Value{}, fmt.Errorf("parse function for %s returned %T", elem, val)
+	}
+	if elem != typ {
+		ptr := reflect.New(elem)
+		ptr.Elem().Set(v)
+		v = ptr
+	}
+	return v, nil
+}
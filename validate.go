@@ -0,0 +1,112 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// A Validator is a value which can check its own consistency.
+type Validator interface {
+	Validate() error
+}
+
+var validatorType = reflect.TypeOf((*Validator)(nil)).Elem()
+
+// A Problem is reported by GET /path?validate for each value at or below
+// the path whose Validate method returns an error.
+type Problem struct {
+	Path  string
+	Error string
+}
+
+// validate returns the problems reported by the Validators at or below obj,
+// ordered by path.  The caller must hold obj.rw.
+func (obj *Object) validate() []Problem {
+	problems := []Problem{}
+	obj.walkValidators(&problems)
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Path < problems[j].Path
+	})
+	return problems
+}
+
+func (obj *Object) walkValidators(problems *[]Problem) {
+	// Check the value held by a pointer or interface instead of the pointer
+	// itself, so that each value is only validated once.
+	if obj.elem != nil {
+		obj.elem.walkValidators(problems)
+		return
+	}
+
+	if val := validatorOf(obj.root); val != nil {
+		if err := val.Validate(); err != nil {
+			*problems = append(*problems, Problem{obj.path, err.Error()})
+		}
+	}
+	for _, child := range obj.child {
+		child.walkValidators(problems)
+	}
+}
+
+// validatorOf returns v as a Validator, or nil if neither v nor a pointer to
+// it is a Validator (or if v is nil).  If only the pointer is, v is used
+// through its address if it has one, and through a copy otherwise.
+func validatorOf(v reflect.Value) Validator {
+	if !v.IsValid() || isNil(v) {
+		return nil
+	}
+	if v.Type().Implements(validatorType) {
+		return v.Interface().(Validator)
+	}
+	if !reflect.PtrTo(v.Type()).Implements(validatorType) {
+		return nil
+	}
+	if v.CanAddr() {
+		return v.Addr().Interface().(Validator)
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Interface().(Validator)
+}
+
+// checkValid returns an error if v is a Validator which reports a problem.
+// It is used to reject values before they are written to the tree.
+func checkValid(v reflect.Value) error {
+	if val := validatorOf(v); val != nil {
+		if err := val.Validate(); err != nil {
+			return &statusError{http.StatusBadRequest, err.Error()}
+		}
+	}
+	return nil
+}
+
+// getValidation writes the problems reported by the Validators at or below
+// obj.  The caller must hold obj.rw.
+func (obj *Object) getValidation(w io.Writer, headers http.Header, r *http.Request) (int, error) {
+	return encodeJSON(w, headers, r, reflect.ValueOf(obj.validate()))
+}
+
+// setWarnings adds a Warning header (RFC 7234) to headers for each problem
+// reported by the Validators at or below obj.  The caller must hold obj.rw.
+func (obj *Object) setWarnings(headers http.Header) {
+	for _, p := range obj.validate() {
+		headers.Add("Warning", fmt.Sprintf("199 - %q", p.Path+": "+p.Error))
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// recordChange advances the version of the tree containing obj after the
+// operation op changed the object at path.  If created is set, the path did
+// not exist before.  The notify function is called with the new version
+// before any other change can be recorded, so that events for the tree are
+// sent in the order of their versions.
+func (obj *Object) recordChange(op, path string, created bool, notify func(version uint64)) {
+	top := obj.top()
+	top.changes.Lock()
+	defer top.changes.Unlock()
+
+	top.changes.version++
+	if top.changes.added == nil {
+		top.changes.added = &addedNode{}
+	}
+	elems := pathElems(path)
+	switch {
+	case len(elems) == 0:
+		// The root is never added, but its children may be replaced.
+		top.changes.added.prune(obj)
+	case op == "delete":
+		// Forget the removed path and everything below it
+		if parent := top.changes.added.find(elems[:len(elems)-1], false); parent != nil {
+			delete(parent.child, elems[len(elems)-1])
+			if obj.parent != nil && obj.parent.kind == reflect.Slice {
+				parent.shift(elems[len(elems)-1])
+			}
+		}
+	case created:
+		top.changes.added.find(elems, true).version = top.changes.version
+	default:
+		// Forget the paths below the replaced one which no longer exist.
+		if n := top.changes.added.find(elems, false); n != nil {
+			n.prune(obj)
+		}
+	}
+	notify(top.changes.version)
+}
+
+// An addedNode holds the version at which a path in the tree was added, and
+// the nodes for the paths below it which have been added since.  The nodes
+// are keyed by the elements of the paths, so that a change only visits the
+// nodes for the changed path and its ancestors.
+type addedNode struct {
+	version uint64
+	child   map[string]*addedNode
+}
+
+// find returns the node below n for the path with the given elements.  If
+// create is set, it and its ancestors are created if necessary; otherwise
+// find returns nil if there is no node for the path.
+func (n *addedNode) find(elems []string, create bool) *addedNode {
+	for _, name := range elems {
+		next, ok := n.child[name]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if n.child == nil {
+				n.child = map[string]*addedNode{}
+			}
+			next = &addedNode{}
+			n.child[name] = next
+		}
+		n = next
+	}
+	return n
+}
+
+// shift renumbers the nodes below n for the elements of a slice after the
+// removed element with the given index, which move down by one.
+func (n *addedNode) shift(removed string) {
+	i, err := strconv.Atoi(removed)
+	if err != nil {
+		return
+	}
+	var later []int
+	for name := range n.child {
+		if j, err := strconv.Atoi(name); err == nil && j > i {
+			later = append(later, j)
+		}
+	}
+	sort.Ints(later)
+	for _, j := range later {
+		n.child[strconv.Itoa(j-1)] = n.child[strconv.Itoa(j)]
+		delete(n.child, strconv.Itoa(j))
+	}
+}
+
+// prune removes the nodes below n for paths which are not in the tree below
+// obj, which is the object at the path of n.
+func (n *addedNode) prune(obj *Object) {
+	o := obj.deref()
+	for name, c := range n.child {
+		child, ok := o.child[name]
+		if !ok {
+			delete(n.child, name)
+			continue
+		}
+		c.prune(child)
+	}
+}
+
+// A ChildList is returned by GET /path?children-since=token.
+type ChildList struct {
+	// Version is the token to use to list the children added after this
+	// list was made.
+	Version string `json:"version"`
+
+	// Children are the paths of the children added since the given token
+	// (or all children, if the token was empty).
+	Children []string `json:"children"`
+}
+
+// getChildrenSince writes the paths of the children of obj which were added
+// after the version in the given token, which is from a previous ChildList.
+// Children which were present when the tree was created are only listed if
+// the token is empty.
+func (obj *Object) getChildrenSince(w io.Writer, headers http.Header, r *http.Request, token string) (int, error) {
+	var since uint64
+	if token != "" {
+		var err error
+		if since, err = strconv.ParseUint(token, 10, 64); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid version %q", token)
+		}
+	}
+
+	top := obj.top()
+	top.changes.Lock()
+	list := ChildList{
+		Version:  strconv.FormatUint(top.changes.version, 10),
+		Children: []string{},
+	}
+	var added map[string]*addedNode
+	if top.changes.added != nil {
+		if n := top.changes.added.find(pathElems(obj.path), false); n != nil {
+			added = n.child
+		}
+	}
+	for name, child := range obj.deref().child {
+		if token == "" || (added[name] != nil && added[name].version > since) {
+			list.Children = append(list.Children, child.path)
+		}
+	}
+	top.changes.Unlock()
+
+	sort.Strings(list.Children)
+	return encodeJSON(w, headers, r, reflect.ValueOf(list))
+}
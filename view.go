@@ -0,0 +1,352 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	marshalerType       = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// marshals returns true if values of type t, or pointers to them, encode
+// themselves with MarshalJSON or MarshalText.
+func marshals(t reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	return t.Implements(marshalerType) || t.Implements(textMarshalerType) ||
+		pt.Implements(marshalerType) || pt.Implements(textMarshalerType)
+}
+
+// marshalerValue returns the value of obj, whose type marshals itself.
+// Marshal methods with pointer receivers are used if obj is addressable, as
+// encoding/json would.
+func (obj *Object) marshalerValue() interface{} {
+	if obj.root.CanAddr() && !obj.typ.Implements(marshalerType) && !obj.typ.Implements(textMarshalerType) {
+		return obj.root.Addr().Interface()
+	}
+	return obj.root.Interface()
+}
+
+// A jsonObject is a JSON object whose fields are encoded in order.
+type jsonObject []jsonField
+
+type jsonField struct {
+	Name  string
+	Value interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// view returns the value which should be encoded for obj.  This is the
+// underlying value unless some part of the tree below obj has options which
+// change how it is encoded, or OmitEmpty or KeyOrder is set.
+func (obj *Object) view() reflect.Value {
+	if top := obj.top(); !obj.custom && !top.OmitEmpty && top.KeyOrder == nil {
+		return obj.root
+	}
+	data := obj.viewData()
+	return reflect.ValueOf(&data).Elem()
+}
+
+// viewData walks the tree below obj and builds a value that encodes the same
+// way encoding/json would encode the underlying value, except that the
+// options on each node are honored.
+func (obj *Object) viewData() interface{} {
+	if c := obj.deref().cycle; c != nil {
+		return jsonObject{{"$ref", c.path}}
+	}
+	if obj.isStringer() {
+		return stringify(obj.root)
+	}
+	if marshals(obj.typ) {
+		return obj.marshalerValue()
+	}
+	top := obj.top()
+	if walk := obj.custom || top.OmitEmpty || top.KeyOrder != nil; !walk || obj.truncated {
+		return obj.root.Interface()
+	}
+
+	if isNil(obj.root) {
+		if obj.opts.template {
+			return template(obj.typ, map[reflect.Type]bool{}).Interface()
+		}
+		return nil
+	}
+	v := indirect(obj.root)
+	if stringerParser(v.Type()) != nil {
+		return stringify(v)
+	}
+	if obj.opts.bigNum > 0 {
+		if s, ok := bigNumString(v, obj.opts.bigNum); ok {
+			return s
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return obj.viewStruct(v)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		keys := make([]string, 0, len(obj.child))
+		for key := range obj.child {
+			keys = append(keys, key)
+		}
+		obj.sortKeys(keys)
+		fields := make(jsonObject, 0, len(keys))
+		for _, key := range keys {
+			fields = append(fields, jsonField{key, obj.child[key].viewData()})
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			if child, ok := obj.child[strconv.Itoa(i)]; ok {
+				list[i] = child.viewData()
+			} else {
+				list[i] = v.Index(i).Interface()
+			}
+		}
+		return list
+	}
+	return v.Interface()
+}
+
+func (obj *Object) viewStruct(v reflect.Value) jsonObject {
+	typ := v.Type()
+	omitEmpty := obj.top().OmitEmpty
+	var fields jsonObject
+	for _, field := range visibleFields(typ) {
+		if ropts, _ := parseTag(field.Tag.Get("rest")); ropts.writeOnly {
+			continue
+		}
+		name, opts := field.name, field.opts
+		fv, ok := fieldByIndex(v, field.Index)
+		if !ok {
+			continue
+		}
+		if (omitEmpty || strings.Contains(opts, ",omitempty")) && isEmptyValue(fv) {
+			continue
+		}
+
+		var val interface{}
+		if child, ok := obj.child[name]; ok {
+			val = child.viewData()
+		} else {
+			val = fv.Interface()
+		}
+		if strings.Contains(opts, ",string") {
+			switch fv.Kind() {
+			case reflect.Bool, reflect.String,
+				reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+				reflect.Float32, reflect.Float64:
+				if b, err := json.Marshal(val); err == nil {
+					val = string(b)
+				}
+			}
+		}
+		fields = append(fields, jsonField{name, val})
+	}
+	return fields
+}
+
+// template returns a zero value of typ in which nil pointers are replaced
+// by pointers to zero values, recursively, so that it shows the full shape
+// of the type.  Recursive types are only expanded once.
+func template(typ reflect.Type, seen map[reflect.Type]bool) reflect.Value {
+	v := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Ptr:
+		if seen[typ] {
+			return v
+		}
+		seen[typ] = true
+		defer delete(seen, typ)
+		ptr := reflect.New(typ.Elem())
+		ptr.Elem().Set(template(typ.Elem(), seen))
+		v.Set(ptr)
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if typ.Field(i).PkgPath != "" {
+				continue // skip unexported fields
+			}
+			v.Field(i).Set(template(typ.Field(i).Type, seen))
+		}
+	}
+	return v
+}
+
+// A visibleField is a field of a struct which encoding/json encodes.  Its
+// Index leads from the struct to the field, through any embedded structs
+// from which it is promoted.
+type visibleField struct {
+	reflect.StructField
+	name   string // the JSON object key
+	opts   string // the options from the json tag, such as ",omitempty"
+	tagged bool   // whether the name is given by the json tag
+}
+
+// visibleFields returns the fields of the struct type typ which encoding/json
+// encodes, in order, including those promoted from embedded structs which
+// aren't given a name by their json tag.  As with encoding/json, a promoted
+// field is hidden by a field with the same name at a shallower depth, and
+// fields with the same name at the same depth are all dropped unless exactly
+// one of them is tagged with the name.
+func visibleFields(typ reflect.Type) []visibleField {
+	var all []visibleField
+	var walk func(t reflect.Type, index []int, seen map[reflect.Type]bool)
+	walk = func(t reflect.Type, index []int, seen map[reflect.Type]bool) {
+		if seen[t] {
+			return // a struct which embeds itself
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			field.Index = append(index[:len(index):len(index)], i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts := tag, ""
+			if comma := strings.Index(tag, ","); comma >= 0 {
+				name, opts = tag[:comma], tag[comma:]
+			}
+			if field.Anonymous && name == "" && elemType(field.Type).Kind() == reflect.Struct {
+				// The exported fields of unexported embedded structs are
+				// promoted too.
+				walk(elemType(field.Type), field.Index, seen)
+				continue
+			}
+			if field.PkgPath != "" {
+				continue // skip unexported fields
+			}
+			f := visibleField{field, name, opts, name != ""}
+			if name == "" {
+				f.name = field.Name
+			}
+			all = append(all, f)
+		}
+	}
+	walk(typ, nil, map[reflect.Type]bool{})
+
+	var fields []visibleField
+	for i, f := range all {
+		// Look for another field with the same name which is shallower, or
+		// is at the same depth and isn't beaten by f being tagged instead.
+		hidden := false
+		for j, g := range all {
+			if j == i || g.name != f.name {
+				continue
+			}
+			if len(g.Index) < len(f.Index) || (len(g.Index) == len(f.Index) && (g.tagged || !f.tagged)) {
+				hidden = true
+				break
+			}
+		}
+		if !hidden {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// fieldByIndex returns the field of the struct v at index, which may lead
+// through embedded pointers.  It returns false if one of them is nil.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// jsonName returns the name of the JSON object key for field, or false if
+// it is not encoded.
+func jsonName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+	tag := field.Tag.Get("json")
+	if comma := strings.Index(tag, ","); comma >= 0 {
+		tag = tag[:comma]
+	}
+	switch tag {
+	case "-":
+		return "", false
+	case "":
+		return field.Name, true
+	}
+	return tag, true
+}
+
+// isEmptyValue reports whether v is empty according to the omitempty rules
+// of encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// A Mutation is an entry in the mutation log.
+type Mutation struct {
+	Time  time.Time
+	Op    string          // the operation (see apply)
+	Path  string          // the path of the object the operation applied to
+	Value json.RawMessage `json:",omitempty"` // the value, if any
+}
+
+// logMutation writes an entry for the mutation op of the object at path to
+// the mutation log, if there is one.  The mutation has already been
+// committed and announced, so a failure to write the entry doesn't fail it;
+// the failure is logged with the log package instead.
+func (obj *Object) logMutation(op, path string, v reflect.Value, stringer bool) {
+	if err := obj.writeMutation(op, path, v, stringer); err != nil {
+		log.Printf("rest: %s", err)
+	}
+}
+
+// writeMutation writes the entry for logMutation.  The path for a put is the
+// path of the new element.  If stringer is set, v is logged as a string.
+func (obj *Object) writeMutation(op, path string, v reflect.Value, stringer bool) error {
+	top := obj.top()
+	if top.MutationLog == nil {
+		return nil
+	}
+
+	m := Mutation{
+		Time: time.Now(),
+		Op:   op,
+		Path: path,
+	}
+	if op == "put" {
+		m.Path = obj.path
+	}
+	if v.IsValid() {
+		var val interface{} = v.Interface()
+		if stringer {
+			val = stringify(v)
+		}
+		raw, err := json.Marshal(val)
+		if err != nil {
+			return fmt.Errorf("mutation log: encode %s: %s", path, err)
+		}
+		m.Value = raw
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("mutation log: encode %s: %s", path, err)
+	}
+	line = append(line, '\n')
+
+	top.logMu.Lock()
+	defer top.logMu.Unlock()
+	if _, err := top.MutationLog.Write(line); err != nil {
+		return fmt.Errorf("mutation log: write %s: %s", path, err)
+	}
+	if !top.SyncMutationLog {
+		return nil
+	}
+	if f, ok := top.MutationLog.(interface {
+		Flush() error
+	}); ok {
+		if err := f.Flush(); err != nil {
+			return fmt.Errorf("mutation log: flush: %s", err)
+		}
+	}
+	if f, ok := top.MutationLog.(interface {
+		Sync() error
+	}); ok {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("mutation log: sync: %s", err)
+		}
+	}
+	return nil
+}
+
+// Replay re-applies the mutations in a mutation log (as written to the
+// MutationLog) to obj, which should be the root of a tree in the state it
+// was in when the log was started.  Replayed mutations fire events but are
+// not written to the mutation log.  Replay stops at the first mutation which
+// cannot be applied.
+func (obj *Object) Replay(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var m Mutation
+		if err := dec.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("replay: %s", err)
+		}
+		if err := obj.replay(m); err != nil {
+			return fmt.Errorf("replay: %s %s: %s", m.Op, m.Path, err)
+		}
+	}
+}
+
+func (obj *Object) replay(m Mutation) error {
+	target, missing := obj.find(strings.Split(m.Path, "/")[1:])
+	if len(missing) == 1 && m.Op == "post" {
+		target = target.newChild(missing[0])
+		missing = nil
+	}
+	if len(missing) > 0 || target == nil {
+		return fmt.Errorf("path not found")
+	}
+
+	defer target.lockWrite(m.Op == "delete")()
+
+	var v reflect.Value
+	switch m.Op {
+	case "post", "patch":
+		var err error
+		if v, err = decodeValue(bytes.NewReader(m.Value), target.typ, target.isStringer()); err != nil {
+			return err
+		}
+	case "put":
+		elem := indirect(target.root).Type()
+		if elem.Kind() != reflect.Slice {
+			return fmt.Errorf("cannot PUT object in non-slice type %s", elem)
+		}
+		var err error
+		if v, err = decodeValue(bytes.NewReader(m.Value), elem.Elem(), isStringerType(elem.Elem())); err != nil {
+			return err
+		}
+	}
+	_, err := target.apply(m.Op, v, false)
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package yamlcodec registers a YAML encoder and decoder with package rest,
+// so that GET requests which accept application/yaml are answered with YAML
+// and YAML request bodies are decoded.  Import it for its side effect:
+//
+//	import _ "kylelemons.net/go/rest/yamlcodec"
+//
+// Values are converted to and from YAML by way of JSON, so they have the
+// same field names and encodings (including json struct tags and
+// MarshalJSON methods) as they do in JSON responses.
+package yamlcodec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+
+	"kylelemons.net/go/rest"
+)
+
+// MIMETypes are the MIME types for which Codec is registered.
+var MIMETypes = []string{"application/yaml", "application/x-yaml", "text/yaml"}
+
+func init() {
+	for _, mimeType := range MIMETypes {
+		rest.RegisterEncoder(mimeType, Codec{})
+		rest.RegisterDecoder(mimeType, Codec{})
+	}
+}
+
+// Codec is a rest.Encoder and rest.Decoder for YAML.
+type Codec struct{}
+
+// ContentType returns the Content-Type of YAML responses.
+func (Codec) ContentType() string { return "application/yaml;charset=utf-8" }
+
+// Encode writes v to w as a YAML document.  Objects keep the order of their
+// keys in JSON.
+func (Codec) Encode(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// JSON is YAML, so it can be parsed as it is; only the style needs to
+	// be changed to make it look like YAML.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	blockStyle(&doc)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// blockStyle clears the style of n and the nodes below it, so that they are
+// written in block style, with strings quoted only where necessary.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// MaxAliasNodes is the largest number of nodes which aliases may add to a
+// decoded document, so that a small document which refers to its anchors
+// many times over (such as a "billion laughs" attack) is rejected instead of
+// being expanded without bound.
+const MaxAliasNodes = 1 << 16
+
+// Decode reads a YAML document from r into v.
+func (Codec) Decode(r io.Reader, v interface{}) error {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		return err
+	}
+	tree, err := new(converter).jsonValue(&doc, false)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// A converter converts YAML nodes to JSON values, counting the nodes which
+// are reached through aliases.
+type converter struct {
+	aliased int
+}
+
+// jsonValue returns the value of n in a form which encoding/json can encode.
+// Mapping keys are converted to strings, as JSON object keys must be.  If
+// aliased is set, n was reached through an alias.
+func (c *converter) jsonValue(n *yaml.Node, aliased bool) (interface{}, error) {
+	if aliased {
+		if c.aliased++; c.aliased > MaxAliasNodes {
+			return nil, fmt.Errorf("line %d: aliases expand to more than %d nodes", n.Line, MaxAliasNodes)
+		}
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return c.jsonValue(n.Content[0], aliased)
+	case yaml.AliasNode:
+		return c.jsonValue(n.Alias, true)
+	case yaml.SequenceNode:
+		list := make([]interface{}, len(n.Content))
+		for i, item := range n.Content {
+			v, err := c.jsonValue(item, aliased)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	case yaml.MappingNode:
+		obj := make(map[string]interface{}, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, val := n.Content[i], n.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: mapping keys must be scalars", key.Line)
+			}
+			v, err := c.jsonValue(val, aliased)
+			if err != nil {
+				return nil, err
+			}
+			obj[key.Value] = v
+		}
+		return obj, nil
+	}
+	var v interface{}
+	if err := n.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package yamlcodec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kylelemons.net/go/rest"
+)
+
+type server struct {
+	Name    string
+	Port    int    `json:"port"`
+	Comment string `json:",omitempty"`
+	Tags    []string
+	Limits  map[int]string
+}
+
+func TestYAML(t *testing.T) {
+	obj := rest.NewObject(&struct{ Server server }{server{
+		Name:   "web",
+		Port:   80,
+		Tags:   []string{"a", "true"},
+		Limits: map[int]string{1: "one"},
+	}})
+
+	req := httptest.NewRequest("GET", "/Server", nil)
+	req.Header.Set("Accept", "application/yaml")
+	rec := httptest.NewRecorder()
+	obj.ServeHTTP(rec, req)
+	if got, want := rec.Header().Get("Content-Type"), (Codec{}).ContentType(); got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	want := `Name: web
+port: 80
+Tags:
+  - a
+  - "true"
+Limits:
+  "1": one
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("GET /Server = %q, want %q", got, want)
+	}
+
+	body := `
+Name: db
+port: 5432
+Comment: "edited by hand"
+Tags: [x]
+Limits:
+  2: two
+`
+	req = httptest.NewRequest("POST", "/Server", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/yaml")
+	rec = httptest.NewRecorder()
+	obj.ServeHTTP(rec, req)
+	if got, want := rec.Code, http.StatusNoContent; got != want {
+		t.Fatalf("POST /Server: code = %v, want %v (%s)", got, want, rec.Body)
+	}
+
+	req = httptest.NewRequest("GET", "/Server", nil)
+	rec = httptest.NewRecorder()
+	obj.ServeHTTP(rec, req)
+	wantJSON := `{"Name":"db","port":5432,"Comment":"edited by hand","Tags":["x"],"Limits":{"2":"two"}}`
+	if got := strings.TrimSpace(rec.Body.String()); got != wantJSON {
+		t.Errorf("after POST: GET /Server = %s, want %s", got, wantJSON)
+	}
+
+	req = httptest.NewRequest("POST", "/Server/Tags", strings.NewReader("- [nested]\n"))
+	req.Header.Set("Content-Type", "application/yaml")
+	rec = httptest.NewRecorder()
+	obj.ServeHTTP(rec, req)
+	if got, want := rec.Code, http.StatusBadRequest; got != want {
+		t.Errorf("POST of the wrong type: code = %v, want %v", got, want)
+	}
+}
+
+func TestAliasLimit(t *testing.T) {
+	obj := rest.NewObject(&struct{ Value interface{} }{})
+
+	// Each level refers to the one before it ten times, so the last level
+	// expands to a billion strings.
+	body := "a: &a [x, x, x, x, x, x, x, x, x, x]\n"
+	for i, prev := 1, "a"; i < 9; i++ {
+		name := string(rune('a' + i))
+		body += name + ": &" + name + " [" + strings.TrimSuffix(strings.Repeat("*"+prev+", ", 10), ", ") + "]\n"
+		prev = name
+	}
+	req := httptest.NewRequest("POST", "/Value", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/yaml")
+	rec := httptest.NewRecorder()
+	obj.ServeHTTP(rec, req)
+	if got, want := rec.Code, http.StatusBadRequest; got != want {
+		t.Fatalf("POST of a billion laughs: code = %v, want %v", got, want)
+	}
+	if got, want := rec.Body.String(), "aliases expand to more than"; !strings.Contains(got, want) {
+		t.Errorf("POST of a billion laughs: body = %q, want it to contain %q", got, want)
+	}
+
+	// Aliases which expand to a reasonable size are fine.
+	req = httptest.NewRequest("POST", "/Value", strings.NewReader("base: &b {x: 1}\ncopy: *b\n"))
+	req.Header.Set("Content-Type", "application/yaml")
+	rec = httptest.NewRecorder()
+	obj.ServeHTTP(rec, req)
+	if got, want := rec.Code, http.StatusNoContent; got != want {
+		t.Errorf("POST with an alias: code = %v, want %v (%s)", got, want, rec.Body)
+	}
+}